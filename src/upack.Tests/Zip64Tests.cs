@@ -0,0 +1,164 @@
+﻿using System;
+using System.IO;
+using System.IO.Compression;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+using Microsoft.VisualStudio.TestTools.UnitTesting;
+
+namespace Inedo.UPack.CLI.Tests
+{
+    // Round-trips packages that need Zip64 through pack, repack, and install. They write several GB to the temp directory and
+    // take minutes, so they only run when the UPACK_ZIP64_TESTS environment variable is set to 1.
+    [TestClass]
+    [TestCategory("Zip64")]
+    public sealed class Zip64Tests
+    {
+        // more than the 65,535 entries that fit in a zip archive without Zip64
+        private const int ManyEntriesCount = 70000;
+        // more than the 4 GB that fit in the size fields of a zip entry without Zip64
+        private const long LargeEntrySize = (4L << 30) + 4096;
+
+        private static readonly byte[] Marker = { 0x75, 0x70, 0x61, 0x63, 0x6B, 0x36, 0x34, 0x21 };
+
+        private string workingDirectory;
+
+        [TestInitialize]
+        public void Initialize()
+        {
+            if (Environment.GetEnvironmentVariable("UPACK_ZIP64_TESTS") != "1")
+                Assert.Inconclusive("Set UPACK_ZIP64_TESTS=1 to run the Zip64 tests.");
+
+            this.workingDirectory = Path.Combine(Path.GetTempPath(), "upack-zip64-" + Guid.NewGuid().ToString("N"));
+            Directory.CreateDirectory(this.workingDirectory);
+        }
+
+        [TestCleanup]
+        public void Cleanup()
+        {
+            if (this.workingDirectory != null && Directory.Exists(this.workingDirectory))
+                Directory.Delete(this.workingDirectory, true);
+        }
+
+        [TestMethod]
+        public async Task ManyEntries()
+        {
+            var sourcePath = Path.Combine(this.workingDirectory, "source");
+            for (int i = 0; i < ManyEntriesCount; i++)
+            {
+                var path = Path.Combine(sourcePath, (i / 1000).ToString("D3"), i.ToString("D5") + ".txt");
+                Directory.CreateDirectory(Path.GetDirectoryName(path));
+                File.WriteAllText(path, i.ToString());
+            }
+
+            var installedPath = await this.RoundTripAsync("many", sourcePath, false);
+
+            Assert.AreEqual(ManyEntriesCount, Directory.EnumerateFiles(installedPath, "*", SearchOption.AllDirectories).Count());
+            foreach (int i in new[] { 0, 65535, ManyEntriesCount - 1 })
+                Assert.AreEqual(i.ToString(), File.ReadAllText(Path.Combine(installedPath, (i / 1000).ToString("D3"), i.ToString("D5") + ".txt")));
+        }
+
+        [TestMethod]
+        public async Task LargeEntry()
+        {
+            var sourcePath = Path.Combine(this.workingDirectory, "source");
+            Directory.CreateDirectory(sourcePath);
+
+            // the file is all zeros except for a marker at the end, so it is sparse where the file system supports it and the
+            // package compresses to a few MB
+            using (var file = new FileStream(Path.Combine(sourcePath, "large.bin"), FileMode.CreateNew, FileAccess.Write))
+            {
+                file.SetLength(LargeEntrySize);
+                file.Position = LargeEntrySize - Marker.Length;
+                file.Write(Marker, 0, Marker.Length);
+            }
+
+            var installedPath = await this.RoundTripAsync("large", sourcePath, true);
+
+            var installedFile = Path.Combine(installedPath, "large.bin");
+            Assert.AreEqual(LargeEntrySize, new FileInfo(installedFile).Length);
+            using (var file = File.OpenRead(installedFile))
+            {
+                var tail = new byte[Marker.Length];
+                file.Position = LargeEntrySize - Marker.Length;
+                Assert.AreEqual(Marker.Length, file.Read(tail, 0, tail.Length));
+                CollectionAssert.AreEqual(Marker, tail);
+            }
+        }
+
+        // Packs the source directory as zip64/«name» 1.0.0, repacks it as 1.0.1, installs the repacked package from the package
+        // cache, and returns the directory it was installed to; the contents of both archives are checked along the way.
+        private async Task<string> RoundTripAsync(string name, string sourcePath, bool reproducible)
+        {
+            var packedPath = Path.Combine(this.workingDirectory, "packed");
+            var pack = new Pack
+            {
+                SourcePath = sourcePath,
+                TargetDirectory = packedPath,
+                Group = "zip64",
+                Name = name,
+                Version = "1.0.0",
+                NoAudit = true,
+                Reproducible = reproducible
+            };
+            Assert.AreEqual(0, await pack.RunAsync(CancellationToken.None));
+
+            var packedFile = Path.Combine(packedPath, name + "-1.0.0.upack");
+            AssertSameContents(sourcePath, packedFile);
+
+            var repackedPath = Path.Combine(this.workingDirectory, "repacked");
+            var repack = new Repack
+            {
+                SourcePath = packedFile,
+                TargetDirectory = repackedPath,
+                NewVersion = "1.0.1"
+            };
+            Assert.AreEqual(0, await repack.RunAsync(CancellationToken.None));
+
+            var repackedFile = Path.Combine(repackedPath, name + "-1.0.1.upack");
+            AssertSameContents(sourcePath, repackedFile);
+
+            var registryPath = Path.Combine(this.workingDirectory, "registry");
+            using (var registry = new Registry(registryPath))
+            using (var file = File.OpenRead(repackedFile))
+            {
+                await registry.WriteToCacheAsync(new UniversalPackageId("zip64", name), UniversalPackageVersion.Parse("1.0.1"), file, CancellationToken.None);
+            }
+
+            var installedPath = Path.Combine(this.workingDirectory, "installed");
+            var install = new Install
+            {
+                PackageName = "zip64/" + name,
+                Version = "1.0.1",
+                TargetDirectory = installedPath,
+                RegistryPath = registryPath,
+                Offline = true
+            };
+            Assert.AreEqual(0, await install.RunAsync(CancellationToken.None));
+
+            return installedPath;
+        }
+
+        // Checks that the package has an entry of the same size for every file in the source directory, and no others.
+        private static void AssertSameContents(string sourcePath, string packageFile)
+        {
+            using (var zip = ZipFile.OpenRead(packageFile))
+            {
+                var entries = zip.Entries
+                    .Where(e => e.FullName.StartsWith("package/") && !e.FullName.EndsWith("/"))
+                    .ToDictionary(e => e.FullName.Substring("package/".Length), e => e.Length);
+
+                var files = Directory.EnumerateFiles(sourcePath, "*", SearchOption.AllDirectories).ToList();
+                Assert.AreEqual(files.Count, entries.Count, $"{packageFile} has a different number of files than {sourcePath}.");
+
+                foreach (var file in files)
+                {
+                    var relativePath = file.Substring(sourcePath.Length + 1).Replace(Path.DirectorySeparatorChar, '/');
+                    Assert.IsTrue(entries.TryGetValue(relativePath, out long length), $"{relativePath} is not in {packageFile}.");
+                    Assert.AreEqual(new FileInfo(file).Length, length, $"{relativePath} has a different size in {packageFile}.");
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,150 @@
+﻿using System;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("bump")]
+    [Description("Creates a copy of an existing package with its version incremented and an audit note recording the change.")]
+    public sealed class Bump : Command
+    {
+        [DisplayName("source")]
+        [Description("The path of the existing upack file.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string SourcePath { get; set; }
+
+        [DisplayName("major")]
+        [Description("Increment the major version and reset the minor and patch versions to 0.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Major { get; set; } = false;
+
+        [DisplayName("minor")]
+        [Description("Increment the minor version and reset the patch version to 0.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Minor { get; set; } = false;
+
+        [DisplayName("patch")]
+        [Description("Increment the patch version.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Patch { get; set; } = false;
+
+        [DisplayName("prerelease")]
+        [Description("Prerelease label, such as rc.1, to give the new version. If used without --major, --minor, or --patch, a stable version has its patch version incremented and a prerelease version keeps its number.")]
+        [ExtraArgument]
+        public string Prerelease { get; set; }
+
+        [DisplayName("targetDirectory")]
+        [Description("Directory where the .upack file will be created. If not specified, the directory of the source file is used.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string TargetDirectory { get; set; }
+
+        [DisplayName("note")]
+        [Description("A description of the purpose for the new version that will be entered as the audit note.")]
+        [ExtraArgument]
+        public string Note { get; set; }
+
+        [DisplayName("no-audit")]
+        [Description("Do not store audit information in the UPack manifest.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool NoAudit { get; set; } = false;
+
+        [DisplayName("overwrite")]
+        [Description("Overwrite existing package file if it already exists.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Overwrite { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            if (new[] { this.Major, this.Minor, this.Patch }.Count(b => b) + (this.Prerelease != null ? 1 : 0) == 0)
+                throw new UpackException(ExitCode.InvalidArguments, "One of --major, --minor, --patch, or --prerelease must be specified.");
+
+            if (new[] { this.Major, this.Minor, this.Patch }.Count(b => b) > 1)
+                throw new UpackException(ExitCode.InvalidArguments, "Only one of --major, --minor, or --patch can be specified.");
+
+            if (this.NoAudit && !string.IsNullOrEmpty(this.Note))
+                throw new UpackException(ExitCode.InvalidArguments, "--no-audit cannot be used with --note.");
+
+            var info = GetPackageMetadata(this.SourcePath);
+            var oldVersion = info.Version;
+            var newVersion = this.GetNextVersion(oldVersion);
+            if (newVersion == null)
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid prerelease label: {this.Prerelease}");
+
+            var id = (string.IsNullOrEmpty(info.Group) ? "" : info.Group + "/") + info.Name + ":" + oldVersion + ":" + GetSHA1(this.SourcePath);
+
+            info.Version = newVersion;
+            PrintManifest(info);
+
+            if (!this.NoAudit)
+                this.AddRepackageHistory(info, id, this.Note ?? $"Version bumped from {oldVersion} to {newVersion}.");
+
+            string relativePackageFileName = $"{info.Name}-{newVersion.Major}.{newVersion.Minor}.{newVersion.Patch}.upack";
+            string targetFileName = Path.Combine(this.TargetDirectory ?? Path.GetDirectoryName(this.SourcePath), relativePackageFileName);
+
+            if (!this.Overwrite && File.Exists(targetFileName) && !Confirm($"{targetFileName} already exists. Overwrite?", false))
+                throw new UpackException(ExitCode.Conflict, $"Target file '{targetFileName}' exists and overwrite was set to false.")
+                {
+                    Code = ErrorCodes.FileExists
+                };
+
+            string tmpPath = Path.GetTempFileName();
+
+            using (var existingPackage = new UniversalPackage(this.SourcePath))
+            {
+                var manifest = MergeManifest(await ReadManifestTextAsync(existingPackage), info);
+                await RewritePackageAsync(existingPackage, tmpPath, manifest, cancellationToken);
+            }
+
+            Directory.CreateDirectory(Path.GetDirectoryName(targetFileName));
+            File.Delete(targetFileName);
+            File.Move(tmpPath, targetFileName);
+
+            Log.Success($"Bumped {oldVersion} to {newVersion}: {targetFileName}");
+
+            return 0;
+        }
+
+        // Follows semver precedence: bumping a prerelease to the stable version it precedes, such as 2.0.0-rc.1 --major, yields 2.0.0.
+        private UniversalPackageVersion GetNextVersion(UniversalPackageVersion version)
+        {
+            bool isPrerelease = !string.IsNullOrEmpty(version.Prerelease);
+            var major = version.Major;
+            var minor = version.Minor;
+            var patch = version.Patch;
+
+            if (this.Major)
+            {
+                if (!isPrerelease || minor != 0 || patch != 0)
+                    major++;
+                minor = 0;
+                patch = 0;
+            }
+            else if (this.Minor)
+            {
+                if (!isPrerelease || patch != 0)
+                    minor++;
+                patch = 0;
+            }
+            else if (!isPrerelease)
+            {
+                // --patch, or --prerelease alone on a stable version
+                patch++;
+            }
+
+            var prerelease = string.IsNullOrEmpty(this.Prerelease) ? null : this.Prerelease;
+            var result = new UniversalPackageVersion(major, minor, patch, prerelease, null);
+            return UniversalPackageVersion.TryParse(result.ToString()) != null ? result : null;
+        }
+    }
+}
@@ -0,0 +1,12 @@
+﻿namespace Inedo.UPack.CLI
+{
+    // A version in the package cache of a registry. SHA256 is null for a package cached by an earlier version of upack, whose
+    // Path is the .upack file itself rather than a blob.
+    public sealed class CachedPackage
+    {
+        public UniversalPackageId Id { get; set; }
+        public UniversalPackageVersion Version { get; set; }
+        public string SHA256 { get; set; }
+        public string Path { get; set; }
+    }
+}
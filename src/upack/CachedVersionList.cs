@@ -0,0 +1,24 @@
+﻿using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    // A response of the versions endpoint of a feed, stored in the version cache of the user registry with its validators.
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class CachedVersionList
+    {
+        [JsonProperty("url")]
+        public string Url { get; set; }
+
+        [JsonProperty("user")]
+        public string UserName { get; set; }
+
+        [JsonProperty("etag")]
+        public string ETag { get; set; }
+
+        [JsonProperty("lastModified")]
+        public string LastModified { get; set; }
+
+        [JsonProperty("body")]
+        public string Body { get; set; }
+    }
+}
@@ -0,0 +1,31 @@
+﻿using System;
+
+namespace Inedo.UPack.CLI
+{
+    // Source of every date recorded by upack (audit fields, registry entries, journal, and lock descriptions).
+    public interface IClock
+    {
+        DateTimeOffset Now { get; }
+    }
+
+    public sealed class SystemClock : IClock
+    {
+        public static readonly SystemClock Instance = new SystemClock();
+
+        private SystemClock()
+        {
+        }
+
+        public DateTimeOffset Now => DateTimeOffset.Now;
+    }
+
+    public sealed class FixedClock : IClock
+    {
+        public FixedClock(DateTimeOffset now)
+        {
+            this.Now = now;
+        }
+
+        public DateTimeOffset Now { get; }
+    }
+}
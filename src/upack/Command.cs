@@ -1,22 +1,31 @@
 ﻿using System;
 using System.Collections.Generic;
 using System.ComponentModel;
+using System.Globalization;
 using System.IO;
+using System.IO.Compression;
 using System.Linq;
 using System.Net;
 using System.Reflection;
+using System.Runtime.CompilerServices;
 using System.Security.Cryptography;
 using System.Text;
+using System.Text.RegularExpressions;
 using System.Threading;
 using System.Threading.Tasks;
 using Inedo.UPack.Net;
 using Inedo.UPack.Packaging;
 using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     public abstract class Command
     {
+        private static readonly ConditionalWeakTable<UniversalFeedClient, Dictionary<string, IReadOnlyList<FeedVersion>>> VersionLists = new ConditionalWeakTable<UniversalFeedClient, Dictionary<string, IReadOnlyList<FeedVersion>>>();
+        // The URL and credentials each client was created with, for the requests that upack sends to the same feed itself.
+        private static readonly ConditionalWeakTable<UniversalFeedClient, Tuple<string, NetworkCredential>> ClientFeeds = new ConditionalWeakTable<UniversalFeedClient, Tuple<string, NetworkCredential>>();
+
         [AttributeUsage(AttributeTargets.Property, AllowMultiple = false, Inherited = true)]
         public sealed class PositionalArgumentAttribute : Attribute
         {
@@ -75,6 +84,8 @@ namespace Inedo.UPack.CLI
             public object DefaultValue => p.GetCustomAttribute<DefaultValueAttribute>()?.Value;
             public bool ExpandPath => p.GetCustomAttribute<ExpandPathAttribute>() != null;
             public string EnvironmentVariable => p.GetCustomAttribute<UseEnvironmentVariableAsDefaultAttribute>()?.EnvironmentVariable;
+            // Arguments of type string[] may be specified more than once; each value is appended.
+            public bool IsRepeatable => p.PropertyType == typeof(string[]);
 
             public abstract string GetUsage();
 
@@ -116,6 +127,13 @@ namespace Inedo.UPack.CLI
                     return true;
                 }
 
+                if (this.IsRepeatable)
+                {
+                    var values = (string[])p.GetValue(cmd) ?? new string[0];
+                    p.SetValue(cmd, values.Concat(new[] { value ?? string.Empty }).ToArray());
+                    return true;
+                }
+
                 if (p.PropertyType == typeof(NetworkCredential))
                 {
                     if (string.IsNullOrWhiteSpace(value))
@@ -127,7 +145,14 @@ namespace Inedo.UPack.CLI
                     var parts = value.Split(new[] { ':' }, 2);
                     if (parts.Length != 2)
                     {
-                        Console.WriteLine($"--{this.DisplayName} must be in the format \"«username»:«password»\" or \"api:«api-key»\".");
+                        // a user name without a password is completed interactively, which keeps the password out of shell history
+                        if (!Console.IsInputRedirected)
+                        {
+                            p.SetValue(cmd, new NetworkCredential(value, ReadPassword($"Password for {value}: ")));
+                            return true;
+                        }
+
+                        Console.WriteLine($"--{this.DisplayName} must be in the format \"«username»:«password»\" or \"api:«api-key»\"; a password can only be prompted for when input is not redirected.");
                         return false;
                     }
 
@@ -184,10 +209,87 @@ namespace Inedo.UPack.CLI
                     s = $"[--{this.DisplayName}]";
                 }
 
+                if (this.IsRepeatable)
+                {
+                    s += "...";
+                }
+
                 return s;
             }
         }
 
+        // Reads a line from the console without echoing it; the prompt is written to standard error so that it is not mixed into output.
+        internal static string ReadPassword(string prompt)
+        {
+            Console.Error.Write(prompt);
+
+            var password = new StringBuilder();
+            while (true)
+            {
+                var key = Console.ReadKey(true);
+                if (key.Key == ConsoleKey.Enter)
+                    break;
+
+                if (key.Key == ConsoleKey.Backspace)
+                {
+                    if (password.Length > 0)
+                        password.Length--;
+                }
+                else if (key.KeyChar != '\0')
+                {
+                    password.Append(key.KeyChar);
+                }
+            }
+
+            Console.Error.WriteLine();
+            return password.ToString();
+        }
+
+        // Set by --yes or -y, which answers yes to every confirmation prompt.
+        internal static bool AssumeYes { get; set; }
+
+        // Asks before a destructive operation, on standard error like ReadPassword. When input is redirected there is nobody to
+        // answer, so unattendedAnswer is used: false for operations that would otherwise fail, such as replacing files without
+        // --overwrite, and true for operations that were explicitly requested, such as registry repair --fix.
+        internal static bool Confirm(string question, bool unattendedAnswer)
+        {
+            if (AssumeYes)
+                return true;
+
+            if (Console.IsInputRedirected)
+                return unattendedAnswer;
+
+            Console.Error.Write(question + " [y/N] ");
+            var answer = Console.ReadLine()?.Trim();
+            return string.Equals(answer, "y", StringComparison.OrdinalIgnoreCase) || string.Equals(answer, "yes", StringComparison.OrdinalIgnoreCase);
+        }
+
+        // Without --overwrite, asks before extracting a package over files that already exist in the target directory. Returns
+        // whether files should be overwritten, and fails if the answer is no.
+        internal static bool ConfirmOverwrite(UniversalPackage package, string targetDirectory, string contentRoot, bool overwrite)
+        {
+            if (overwrite || !Directory.Exists(targetDirectory))
+                return overwrite;
+
+            var root = NormalizeContentRoot(contentRoot);
+            var existing = package.Entries
+                .Where(e => !e.IsDirectory)
+                .Select(e => GetContentPath(e, root))
+                .Where(p => p != null && File.Exists(Path.Combine(targetDirectory, p)))
+                .ToList();
+
+            if (existing.Count == 0)
+                return false;
+
+            if (!Confirm($"{existing.Count} file{(existing.Count == 1 ? " already exists" : "s already exist")} in {targetDirectory}, such as {existing[0]}. Overwrite?", false))
+                throw new UpackException(ExitCode.Conflict, $"{Path.Combine(targetDirectory, existing[0])} already exists; use --overwrite to replace existing files.")
+                {
+                    Code = ErrorCodes.FileExists
+                };
+
+            return true;
+        }
+
         public string DisplayName => this.GetType().GetCustomAttribute<DisplayNameAttribute>()?.DisplayName ?? this.GetType().Name;
         public string Description => this.GetType().GetCustomAttribute<DescriptionAttribute>()?.Description ?? string.Empty;
         public IEnumerable<PositionalArgument> PositionalArguments => this.GetType().GetRuntimeProperties()
@@ -195,8 +297,26 @@ namespace Inedo.UPack.CLI
             .Select(p => new PositionalArgument(p))
             .OrderBy(a => a.Index);
 
+        public IClock Clock { get; set; } = SystemClock.Instance;
+
+        // Commands that support --warnings-as-errors override this.
+        protected virtual bool TreatWarningsAsErrors => false;
+        // Commands that support --legacy-versions override this; pack always validates versions strictly.
+        protected virtual bool AllowLegacyVersions => false;
+
+        // Set by the dispatcher for --json to the original standard output; everything else written to Console.Out then goes
+        // to standard error, so that standard output contains only the JSON result of the command.
+        internal static TextWriter JsonWriter { get; set; }
+        protected static bool JsonOutput => JsonWriter != null;
+
         public abstract Task<int> RunAsync(CancellationToken cancellationToken);
 
+        // Writes the result of the command to standard output with --json; otherwise does nothing.
+        internal static void WriteResult(JToken result)
+        {
+            JsonWriter?.WriteLine(result.ToString(Formatting.Indented));
+        }
+
         public IEnumerable<ExtraArgument> ExtraArguments => this.GetType().GetRuntimeProperties()
             .Where(p => p.GetCustomAttribute<ExtraArgumentAttribute>() != null)
             .Select(p => new ExtraArgument(p));
@@ -298,45 +418,302 @@ namespace Inedo.UPack.CLI
                 }
             }
 
-            if (UniversalPackageVersion.TryParse(info["version"] as string ?? string.Empty) == null)
+            var versionText = info["version"] as string;
+            if (string.IsNullOrEmpty(versionText))
             {
                 return "missing or invalid version.";
             }
+            if (UniversalPackageVersion.TryParse(versionText) == null)
+            {
+                var problem = VersionCheck.Explain(versionText);
+                return problem != null ? $"invalid version {versionText}: {problem}" : "invalid version.";
+            }
 
             if (info.Title != null && info.Title.Length > 50)
             {
                 return "title must be between 0 and 50 characters long.";
             }
 
-            return null;
+            return PackageLicense.Validate(info) ?? PackageTags.Validate(info);
+        }
+
+        // Dependencies are written as «group»/«name», «group»/«name»:«version», or the older «group»:«name»:«version».
+        internal static void ParseDependency(string text, out UniversalPackageId id, out string constraint)
+        {
+            id = null;
+            constraint = null;
+            if (string.IsNullOrWhiteSpace(text))
+                return;
+
+            var parts = text.Trim().Split(':');
+            string fullName;
+            if (parts.Length == 3)
+            {
+                fullName = parts[0] + "/" + parts[1];
+                constraint = parts[2];
+            }
+            else if (parts.Length <= 2)
+            {
+                fullName = parts[0];
+                constraint = parts.Length == 2 ? parts[1] : null;
+            }
+            else
+            {
+                return;
+            }
+
+            try
+            {
+                id = UniversalPackageId.Parse(fullName);
+            }
+            catch (ArgumentException)
+            {
+            }
+        }
+
+        // Prints each problem found by checking the manifest against the embedded schema, and fails if there were any.
+        internal static void CheckManifestSchema(UniversalPackageMetadata info)
+        {
+            var problems = ManifestSchema.Check(info);
+            if (problems.Count == 0)
+                return;
+
+            foreach (var problem in problems)
+                Console.Error.WriteLine("Invalid upack.json (--strict): {0}", problem);
+
+            throw new UpackException(ExitCode.ValidationFailed, $"upack.json has {problems.Count} problem{(problems.Count == 1 ? string.Empty : "s")}.")
+            {
+                Code = ErrorCodes.InvalidManifest
+            };
+        }
+
+        // Packages are read as zip archives, which requires a seekable stream; network streams are buffered to a temporary file.
+        internal static async Task<Stream> EnsureSeekableAsync(Stream stream, CancellationToken cancellationToken)
+        {
+            if (stream.CanSeek)
+                return stream;
+
+            using (stream)
+            {
+                var tempStream = new FileStream(Path.GetTempFileName(), FileMode.Create, FileAccess.ReadWrite, FileShare.None, 4096, FileOptions.DeleteOnClose | FileOptions.Asynchronous);
+                try
+                {
+                    await stream.CopyToAsync(tempStream, 65536, cancellationToken);
+                    tempStream.Position = 0;
+                    return tempStream;
+                }
+                catch
+                {
+                    tempStream.Dispose();
+                    throw;
+                }
+            }
+        }
+
+        internal static async Task<string> ReadManifestTextAsync(UniversalPackage package)
+        {
+            var entry = package.Entries.FirstOrDefault(e => string.Equals(e.RawPath, "upack.json", StringComparison.OrdinalIgnoreCase));
+            if (entry == null)
+                return null;
+
+            using (var reader = new StreamReader(entry.Open()))
+            {
+                return await reader.ReadToEndAsync();
+            }
+        }
+
+        // Applies metadata to the original upack.json, keeping its key order, indentation, and line endings where possible.
+        internal static string MergeManifest(string originalText, UniversalPackageMetadata info)
+        {
+            JObject manifest;
+            if (string.IsNullOrWhiteSpace(originalText))
+            {
+                manifest = new JObject();
+            }
+            else
+            {
+                using (var reader = new JsonTextReader(new StringReader(originalText)) { DateParseHandling = DateParseHandling.None })
+                {
+                    manifest = JObject.Load(reader);
+                }
+            }
+
+            foreach (var name in manifest.Properties().Select(p => p.Name).ToList())
+            {
+                if (!info.ContainsKey(name))
+                    manifest.Remove(name);
+            }
+
+            foreach (var item in info)
+            {
+                if (item.Value == null)
+                {
+                    manifest.Remove(item.Key);
+                    continue;
+                }
+
+                var value = JToken.FromObject(item.Value);
+                var existing = manifest[item.Key];
+                if (existing == null)
+                    manifest.Add(item.Key, value);
+                else if (!JToken.DeepEquals(existing, value))
+                    existing.Replace(value);
+            }
+
+            var indented = originalText == null || originalText.Trim().IndexOf('\n') >= 0;
+            var indentation = Regex.Match(originalText ?? string.Empty, @"\n([ \t]+)\S").Groups[1].Value;
+
+            using (var writer = new StringWriter { NewLine = originalText?.Contains("\r\n") == true ? "\r\n" : "\n" })
+            {
+                using (var jsonWriter = new JsonTextWriter(writer) { CloseOutput = false })
+                {
+                    jsonWriter.Formatting = indented ? Formatting.Indented : Formatting.None;
+                    if (indentation.Length > 0)
+                    {
+                        jsonWriter.IndentChar = indentation[0];
+                        jsonWriter.Indentation = indentation.Length;
+                    }
+
+                    manifest.WriteTo(jsonWriter);
+                }
+
+                if (originalText != null && originalText.EndsWith("\n"))
+                    writer.WriteLine();
+
+                return writer.ToString();
+            }
+        }
+
+        // Copies every entry of a package except upack.json to a new archive, using the specified upack.json instead.
+        internal static async Task RewritePackageAsync(UniversalPackage source, string targetFileName, string manifest, CancellationToken cancellationToken)
+        {
+            using (var targetStream = new FileStream(targetFileName, FileMode.Create, FileAccess.Write, FileShare.None))
+            using (var zip = new ZipArchive(targetStream, ZipArchiveMode.Create))
+            {
+                using (var writer = new StreamWriter(zip.CreateEntry("upack.json").Open(), new UTF8Encoding(false)))
+                {
+                    await writer.WriteAsync(manifest);
+                }
+
+                foreach (var entry in source.Entries)
+                {
+                    if (string.Equals(entry.RawPath, "upack.json", StringComparison.OrdinalIgnoreCase))
+                        continue;
+
+                    cancellationToken.ThrowIfCancellationRequested();
+
+                    if (entry.IsDirectory)
+                    {
+                        zip.CreateEntry(entry.RawPath.TrimEnd('/') + "/");
+                    }
+                    else
+                    {
+                        var targetEntry = zip.CreateEntry(entry.RawPath);
+                        if (entry.Timestamp.Year > 1980)
+                            targetEntry.LastWriteTime = entry.Timestamp;
+
+                        using (var entryStream = entry.Open())
+                        using (var targetEntryStream = targetEntry.Open())
+                        {
+                            await entryStream.CopyToAsync(targetEntryStream, 65536, cancellationToken);
+                        }
+                    }
+                }
+            }
+        }
+
+        // id identifies the original package as «group»/«name»:«version»:«sha1».
+        internal void AddRepackageHistory(UniversalPackageMetadata info, string id, string note)
+        {
+            JArray history;
+            if (info.ContainsKey("repackageHistory"))
+            {
+                history = (JArray)info["repackageHistory"];
+            }
+            else
+            {
+                history = new JArray();
+                info["repackageHistory"] = history;
+            }
+
+            var entry = new Dictionary<string, object>
+            {
+                { "id", id },
+                { "date", this.Clock.Now.UtcDateTime.ToString("u") },
+                { "using", "upack/" + typeof(Command).Assembly.GetName().Version.ToString(3) },
+                { "by", Environment.UserName }
+            };
+
+            if (!string.IsNullOrEmpty(note))
+            {
+                entry["reason"] = note;
+            }
+
+            history.Add(JObject.FromObject(entry));
         }
 
         internal static void PrintManifest(UniversalPackageMetadata info)
         {
             if (!string.IsNullOrEmpty(info.Group))
             {
-                Console.WriteLine($"Package: {info.Group}/{info.Name}");
+                Log.Info($"Package: {info.Group}/{info.Name}");
             }
             else
             {
-                Console.WriteLine($"Package: {info.Name}");
+                Log.Info($"Package: {info.Name}");
             }
 
-            Console.WriteLine($"Version: {info.Version}");
+            Log.Info($"Version: {info.Version}");
+
+            if (!string.IsNullOrEmpty(info.GetLicense()))
+            {
+                Log.Info($"License: {info.GetLicense()}");
+            }
+            if (!string.IsNullOrEmpty(info.GetLicenseUrl()))
+            {
+                Log.Info($"License URL: {info.GetLicenseUrl()}");
+            }
+            if (info.GetTags().Count > 0)
+            {
+                Log.Info($"Tags: {string.Join(", ", info.GetTags())}");
+            }
         }
 
-        internal static async Task UnpackZipAsync(string targetDirectory, bool overwrite, UniversalPackage package, bool preserveTimestamps, CancellationToken cancellationToken)
+        internal const string DefaultContentRoot = "package/";
+
+        // Converts a --root or --content-root value to a prefix of raw archive paths; "/" or "." selects the archive root.
+        internal static string NormalizeContentRoot(string contentRoot)
+        {
+            if (contentRoot == null)
+                return DefaultContentRoot;
+
+            var root = contentRoot.Replace('\\', '/').Trim('/');
+            if (root == string.Empty || root == ".")
+                return string.Empty;
+
+            return root + "/";
+        }
+
+        // Files whose content paths are in excludedPaths are not extracted.
+        internal async Task UnpackZipAsync(string targetDirectory, bool overwrite, UniversalPackage package, bool preserveTimestamps, string contentRoot, CancellationToken cancellationToken, ICollection<string> excludedPaths = null)
         {
             Directory.CreateDirectory(targetDirectory);
+            var fullTargetDirectory = Path.GetFullPath(targetDirectory);
 
-            var entries = package.Entries.Where(e => e.IsContent);
+            var root = NormalizeContentRoot(contentRoot);
 
             int files = 0;
             int directories = 0;
 
-            foreach (var entry in entries)
+            var progress = Progress.Active ? Progress.Start("extract", new UniversalPackageId(package.Group, package.Name), package.Version, totalFiles: package.Entries.Where(e => !e.IsDirectory).Select(e => GetContentPath(e, root)).Count(p => p != null && excludedPaths?.Contains(p) != true)) : null;
+
+            foreach (var entry in package.Entries)
             {
-                var targetPath = Path.Combine(targetDirectory, entry.ContentPath);
+                var contentPath = GetContentPath(entry, root);
+                if (contentPath == null || (!entry.IsDirectory && excludedPaths?.Contains(contentPath) == true))
+                    continue;
+
+                var targetPath = GetTargetPath(fullTargetDirectory, contentPath, entry);
 
                 if (entry.IsDirectory)
                 {
@@ -346,40 +723,124 @@ namespace Inedo.UPack.CLI
                 else
                 {
                     Directory.CreateDirectory(Path.GetDirectoryName(targetPath));
-                    using (var entryStream = entry.Open())
+                    using (var entryStream = progress != null ? new ProgressStream(entry.Open(), progress) : entry.Open())
                     using (var targetStream = new FileStream(targetPath, overwrite ? FileMode.Create : FileMode.CreateNew, FileAccess.Write, FileShare.None, 4096, FileOptions.Asynchronous))
                     {
                         await entryStream.CopyToAsync(targetStream, 65536, cancellationToken);
                     }
 
+                    progress?.Add(0, 1);
+
                     // Assume files with timestamps set to 0 (DOS time) or close to 0 are not timestamped.
                     if (preserveTimestamps && entry.Timestamp.Year > 1980)
                     {
-                        File.SetLastWriteTimeUtc(targetPath, entry.Timestamp.DateTime);
+                        try
+                        {
+                            File.SetLastWriteTimeUtc(targetPath, entry.Timestamp.DateTime);
+                        }
+                        catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException || ex is ArgumentException)
+                        {
+                            this.Warn($"unable to preserve the timestamp of {targetPath}: {ex.Message}");
+                        }
                     }
 
+                    Log.Verbose("Extracted " + contentPath);
                     files++;
                 }
             }
 
-            Console.WriteLine($"Extracted {files} files and {directories} directories.");
+            progress?.Finish();
+            Log.Success($"Extracted {files} files and {directories} directories.");
+            Log.Event("extract", new JObject { ["package"] = new UniversalPackageId(package.Group, package.Name).ToString(), ["version"] = package.Version?.ToString(), ["path"] = targetDirectory, ["files"] = files, ["directories"] = directories });
         }
 
-        internal static async Task<UniversalPackageVersion> GetVersionAsync(UniversalFeedClient client, UniversalPackageId id, string version, bool prerelease, CancellationToken cancellationToken)
+        // Returns the path of an entry relative to the content root, or null if the entry is not part of the contents. Fails if
+        // the path is rooted or has a .. segment, since it would be extracted outside of the target directory.
+        internal static string GetContentPath(UniversalPackageEntry entry, string root)
         {
-            if (!string.IsNullOrEmpty(version) && !string.Equals(version, "latest", StringComparison.OrdinalIgnoreCase) && !prerelease)
+            string contentPath;
+            if (root == DefaultContentRoot)
             {
-                var parsed = UniversalPackageVersion.TryParse(version);
-                if (parsed != null)
-                    return parsed;
+                if (!entry.IsContent)
+                    return null;
 
-                throw new UpackException($"Invalid UPack version number: {version}");
+                contentPath = entry.ContentPath;
             }
+            else
+            {
+                var rawPath = entry.RawPath.Replace('\\', '/');
+                if (!rawPath.StartsWith(root, StringComparison.OrdinalIgnoreCase) || rawPath.Length == root.Length)
+                    return null;
+                if (root == string.Empty && string.Equals(rawPath, "upack.json", StringComparison.OrdinalIgnoreCase))
+                    return null;
 
-            IReadOnlyList<RemoteUniversalPackageVersion> versions;
+                contentPath = rawPath.Substring(root.Length);
+            }
+
+            var normalized = contentPath.Replace('\\', '/');
+            if (normalized.StartsWith("/") || Path.IsPathRooted(contentPath) || normalized.Split('/').Contains(".."))
+                throw new UpackException(ExitCode.ValidationFailed, $"The package is not valid: the entry {entry.RawPath} would be extracted outside of the target directory.")
+                {
+                    Code = ErrorCodes.InvalidPackage
+                };
+
+            return contentPath;
+        }
+
+        // Returns the full path that a content path is extracted to, and fails if it is not inside the target directory.
+        private static string GetTargetPath(string fullTargetDirectory, string contentPath, UniversalPackageEntry entry)
+        {
+            var targetPath = Path.GetFullPath(Path.Combine(fullTargetDirectory, contentPath));
+            var prefix = fullTargetDirectory.EndsWith(Path.DirectorySeparatorChar.ToString()) ? fullTargetDirectory : fullTargetDirectory + Path.DirectorySeparatorChar;
+            if (!targetPath.StartsWith(prefix, StringComparison.OrdinalIgnoreCase) && !string.Equals(targetPath, fullTargetDirectory, StringComparison.OrdinalIgnoreCase))
+                throw new UpackException(ExitCode.ValidationFailed, $"The package is not valid: the entry {entry.RawPath} would be extracted outside of the target directory.")
+                {
+                    Code = ErrorCodes.InvalidPackage
+                };
+
+            return targetPath;
+        }
+
+        // version may be an exact version, a range, or one of the keywords latest, latest-stable, and latest-prerelease.
+        internal async Task<UniversalPackageVersion> GetVersionAsync(UniversalFeedClient client, UniversalPackageId id, string version, bool prerelease, bool includeYanked, CancellationToken cancellationToken)
+        {
+            bool latestStable = string.Equals(version, "latest-stable", StringComparison.OrdinalIgnoreCase);
+            bool latest = string.IsNullOrEmpty(version) || IsLatestKeyword(version);
+
+            VersionRange range = null;
+            if (!latest && this.ParseVersion(version) == null)
+            {
+                range = VersionRange.TryParse(version);
+                if (range == null)
+                    throw new UpackException(ExitCode.InvalidArguments, $"Invalid UPack version number or range: {version}");
+            }
+
+            if (range == null && !latest && !prerelease)
+            {
+                var parsed = this.ParseVersion(version);
+
+                // the lookup is only for the warning, so an exact version is still used if the feed cannot describe it
+                RemoteUniversalPackageVersion remoteVersion = null;
+                try
+                {
+                    remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(id, parsed, false, cancellationToken), cancellationToken);
+                }
+                catch (WebException ex)
+                {
+                    Log.Verbose($"Could not check whether {id} {parsed} has been unlisted or deprecated: {ex.Message}");
+                }
+
+                if (remoteVersion != null && IsYanked(FeedVersion.FromRemote(remoteVersion)))
+                    this.Warn($"{id} {parsed} has been unlisted or deprecated by the feed.");
+
+                Log.Event("resolve", new JObject { ["package"] = id.ToString(), ["requested"] = version, ["version"] = parsed.ToString() });
+                return parsed;
+            }
+
+            IReadOnlyList<FeedVersion> versions;
             try
             {
-                versions = await client.ListPackageVersionsAsync(id, false, null, cancellationToken);
+                versions = await ListVersionsAsync(client, id, cancellationToken);
             }
             catch (WebException ex)
             {
@@ -387,9 +848,163 @@ namespace Inedo.UPack.CLI
             }
 
             if (!versions.Any())
-                throw new UpackException($"No versions of package {id} found.");
+                throw new UpackException(ExitCode.NotFound, $"No versions of package {id} found.")
+                {
+                    Code = ErrorCodes.PackageNotFound,
+                    Hint = "Check the name and group of the package, and that the source is the feed that has it."
+                };
+
+            if (latestStable)
+            {
+                versions = versions.Where(v => string.IsNullOrEmpty(v.Version.Prerelease)).ToList();
+                if (!versions.Any())
+                    throw new UpackException(ExitCode.NotFound, $"No stable versions of package {id} found.")
+                    {
+                        Code = ErrorCodes.PackageNotFound,
+                        Hint = "Specify a version, or --prerelease to use the latest prerelease version."
+                    };
+            }
+
+            if (range != null)
+            {
+                versions = versions.Where(v => range.IsMatch(v.Version, prerelease)).ToList();
+                if (!versions.Any())
+                    throw new UpackException(ExitCode.NotFound, $"No version of package {id} matches {range}.")
+                    {
+                        Code = ErrorCodes.PackageNotFound
+                    };
+            }
+
+            var candidates = includeYanked ? versions : versions.Where(v => !IsYanked(v)).ToList();
+            if (!candidates.Any())
+                throw new UpackException(ExitCode.NotFound, $"All {(range != null ? "matching " : string.Empty)}versions of package {id} have been unlisted or deprecated; specify a version or use --include-yanked.")
+                {
+                    Code = ErrorCodes.PackageNotFound
+                };
 
-            return versions.Max(v => v.Version);
+            var resolved = candidates.Max(v => v.Version);
+            Log.Event("resolve", new JObject { ["package"] = id.ToString(), ["requested"] = version, ["version"] = resolved.ToString() });
+            return resolved;
+        }
+
+        // Version lists are kept for the lifetime of the client, so that resolving many dependencies on the same package asks
+        // the feed for its versions only once. Between commands, a list from an HTTP feed is kept in the version cache of the
+        // user registry, and the feed is only asked whether it has changed.
+        private static async Task<IReadOnlyList<FeedVersion>> ListVersionsAsync(UniversalFeedClient client, UniversalPackageId id, CancellationToken cancellationToken)
+        {
+            var cache = VersionLists.GetOrCreateValue(client);
+            lock (cache)
+            {
+                if (cache.TryGetValue(id.ToString(), out var cached))
+                    return cached;
+            }
+
+            IReadOnlyList<FeedVersion> versions;
+            if (ClientFeeds.TryGetValue(client, out var feed) && (feed.Item1.StartsWith("http://", StringComparison.OrdinalIgnoreCase) || feed.Item1.StartsWith("https://", StringComparison.OrdinalIgnoreCase)))
+                versions = await VersionListCache.GetAsync(feed.Item1, feed.Item2, id, cancellationToken);
+            else
+                versions = (await FeedHttp.SendAsync(() => client.ListPackageVersionsAsync(id, false, null, cancellationToken), cancellationToken)).Select(FeedVersion.FromRemote).ToList();
+
+            lock (cache)
+            {
+                cache[id.ToString()] = versions;
+            }
+
+            return versions;
+        }
+
+        // Resolves version the same way as GetVersionAsync, but only from the versions in the package cache of the local registry.
+        internal UniversalPackageVersion GetCachedVersion(Registry registry, UniversalPackageId id, string version, bool prerelease)
+        {
+            var cached = registry.GetCachedVersions(id);
+            var available = cached.Count > 0 ? "cached versions: " + string.Join(", ", cached.OrderBy(v => v)) : "no versions are cached";
+
+            bool latestStable = string.Equals(version, "latest-stable", StringComparison.OrdinalIgnoreCase);
+            bool latest = string.IsNullOrEmpty(version) || IsLatestKeyword(version);
+
+            VersionRange range = null;
+            if (!latest)
+            {
+                var parsed = this.ParseVersion(version);
+                if (parsed != null)
+                {
+                    if (!cached.Contains(parsed))
+                        throw new UpackException(ExitCode.NotFound, $"{id} {parsed} is not in the package cache of {registry.RegistryRoot} ({available}).")
+                        {
+                            Code = ErrorCodes.NotInCache
+                        };
+
+                    return parsed;
+                }
+
+                range = VersionRange.TryParse(version);
+                if (range == null)
+                    throw new UpackException(ExitCode.InvalidArguments, $"Invalid UPack version number or range: {version}");
+            }
+
+            var candidates = cached.AsEnumerable();
+            if (latestStable)
+                candidates = candidates.Where(v => string.IsNullOrEmpty(v.Prerelease));
+            if (range != null)
+                candidates = candidates.Where(v => range.IsMatch(v, prerelease));
+
+            var match = candidates.OrderByDescending(v => v).FirstOrDefault();
+            if (match == null)
+                throw new UpackException(ExitCode.NotFound, $"No {(range != null ? "version matching " + range : latestStable ? "stable version" : "version")} of {id} is in the package cache of {registry.RegistryRoot} ({available}).")
+                {
+                    Code = ErrorCodes.NotInCache
+                };
+
+            return match;
+        }
+
+        internal static bool IsLatestKeyword(string version)
+        {
+            return string.Equals(version, "latest", StringComparison.OrdinalIgnoreCase)
+                || string.Equals(version, "latest-stable", StringComparison.OrdinalIgnoreCase)
+                || string.Equals(version, "latest-prerelease", StringComparison.OrdinalIgnoreCase);
+        }
+
+        // Some older feeds contain four-part versions such as 1.2.3.4; when allowed, the fourth part is moved into the build metadata.
+        internal UniversalPackageVersion ParseVersion(string version)
+        {
+            var parsed = UniversalPackageVersion.TryParse(version);
+            if (parsed != null || !this.AllowLegacyVersions || version == null)
+                return parsed;
+
+            var match = Regex.Match(version, @"^(?<version>\d+\.\d+\.\d+)\.(?<revision>\d+)(?<prerelease>-[0-9A-Za-z.-]+)?(?:\+(?<build>[0-9A-Za-z.-]+))?$", RegexOptions.ExplicitCapture);
+            if (!match.Success)
+                return null;
+
+            var build = match.Groups["revision"].Value + (match.Groups["build"].Success ? "." + match.Groups["build"].Value : string.Empty);
+            return UniversalPackageVersion.TryParse(match.Groups["version"].Value + match.Groups["prerelease"].Value + "+" + build);
+        }
+
+        // Feeds mark withdrawn versions with properties such as "unlisted": true or "deprecated": "«reason»".
+        internal static bool IsYanked(FeedVersion version)
+        {
+            if (version.Properties == null)
+                return false;
+
+            foreach (var name in new[] { "unlisted", "yanked", "deprecated" })
+            {
+                if (!version.Properties.TryGetValue(name, out var value) || value == null)
+                    continue;
+
+                if (value is bool b)
+                {
+                    if (b)
+                        return true;
+                }
+                else
+                {
+                    var text = value.ToString();
+                    if (!string.IsNullOrWhiteSpace(text) && !string.Equals(text, "false", StringComparison.OrdinalIgnoreCase))
+                        return true;
+                }
+            }
+
+            return false;
         }
 
         internal const string PackageNotFoundMessage = "The specified universal package was not found at the given URL";
@@ -430,11 +1045,86 @@ namespace Inedo.UPack.CLI
                     }
                 }
             }
-            return new UpackException(message, ex);
+            var code = GetErrorCode(ex, notFoundMessage);
+            return new UpackException(GetExitCode(ex), message, ex)
+            {
+                Code = code,
+                Location = ex.Response?.ResponseUri?.ToString(),
+                Hint = GetHint(code)
+            };
+        }
+
+        private static string GetErrorCode(WebException ex, string notFoundMessage)
+        {
+            var statusCode = (ex.Response as HttpWebResponse)?.StatusCode;
+            if (statusCode == HttpStatusCode.NotFound)
+                return notFoundMessage == FeedNotFoundMessage ? ErrorCodes.FeedNotFound : ErrorCodes.PackageNotFound;
+            if (statusCode == HttpStatusCode.Unauthorized)
+                return ErrorCodes.Unauthorized;
+            if (statusCode == HttpStatusCode.Forbidden)
+                return ErrorCodes.Forbidden;
+            if ((int?)statusCode >= 500)
+                return ErrorCodes.ServerError;
+
+            switch (ex.Status)
+            {
+                case WebExceptionStatus.TrustFailure:
+                case WebExceptionStatus.SecureChannelFailure:
+                    return ErrorCodes.CertificateNotTrusted;
+                case WebExceptionStatus.Timeout:
+                    return ErrorCodes.Timeout;
+                case WebExceptionStatus.ConnectFailure:
+                case WebExceptionStatus.NameResolutionFailure:
+                case WebExceptionStatus.ProxyNameResolutionFailure:
+                case WebExceptionStatus.ConnectionClosed:
+                case WebExceptionStatus.ReceiveFailure:
+                case WebExceptionStatus.SendFailure:
+                    return ErrorCodes.ConnectionFailed;
+                default:
+                    return ErrorCodes.Network;
+            }
+        }
+
+        private static string GetHint(string code)
+        {
+            switch (code)
+            {
+                case ErrorCodes.FeedNotFound:
+                    return "Check that the source is the API endpoint URL of a universal feed, such as https://proget/upack/Feed.";
+                case ErrorCodes.Unauthorized:
+                    return "Specify --user or --api-key, or store credentials for the feed with upack login.";
+                case ErrorCodes.Forbidden:
+                    return "The credentials were accepted, but do not have permission for this operation on the feed.";
+                case ErrorCodes.CertificateNotTrusted:
+                    return "If the certificate of the feed was issued by an internal CA, specify the CA certificate with --ca-cert.";
+                case ErrorCodes.Timeout:
+                    return "Increase --connect-timeout or --http-timeout if the feed is slow to respond.";
+                case ErrorCodes.ConnectionFailed:
+                    return "Check the URL of the feed, and specify --proxy if the feed can only be reached through a proxy.";
+                default:
+                    return null;
+            }
         }
 
-        internal static UniversalFeedClient CreateClient(string source, NetworkCredential credentials)
+        // A connection failure or an unexpected response is a network error; the feed answering 401, 403, or 404 is not.
+        internal static ExitCode GetExitCode(WebException ex)
         {
+            switch ((ex.Response as HttpWebResponse)?.StatusCode)
+            {
+                case HttpStatusCode.Unauthorized:
+                case HttpStatusCode.Forbidden:
+                    return ExitCode.AuthenticationFailed;
+                case HttpStatusCode.NotFound:
+                    return ExitCode.NotFound;
+                default:
+                    return ExitCode.NetworkError;
+            }
+        }
+
+        internal static UniversalFeedClient CreateClient(string source, NetworkCredential credentials, string apiKey = null)
+        {
+            credentials = ResolveCredentials(source, credentials, apiKey);
+
             try
             {
                 var uri = new Uri(source);
@@ -443,28 +1133,199 @@ namespace Inedo.UPack.CLI
                     new UniversalFeedEndpoint(uri, true) :
                     new UniversalFeedEndpoint(uri, credentials.UserName, credentials.SecurePassword);
 
-                return new UniversalFeedClient(endpoint);
+                var client = new UniversalFeedClient(endpoint);
+                ClientFeeds.Add(client, Tuple.Create(source, credentials));
+                return client;
             }
             catch (UriFormatException ex)
             {
-                throw new UpackException("Invalid UPack feed URL: " + ex.Message, ex);
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid UPack feed URL: " + ex.Message, ex);
             }
             catch (ArgumentException ex)
             {
-                throw new UpackException("Invalid UPack feed URL: " + ex.Message, ex);
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid UPack feed URL: " + ex.Message, ex);
+            }
+        }
+
+        // Returns the credentials to send to the source, or null to use the default credentials of the process.
+        // ProGet accepts an API key as the password of the user name "api", so --api-key is sent the same way as --user=api:«api-key».
+        internal static NetworkCredential ResolveCredentials(string source, NetworkCredential credentials, string apiKey)
+        {
+            // with --token, no credentials of any other kind may be sent, since they would replace the bearer token
+            if (FeedHttp.BearerToken != null)
+            {
+                if (credentials != null || !string.IsNullOrEmpty(apiKey))
+                    throw new UpackException(ExitCode.InvalidArguments, "--token cannot be combined with --user or --api-key.");
+
+                return null;
+            }
+
+            if (!string.IsNullOrEmpty(apiKey))
+            {
+                if (credentials != null)
+                    throw new UpackException(ExitCode.InvalidArguments, "--user and --api-key cannot both be specified.");
+
+                return new NetworkCredential("api", apiKey);
             }
+
+            // credentials stored with upack login are used only when none are given explicitly
+            if (credentials == null && !string.IsNullOrEmpty(source))
+                return CredentialStore.TryGet(source);
+
+            return credentials;
+        }
+
+        // With more than one thread, a large package is downloaded in parallel segments when the feed supports range requests,
+        // and checked against the SHA1 hash the feed publishes for it; otherwise it is downloaded through the client. Either way
+        // the returned stream is a seekable HashedStream, or null if the feed does not have the package.
+        internal static async Task<Stream> DownloadPackageAsync(UniversalFeedClient client, string source, NetworkCredential credentials, string apiKey, UniversalPackageId id, UniversalPackageVersion version, int threads, CancellationToken cancellationToken)
+        {
+            Log.Event("download-start", new JObject { ["package"] = id.ToString(), ["version"] = version.ToString(), ["source"] = source });
+
+            if (threads > 1)
+            {
+                var segmented = await SegmentedDownload.TryDownloadAsync(source, ResolveCredentials(source, credentials, apiKey), id, version, threads, cancellationToken);
+                if (segmented != null)
+                {
+                    try
+                    {
+                        // the segments arrive out of order, so this is the one pass that hashes the whole file
+                        var stream = HashedStream.Compute(segmented);
+                        segmented = stream;
+
+                        var remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(id, version, false, cancellationToken), cancellationToken);
+                        if (remoteVersion?.SHA1 != null)
+                        {
+                            var actual = stream.SHA1;
+                            if (actual != remoteVersion.SHA1)
+                                throw new UpackException(ExitCode.ValidationFailed, $"The SHA1 hash of the downloaded {id} {version} is {actual}, but the feed reports {remoteVersion.SHA1}.")
+                                {
+                                    Code = ErrorCodes.HashMismatch,
+                                    Location = source,
+                                    Hint = "The package may have been corrupted in transit; try again, or specify --download-threads=1."
+                                };
+                        }
+
+                        Log.Event("download-finish", new JObject { ["package"] = id.ToString(), ["version"] = version.ToString(), ["size"] = stream.Length, ["sha1"] = stream.SHA1.ToString(), ["segmented"] = true });
+                        return stream;
+                    }
+                    catch
+                    {
+                        segmented.Dispose();
+                        throw;
+                    }
+                }
+            }
+
+            // the package is read to the end here, so that the download is complete when it is logged
+            var result = await FeedHttp.SendAsync(() => client.GetPackageStreamAsync(id, version, cancellationToken), cancellationToken);
+            if (result != null)
+            {
+                // the size is not known until the whole package has been received
+                var progress = result.CanSeek ? null : Progress.Start("download", id, version);
+                if (progress != null)
+                    result = new ProgressStream(result, progress);
+
+                var downloaded = result.CanSeek ? HashedStream.Compute(result) : await HashedStream.CopyToTempFileAsync(result, cancellationToken);
+                progress?.Finish();
+                Log.Event("download-finish", new JObject { ["package"] = id.ToString(), ["version"] = version.ToString(), ["size"] = downloaded.Length, ["sha1"] = downloaded.SHA1.ToString(), ["segmented"] = false });
+                return downloaded;
+            }
+
+            return null;
+        }
+
+        // Splits a source URL such as https://proget/upack/Feed/group/sub into the feed endpoint and the group that follows it.
+        internal static string InferGroupFromSource(ref string source)
+        {
+            if (!Uri.TryCreate(source, UriKind.Absolute, out var uri))
+                return null;
+
+            var segments = uri.AbsolutePath.Split(new[] { '/' }, StringSplitOptions.RemoveEmptyEntries);
+            int feedIndex = Array.FindIndex(segments, s => string.Equals(s, "upack", StringComparison.OrdinalIgnoreCase)) + 1;
+            if (feedIndex <= 0 || feedIndex >= segments.Length - 1)
+                return null;
+
+            var builder = new UriBuilder(uri) { Path = "/" + string.Join("/", segments.Take(feedIndex + 1)) };
+            source = builder.Uri.ToString();
+            return Uri.UnescapeDataString(string.Join("/", segments.Skip(feedIndex + 1)));
+        }
+
+        internal Registry OpenRegistry(string registryPath, bool userRegistry, bool projectRegistry, string lockTimeout = null, string lockPollInterval = null)
+        {
+            Registry registry;
+            if (!string.IsNullOrEmpty(registryPath))
+                registry = new Registry(registryPath);
+            else if (projectRegistry)
+                registry = Registry.GetProjectRegistry(Environment.CurrentDirectory);
+            else
+                registry = Registry.GetRegistry(userRegistry);
+
+            registry.Command = this.DisplayName;
+            registry.Clock = this.Clock;
+            ApplyLockPolicy(registry, lockTimeout, lockPollInterval);
+            return registry;
+        }
+
+        // lockTimeout and lockPollInterval are numbers of seconds; a missing timeout waits indefinitely
+        internal static void ApplyLockPolicy(Registry registry, string lockTimeout, string lockPollInterval)
+        {
+            if (!string.IsNullOrEmpty(lockTimeout))
+            {
+                if (!double.TryParse(lockTimeout, NumberStyles.Float, CultureInfo.InvariantCulture, out var seconds) || seconds < 0)
+                    throw new UpackException(ExitCode.InvalidArguments, "--lock-timeout must be a non-negative number of seconds.");
+
+                registry.LockTimeout = TimeSpan.FromSeconds(seconds);
+            }
+
+            if (!string.IsNullOrEmpty(lockPollInterval))
+            {
+                if (!double.TryParse(lockPollInterval, NumberStyles.Float, CultureInfo.InvariantCulture, out var seconds) || seconds <= 0)
+                    throw new UpackException(ExitCode.InvalidArguments, "--lock-poll-interval must be a positive number of seconds.");
+
+                registry.LockPollInterval = TimeSpan.FromSeconds(seconds);
+            }
+        }
+
+        internal void Warn(string message)
+        {
+            if (this.TreatWarningsAsErrors)
+                throw new UpackException("Error (--warnings-as-errors): " + message);
+
+            Log.Warning("Warning: " + message);
         }
 
         internal static HexString GetSHA1(string filePath)
         {
             using (var file = File.OpenRead(filePath))
-            using (var hash = HashAlgorithm.Create("SHA1"))
             {
-                var bytes = hash.ComputeHash(file);
+                return GetHash(file, "SHA1");
+            }
+        }
+
+        // Uses the hash computed while a package was downloaded if there is one; otherwise the stream is read and rewound.
+        internal static HexString GetSHA1(Stream stream)
+        {
+            if (stream is HashedStream hashed)
+                return hashed.SHA1;
+
+            var sha1 = GetHash(stream, "SHA1");
+            stream.Position = 0;
+            return sha1;
+        }
+
+        internal static HexString GetHash(Stream stream, string algorithm)
+        {
+            using (var hash = HashAlgorithm.Create(algorithm))
+            {
+                var bytes = hash.ComputeHash(stream);
                 return new HexString(bytes);
             }
         }
 
+        // Formats the compressed size of a file or set of files as a percentage of its uncompressed size.
+        internal static string FormatRatio(long compressed, long size) => size == 0 ? "-" : ((double)compressed / size).ToString("P0");
+
         internal static UniversalPackageMetadata GetPackageMetadata(string zipFileName)
         {
             try
@@ -476,7 +1337,10 @@ namespace Inedo.UPack.CLI
             }
             catch (Exception ex)
             {
-                throw new UpackException($"The source package file '{zipFileName}' does not exist or could not be opened.", ex);
+                throw new UpackException(ExitCode.NotFound, $"The source package file '{zipFileName}' does not exist or could not be opened.", ex)
+                {
+                    Code = ErrorCodes.FileNotFound
+                };
             }
         }
     }
@@ -1,16 +1,19 @@
 ﻿using System;
 using System.Collections.Generic;
 using System.ComponentModel;
+using System.IO;
 using System.Linq;
+using System.Net;
 using System.Reflection;
 using System.Threading;
 using System.Threading.Tasks;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     public sealed class CommandDispatcher
     {
-        public static CommandDispatcher Default => new CommandDispatcher(typeof(Pack), typeof(Push), typeof(Unpack), typeof(Install), typeof(List), typeof(Repack), typeof(Verify), typeof(Hash), typeof(Metadata), typeof(Get), typeof(Version));
+        public static CommandDispatcher Default => new CommandDispatcher(typeof(Pack), typeof(Push), typeof(PublishAndInstall), typeof(Unpack), typeof(Install), typeof(List), typeof(Repack), typeof(EditMetadata), typeof(Verify), typeof(Validate), typeof(Hash), typeof(Metadata), typeof(MetadataDiff), typeof(Readme), typeof(Get), typeof(Version), typeof(VersionCompare), typeof(VersionSort), typeof(VersionCheck), typeof(RegistryRemove), typeof(RegistryRepair), typeof(RegistryExport), typeof(RegistryImport), typeof(RegistryDiff), typeof(RegistryLog), typeof(Files), typeof(Hold), typeof(Bump), typeof(Login), typeof(Logout));
 
         private readonly IEnumerable<Type> commands;
 
@@ -21,15 +24,32 @@ namespace Inedo.UPack.CLI
 
         public void Main(string[] args)
         {
+            try
+            {
+                args = ExpandResponseFiles(args);
+            }
+            catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException)
+            {
+                Console.Error.WriteLine(ErrorCodes.Format(new UpackException(ExitCode.InvalidArguments, "Unable to read response file: " + ex.Message)));
+                Environment.ExitCode = (int)ExitCode.InvalidArguments;
+                return;
+            }
+
             bool onlyPositional = false;
             bool hadError = false;
+            bool yes = false;
 
             var positional = new List<string>();
-            var extra = new Dictionary<string, string>(StringComparer.OrdinalIgnoreCase);
+            var extra = new Dictionary<string, List<string>>(StringComparer.OrdinalIgnoreCase);
 
             foreach (var arg in args)
             {
-                if (onlyPositional || !arg.StartsWith("--"))
+                if (!onlyPositional && arg == "-y")
+                {
+                    // the only short option, by convention with other tools
+                    yes = true;
+                }
+                else if (onlyPositional || !arg.StartsWith("--"))
                 {
                     positional.Add(arg);
                 }
@@ -41,15 +61,48 @@ namespace Inedo.UPack.CLI
                 else
                 {
                     var parts = arg.Substring("--".Length).Split(new[] { '=' }, 2);
-                    if (extra.ContainsKey(parts[0]))
+                    if (!extra.TryGetValue(parts[0], out var values))
                     {
-                        hadError = true;
+                        values = new List<string>();
+                        extra[parts[0]] = values;
                     }
 
-                    extra[parts[0]] = parts.Length == 1 ? null : parts[1];
+                    values.Add(parts.Length == 1 ? null : parts[1]);
                 }
             }
 
+            // these options apply to every command, so they are taken out before the arguments of the command are matched
+            bool json = TakeFlag(extra, "json", ref hadError);
+            bool quiet = TakeFlag(extra, "quiet", ref hadError);
+            bool verbose = TakeFlag(extra, "verbose", ref hadError);
+            bool debug = TakeFlag(extra, "debug", ref hadError);
+            Command.AssumeYes = TakeFlag(extra, "yes", ref hadError) || yes;
+            Log.UseColor = !TakeFlag(extra, "no-color", ref hadError) && string.IsNullOrEmpty(Environment.GetEnvironmentVariable("NO_COLOR"));
+            if ((quiet ? 1 : 0) + (verbose ? 1 : 0) + (debug ? 1 : 0) > 1)
+                hadError = true;
+            else
+                Log.Verbosity = quiet ? Verbosity.Quiet : debug ? Verbosity.Debug : verbose ? Verbosity.Verbose : Verbosity.Normal;
+
+            var logFile = Environment.GetEnvironmentVariable("UPACK_LOG_FILE");
+            if (extra.TryGetValue("log-file", out var logFileValues))
+            {
+                extra.Remove("log-file");
+                if (logFileValues.Count != 1 || string.IsNullOrEmpty(logFileValues[0]))
+                    hadError = true;
+                else
+                    logFile = logFileValues[0];
+            }
+
+            // json is the only format for now; the option takes a value so that others can be added
+            if (extra.TryGetValue("progress", out var progressValues))
+            {
+                extra.Remove("progress");
+                if (progressValues.Count != 1 || !string.Equals(progressValues[0], "json", StringComparison.OrdinalIgnoreCase))
+                    hadError = true;
+                else
+                    Progress.Enabled = true;
+            }
+
             if (positional.Count > 0 && string.Equals("help", positional[0], StringComparison.OrdinalIgnoreCase))
             {
                 hadError = true;
@@ -63,21 +116,23 @@ namespace Inedo.UPack.CLI
             }
             else
             {
-                foreach (var command in commands)
+                // Commands such as "registry remove" span multiple words; prefer the longest name that matches.
+                var matches = from c in commands
+                              let name = (c.GetCustomAttribute<DisplayNameAttribute>()?.DisplayName ?? c.Name).Split(' ')
+                              where name.Length <= positional.Count && name.Select((n, i) => string.Equals(n, positional[i], StringComparison.OrdinalIgnoreCase)).All(m => m)
+                              orderby name.Length descending
+                              select c;
+
+                foreach (var command in matches.Take(1))
                 {
                     cmd = (Command)Activator.CreateInstance(command);
-                    if (!string.Equals(cmd.DisplayName, positional[0], StringComparison.OrdinalIgnoreCase))
-                    {
-                        cmd = null;
-                        continue;
-                    }
 
                     if (hadError)
                     {
                         break;
                     }
 
-                    positional.RemoveAt(0);
+                    positional.RemoveRange(0, cmd.DisplayName.Split(' ').Length);
 
                     foreach (var arg in cmd.PositionalArguments)
                     {
@@ -116,10 +171,19 @@ namespace Inedo.UPack.CLI
                         var alt = arg.AlternateNames.FirstOrDefault(extra.ContainsKey);
                         if (extra.ContainsKey(arg.DisplayName) || alt != null)
                         {
-                            if (!arg.TrySetValue(cmd, extra[alt ?? arg.DisplayName]))
+                            var values = extra[alt ?? arg.DisplayName];
+                            if (values.Count > 1 && !arg.IsRepeatable)
                             {
                                 hadError = true;
                             }
+
+                            foreach (var value in values)
+                            {
+                                if (!arg.TrySetValue(cmd, value))
+                                {
+                                    hadError = true;
+                                }
+                            }
                             extra.Remove(alt ?? arg.DisplayName);
                         }
                         else if (arg.EnvironmentVariable != null)
@@ -159,7 +223,7 @@ namespace Inedo.UPack.CLI
                 {
                     ShowGenericHelp();
                 }
-                Environment.ExitCode = 2;
+                Environment.ExitCode = (int)ExitCode.InvalidArguments;
             }
             else
             {
@@ -171,31 +235,124 @@ namespace Inedo.UPack.CLI
                             consoleCancelTokenSource.Cancel();
                         };
 
+                    if (json)
+                    {
+                        Command.JsonWriter = Console.Out;
+                        Console.SetOut(Console.Error);
+                    }
+
+                    if (!string.IsNullOrEmpty(logFile))
+                    {
+                        try
+                        {
+                            Log.OpenFile(logFile);
+                        }
+                        catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException || ex is ArgumentException || ex is NotSupportedException)
+                        {
+                            Console.Error.WriteLine(ErrorCodes.Format(new UpackException(ExitCode.InvalidArguments, "Unable to open log file: " + ex.Message) { Location = logFile }));
+                            Environment.ExitCode = (int)ExitCode.InvalidArguments;
+                            return;
+                        }
+                    }
+
+                    // only the name of the command is logged, since its arguments may include credentials
+                    Log.Event("start", new JObject { ["command"] = cmd.DisplayName, ["version"] = typeof(CommandDispatcher).Assembly.GetName().Version.ToString() });
+
                     try
                     {
                         try
                         {
+                            if (cmd is FeedCommand feedCommand)
+                                feedCommand.ConfigureHttp();
+
                             Environment.ExitCode = cmd.RunAsync(consoleCancelTokenSource.Token).GetAwaiter().GetResult();
                         }
                         catch (AggregateException ex) when (ex.InnerException is UpackException)
                         {
                             throw ex.InnerException;
                         }
+                        catch (WebException ex)
+                        {
+                            // a request that a command did not expect to fail
+                            throw Command.ConvertWebException(ex);
+                        }
                     }
                     catch (TaskCanceledException)
                     {
-                        Console.Error.WriteLine("Operation was canceled by the user.");
-                        Environment.ExitCode = 3;
+                        Log.Error("Operation was canceled by the user.");
+                        Log.Event("canceled");
+                        Environment.ExitCode = (int)ExitCode.Canceled;
                     }
                     catch (UpackException ex)
                     {
-                        Console.Error.WriteLine(ex.Message);
-                        Environment.ExitCode = 1;
+                        Log.Error(ErrorCodes.Format(ex));
+                        Command.WriteResult(new JObject { ["error"] = ex.Message, ["code"] = ex.Code, ["location"] = ex.Location, ["hint"] = ex.Hint, ["exitCode"] = (int)ex.ExitCode });
+                        Log.Event("error", new JObject { ["code"] = ex.Code, ["message"] = ex.Message, ["location"] = ex.Location });
+                        Environment.ExitCode = (int)ex.ExitCode;
+                    }
+                    finally
+                    {
+                        Log.Event("exit", new JObject { ["exitCode"] = Environment.ExitCode });
+                        Log.CloseFile();
                     }
                 }
             }
         }
 
+        // Removes a global option such as --json, which may be given as --«name» or --«name»=true|false.
+        private static bool TakeFlag(Dictionary<string, List<string>> extra, string name, ref bool hadError)
+        {
+            if (!extra.TryGetValue(name, out var values))
+                return false;
+
+            extra.Remove(name);
+            if (values.Count > 1)
+            {
+                hadError = true;
+                return false;
+            }
+
+            if (values[0] == null)
+                return true;
+
+            if (!bool.TryParse(values[0], out bool value))
+                hadError = true;
+
+            return value;
+        }
+
+        // An argument of @«file» is replaced with the lines of that file, one argument per line; blank lines and lines
+        // starting with # are ignored. Use @@ for an argument that starts with a literal @.
+        private static string[] ExpandResponseFiles(string[] args)
+        {
+            var expanded = new List<string>();
+            bool onlyPositional = false;
+
+            foreach (var arg in args)
+            {
+                if (onlyPositional || !arg.StartsWith("@"))
+                {
+                    expanded.Add(arg);
+                    onlyPositional |= arg == "--";
+                }
+                else if (arg.StartsWith("@@"))
+                {
+                    expanded.Add(arg.Substring(1));
+                }
+                else
+                {
+                    foreach (var line in File.ReadAllLines(arg.Substring(1)))
+                    {
+                        var trimmed = line.Trim();
+                        if (trimmed.Length > 0 && !trimmed.StartsWith("#"))
+                            expanded.Add(trimmed);
+                    }
+                }
+            }
+
+            return expanded.ToArray();
+        }
+
         public void ShowGenericHelp()
         {
             Console.Error.WriteLine($"upack {typeof(CommandDispatcher).Assembly.GetName().Version}");
@@ -206,6 +363,12 @@ namespace Inedo.UPack.CLI
             {
                 Console.Error.WriteLine($"{command.GetCustomAttribute<DisplayNameAttribute>()?.DisplayName ?? command.Name} - {command.GetCustomAttribute<DescriptionAttribute>()?.Description ?? string.Empty}");
             }
+
+            Console.Error.WriteLine();
+            Console.Error.WriteLine("Every command also accepts --json to write its result to standard output as JSON, with all other output on standard error,");
+            Console.Error.WriteLine("one of --quiet (errors only), --verbose (also extracted files and requested URLs), or --debug (also HTTP headers),");
+            Console.Error.WriteLine("--log-file=«path» to append a JSON line for each significant action to a file, --progress=json to write");
+            Console.Error.WriteLine("progress to standard error as JSON lines, --no-color, and --yes (or -y) to answer yes to confirmation prompts.");
         }
 
         public void ShowHelp(Command cmd)
@@ -0,0 +1,302 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.Diagnostics;
+using System.Linq;
+using System.Net;
+using System.Runtime.InteropServices;
+using System.Text;
+
+namespace Inedo.UPack.CLI
+{
+    // Stores feed credentials in the credential store of the operating system: Credential Manager on Windows, the login
+    // keychain on macOS (through the security tool), and the Secret Service on Linux (through secret-tool from libsecret).
+    // Credentials are stored for a URL; a lookup also matches credentials stored for a parent URL, so that logging in to
+    // https://proget/upack applies to every feed under it.
+    internal static class CredentialStore
+    {
+        private const string ServiceName = "upack";
+        private const uint CredTypeGeneric = 1;
+        private const uint CredPersistLocalMachine = 2;
+        private const int ErrorNotFound = 1168;
+        private const int SecurityItemNotFound = 44;
+
+        public static string Name
+        {
+            get
+            {
+                switch (Platform.CurrentOS)
+                {
+                    case "windows":
+                        return "Windows Credential Manager";
+                    case "macos":
+                        return "the macOS keychain";
+                    default:
+                        return "the Secret Service keyring";
+                }
+            }
+        }
+
+        // Returns the URL that credentials for a source are stored under: the source without its query, fragment, or trailing slash.
+        public static string GetKey(string source)
+        {
+            Uri uri;
+            try
+            {
+                uri = new Uri(source);
+            }
+            catch (UriFormatException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid UPack feed URL: " + ex.Message, ex);
+            }
+
+            return uri.GetLeftPart(UriPartial.Path).TrimEnd('/');
+        }
+
+        public static void Save(string source, NetworkCredential credentials)
+        {
+            var key = GetKey(source);
+            switch (Platform.CurrentOS)
+            {
+                case "windows":
+                    WindowsSave(key, credentials);
+                    break;
+                case "macos":
+                    // an item is identified by its service and account, so remove any item stored for another user first
+                    Delete(source);
+                    // commands read by security -i are split like a shell command line, which keeps the password out of the process arguments
+                    RunTool("security", "-i", $"add-generic-password -U -s {Quote(ServiceName + ":" + key)} -a {Quote(credentials.UserName)} -l {Quote("upack " + key)} -w {Quote(credentials.Password ?? string.Empty)}\n", true, out _);
+                    break;
+                default:
+                    RunTool("secret-tool", $"store --label={Quote("upack " + key)} service {ServiceName} url {Quote(key)} user {Quote(credentials.UserName)}", credentials.Password ?? string.Empty, true, out _);
+                    break;
+            }
+
+            if (TryGetExact(key) == null)
+                throw new UpackException($"The credentials for {key} could not be stored in {Name}.");
+        }
+
+        // Returns the credentials stored for the source or the nearest parent URL, or null if there are none or the store is unavailable.
+        public static NetworkCredential TryGet(string source)
+        {
+            string key;
+            try
+            {
+                key = GetKey(source);
+            }
+            catch (UpackException)
+            {
+                return null;
+            }
+
+            try
+            {
+                foreach (var candidate in GetCandidateKeys(key))
+                {
+                    var credentials = TryGetExact(candidate);
+                    if (credentials != null)
+                        return credentials;
+                }
+            }
+            catch (UpackException)
+            {
+            }
+
+            return null;
+        }
+
+        // Returns false if no credentials were stored for exactly this source.
+        public static bool Delete(string source)
+        {
+            var key = GetKey(source);
+            switch (Platform.CurrentOS)
+            {
+                case "windows":
+                    if (CredDelete(ServiceName + ":" + key, CredTypeGeneric, 0))
+                        return true;
+                    if (Marshal.GetLastWin32Error() == ErrorNotFound)
+                        return false;
+                    throw new UpackException($"Unable to delete the credentials for {key} from {Name} (error {Marshal.GetLastWin32Error()}).");
+                case "macos":
+                    return RunTool("security", $"delete-generic-password -s {Quote(ServiceName + ":" + key)}", null, false, out _) == 0;
+                default:
+                    if (TryGetExact(key) == null)
+                        return false;
+                    RunTool("secret-tool", $"clear service {ServiceName} url {Quote(key)}", null, true, out _);
+                    return true;
+            }
+        }
+
+        // https://proget/upack/Feed is looked up as https://proget/upack/Feed, then https://proget/upack, then https://proget.
+        private static IEnumerable<string> GetCandidateKeys(string key)
+        {
+            var uri = new Uri(key);
+            var root = uri.GetLeftPart(UriPartial.Authority);
+            var segments = uri.AbsolutePath.Split(new[] { '/' }, StringSplitOptions.RemoveEmptyEntries).ToList();
+
+            for (int i = segments.Count; i >= 0; i--)
+                yield return i == 0 ? root : root + "/" + string.Join("/", segments.Take(i));
+        }
+
+        private static NetworkCredential TryGetExact(string key)
+        {
+            switch (Platform.CurrentOS)
+            {
+                case "windows":
+                    return WindowsRead(key);
+
+                case "macos":
+                {
+                    int exitCode = RunTool("security", $"find-generic-password -s {Quote(ServiceName + ":" + key)} -w", null, false, out var password);
+                    if (exitCode == SecurityItemNotFound)
+                        return null;
+                    if (exitCode != 0)
+                        throw new UpackException($"Unable to read the credentials for {key} from {Name}.");
+
+                    RunTool("security", $"find-generic-password -s {Quote(ServiceName + ":" + key)}", null, false, out var attributes);
+                    var account = attributes.Split('\n').Select(l => l.Trim()).FirstOrDefault(l => l.StartsWith("\"acct\"<blob>=\"", StringComparison.Ordinal));
+                    if (account == null)
+                        return null;
+
+                    var userName = account.Substring("\"acct\"<blob>=\"".Length).TrimEnd('"');
+                    return new NetworkCredential(userName, password.TrimEnd('\n'));
+                }
+
+                default:
+                {
+                    if (RunTool("secret-tool", $"lookup service {ServiceName} url {Quote(key)}", null, false, out var password) != 0)
+                        return null;
+
+                    RunTool("secret-tool", $"search service {ServiceName} url {Quote(key)}", null, false, out var details);
+                    var user = details.Split('\n').Select(l => l.Trim()).FirstOrDefault(l => l.StartsWith("attribute.user = ", StringComparison.Ordinal));
+                    if (user == null)
+                        return null;
+
+                    return new NetworkCredential(user.Substring("attribute.user = ".Length), password);
+                }
+            }
+        }
+
+        private static int RunTool(string fileName, string arguments, string input, bool throwOnError, out string output)
+        {
+            var startInfo = new ProcessStartInfo(fileName, arguments)
+            {
+                UseShellExecute = false,
+                RedirectStandardInput = true,
+                RedirectStandardOutput = true,
+                RedirectStandardError = true,
+                CreateNoWindow = true,
+                StandardOutputEncoding = Encoding.UTF8
+            };
+
+            Process process;
+            try
+            {
+                process = Process.Start(startInfo);
+            }
+            catch (Win32Exception ex)
+            {
+                var package = fileName == "secret-tool" ? " (install the libsecret-tools package, or the package that provides secret-tool on your distribution)" : string.Empty;
+                throw new UpackException($"{Name} is not available: {fileName} could not be run{package}. {ex.Message}", ex);
+            }
+
+            using (process)
+            {
+                var error = process.StandardError.ReadToEndAsync();
+                if (input != null)
+                    process.StandardInput.Write(input);
+                process.StandardInput.Close();
+
+                output = process.StandardOutput.ReadToEnd();
+                process.WaitForExit();
+
+                if (throwOnError && process.ExitCode != 0)
+                {
+                    var message = error.Result.Trim();
+                    throw new UpackException($"{fileName} failed with exit code {process.ExitCode}{(message.Length > 0 ? ": " + message : ".")}");
+                }
+
+                return process.ExitCode;
+            }
+        }
+
+        private static string Quote(string value) => "\"" + value.Replace("\\", "\\\\").Replace("\"", "\\\"") + "\"";
+
+        private static void WindowsSave(string key, NetworkCredential credentials)
+        {
+            var password = Encoding.Unicode.GetBytes(credentials.Password ?? string.Empty);
+            var blob = Marshal.AllocCoTaskMem(Math.Max(password.Length, 1));
+            try
+            {
+                Marshal.Copy(password, 0, blob, password.Length);
+                var credential = new NativeCredential
+                {
+                    Type = CredTypeGeneric,
+                    TargetName = ServiceName + ":" + key,
+                    CredentialBlobSize = (uint)password.Length,
+                    CredentialBlob = blob,
+                    Persist = CredPersistLocalMachine,
+                    UserName = credentials.UserName
+                };
+
+                if (!CredWrite(ref credential, 0))
+                    throw new UpackException($"Unable to store the credentials for {key} in {Name} (error {Marshal.GetLastWin32Error()}).");
+            }
+            finally
+            {
+                Marshal.FreeCoTaskMem(blob);
+            }
+        }
+
+        private static NetworkCredential WindowsRead(string key)
+        {
+            if (!CredRead(ServiceName + ":" + key, CredTypeGeneric, 0, out var buffer))
+            {
+                if (Marshal.GetLastWin32Error() == ErrorNotFound)
+                    return null;
+
+                throw new UpackException($"Unable to read the credentials for {key} from {Name} (error {Marshal.GetLastWin32Error()}).");
+            }
+
+            try
+            {
+                var credential = (NativeCredential)Marshal.PtrToStructure(buffer, typeof(NativeCredential));
+                var password = credential.CredentialBlobSize == 0 ? string.Empty : Marshal.PtrToStringUni(credential.CredentialBlob, (int)credential.CredentialBlobSize / 2);
+                return new NetworkCredential(credential.UserName, password);
+            }
+            finally
+            {
+                CredFree(buffer);
+            }
+        }
+
+        [DllImport("advapi32.dll", EntryPoint = "CredWriteW", CharSet = CharSet.Unicode, SetLastError = true)]
+        private static extern bool CredWrite(ref NativeCredential credential, uint flags);
+
+        [DllImport("advapi32.dll", EntryPoint = "CredReadW", CharSet = CharSet.Unicode, SetLastError = true)]
+        private static extern bool CredRead(string target, uint type, uint flags, out IntPtr credential);
+
+        [DllImport("advapi32.dll", EntryPoint = "CredDeleteW", CharSet = CharSet.Unicode, SetLastError = true)]
+        private static extern bool CredDelete(string target, uint type, uint flags);
+
+        [DllImport("advapi32.dll")]
+        private static extern void CredFree(IntPtr buffer);
+
+        [StructLayout(LayoutKind.Sequential, CharSet = CharSet.Unicode)]
+        private struct NativeCredential
+        {
+            public uint Flags;
+            public uint Type;
+            public string TargetName;
+            public string Comment;
+            public System.Runtime.InteropServices.ComTypes.FILETIME LastWritten;
+            public uint CredentialBlobSize;
+            public IntPtr CredentialBlob;
+            public uint Persist;
+            public uint AttributeCount;
+            public IntPtr Attributes;
+            public string TargetAlias;
+            public string UserName;
+        }
+    }
+}
@@ -0,0 +1,226 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("edit-metadata")]
+    [Description("Creates a copy of an existing package with properties of its upack.json set or removed, without repackaging its contents.")]
+    public sealed class EditMetadata : Command
+    {
+        [DisplayName("source")]
+        [Description("The path of the existing upack file.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string SourcePath { get; set; }
+
+        [DisplayName("set")]
+        [Description("Property to set to a string value, in the format «key»=«value». May be specified more than once.")]
+        [ExtraArgument]
+        public string[] Set { get; set; }
+
+        [DisplayName("set-json")]
+        [Description("Property to set to a JSON value, such as an object or array, in the format «key»=«json». May be specified more than once.")]
+        [ExtraArgument]
+        public string[] SetJson { get; set; }
+
+        [DisplayName("unset")]
+        [Description("Property to remove. May be specified more than once.")]
+        [ExtraArgument]
+        public string[] Unset { get; set; }
+
+        [DisplayName("targetDirectory")]
+        [Description("Directory where the .upack file will be created. If not specified, the directory of the source file is used.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string TargetDirectory { get; set; }
+
+        [DisplayName("note")]
+        [Description("A description of the purpose for the edit that will be entered as the audit note.")]
+        [ExtraArgument]
+        public string Note { get; set; }
+
+        [DisplayName("no-audit")]
+        [Description("Do not store audit information in the UPack manifest.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool NoAudit { get; set; } = false;
+
+        [DisplayName("overwrite")]
+        [Description("Overwrite existing package file if it already exists, including the source file.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Overwrite { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            if (this.NoAudit && !string.IsNullOrEmpty(this.Note))
+                throw new UpackException(ExitCode.InvalidArguments, "--no-audit cannot be used with --note.");
+
+            var changes = new Dictionary<string, object>();
+            var error = ParseAssignments(this.Set, "set", v => v, changes)
+                ?? ParseAssignments(this.SetJson, "set-json", ParseJson, changes);
+            if (error == null)
+            {
+                foreach (var key in this.Unset ?? new string[0])
+                {
+                    if (string.IsNullOrWhiteSpace(key))
+                    {
+                        error = "--unset requires a property name.";
+                        break;
+                    }
+
+                    if (changes.ContainsKey(key))
+                    {
+                        error = $"{key} is specified more than once.";
+                        break;
+                    }
+
+                    changes.Add(key, null);
+                }
+            }
+
+            if (error == null && changes.Count == 0)
+                error = "At least one of --set, --set-json, or --unset must be specified.";
+
+            if (error != null)
+                throw new UpackException(ExitCode.InvalidArguments, error);
+
+            var info = GetPackageMetadata(this.SourcePath);
+            var id = (string.IsNullOrEmpty(info.Group) ? "" : info.Group + "/") + info.Name + ":" + info.Version + ":" + GetSHA1(this.SourcePath);
+
+            foreach (var change in changes)
+            {
+                error = Apply(info, change.Key, change.Value);
+                if (error != null)
+                    throw new UpackException(ExitCode.InvalidArguments, error);
+            }
+
+            error = ValidateManifest(info);
+            if (error != null)
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid upack.json: {error}");
+
+            PrintManifest(info);
+
+            if (!this.NoAudit)
+                this.AddRepackageHistory(info, id, this.Note ?? GetDefaultNote(changes));
+
+            string relativePackageFileName = $"{info.Name}-{info.Version.Major}.{info.Version.Minor}.{info.Version.Patch}.upack";
+            string targetFileName = Path.Combine(this.TargetDirectory ?? Path.GetDirectoryName(this.SourcePath), relativePackageFileName);
+
+            if (!this.Overwrite && File.Exists(targetFileName) && !Confirm($"{targetFileName} already exists. Overwrite?", false))
+                throw new UpackException(ExitCode.Conflict, $"Target file '{targetFileName}' exists and overwrite was set to false.")
+                {
+                    Code = ErrorCodes.FileExists
+                };
+
+            string tmpPath = Path.GetTempFileName();
+
+            using (var existingPackage = new UniversalPackage(this.SourcePath))
+            {
+                var manifest = MergeManifest(await ReadManifestTextAsync(existingPackage), info);
+                await RewritePackageAsync(existingPackage, tmpPath, manifest, cancellationToken);
+            }
+
+            Directory.CreateDirectory(Path.GetDirectoryName(targetFileName));
+            File.Delete(targetFileName);
+            File.Move(tmpPath, targetFileName);
+
+            Log.Success($"Edited {changes.Count} propert{(changes.Count == 1 ? "y" : "ies")}: {targetFileName}");
+
+            return 0;
+        }
+
+        private static string ParseAssignments(string[] assignments, string option, Func<string, object> parseValue, Dictionary<string, object> changes)
+        {
+            foreach (var assignment in assignments ?? new string[0])
+            {
+                var parts = assignment.Split(new[] { '=' }, 2);
+                if (parts.Length != 2 || string.IsNullOrWhiteSpace(parts[0]))
+                    return $"--{option} must be in the format \"«key»=«value»\".";
+
+                var key = parts[0].Trim();
+                if (changes.ContainsKey(key))
+                    return $"{key} is specified more than once.";
+
+                object value;
+                try
+                {
+                    value = parseValue(parts[1]);
+                }
+                catch (JsonException ex)
+                {
+                    return $"--{option} value for {key} is not valid JSON: {ex.Message}";
+                }
+
+                changes.Add(key, value);
+            }
+
+            return null;
+        }
+
+        private static object ParseJson(string text)
+        {
+            using (var reader = new JsonTextReader(new StringReader(text)) { DateParseHandling = DateParseHandling.None })
+            {
+                var token = JToken.ReadFrom(reader);
+                if (reader.Read())
+                    throw new JsonReaderException("Additional text found after the JSON value.");
+
+                return token;
+            }
+        }
+
+        // group, name, and version have typed accessors on the metadata, so they are assigned through them.
+        private static string Apply(UniversalPackageMetadata info, string key, object value)
+        {
+            switch (key)
+            {
+                case "group":
+                    info.Group = (value as string) ?? (value as JValue)?.Value as string;
+                    return null;
+
+                case "name":
+                    info.Name = (value as string) ?? (value as JValue)?.Value as string;
+                    return null;
+
+                case "version":
+                    var text = (value as string) ?? (value as JValue)?.Value as string;
+                    if (text == null)
+                        return "version cannot be removed.";
+
+                    var version = UniversalPackageVersion.TryParse(text);
+                    if (version == null)
+                        return $"Invalid version {text}: {VersionCheck.Explain(text) ?? "it is not a valid UPack version number."}";
+
+                    info.Version = version;
+                    return null;
+
+                default:
+                    info[key] = value;
+                    return null;
+            }
+        }
+
+        private static string GetDefaultNote(Dictionary<string, object> changes)
+        {
+            var set = changes.Where(c => c.Value != null).Select(c => c.Key).ToList();
+            var unset = changes.Where(c => c.Value == null).Select(c => c.Key).ToList();
+
+            var parts = new List<string>();
+            if (set.Count > 0)
+                parts.Add("set " + string.Join(", ", set));
+            if (unset.Count > 0)
+                parts.Add("removed " + string.Join(", ", unset));
+
+            return "Metadata edited: " + string.Join("; ", parts) + ".";
+        }
+    }
+}
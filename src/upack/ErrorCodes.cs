@@ -0,0 +1,101 @@
+﻿using System;
+using System.Text;
+
+namespace Inedo.UPack.CLI
+{
+    // Stable codes that prefix error messages, such as "UPK1202: No versions of package tools/deploy found.", so that an error
+    // can be recognized in a support ticket or a script whatever the wording of its message. Each block of codes belongs to one
+    // exit code: UPK1000 is exit code 1, UPK1020 is 2, UPK1100-1149 are 10, UPK1150-1199 are 11, UPK1200-1299 are 12,
+    // UPK1300-1399 are 13, and UPK1400-1499 are 14. Errors without a code of their own use the first code of their block.
+    // These values must not change, and a code that is no longer used must not be given to a different error.
+    internal static class ErrorCodes
+    {
+        public const string Failed = "UPK1000";
+
+        // an option or argument is missing, malformed, or cannot be combined with another
+        public const string InvalidArguments = "UPK1020";
+
+        public const string Network = "UPK1100";
+        // the server could not be reached, or the connection was closed
+        public const string ConnectionFailed = "UPK1101";
+        // the server responded with a 5xx status
+        public const string ServerError = "UPK1102";
+        // the certificate of the server is not trusted
+        public const string CertificateNotTrusted = "UPK1103";
+        public const string Timeout = "UPK1104";
+
+        // the server responded with 401
+        public const string Unauthorized = "UPK1150";
+        // the server responded with 403
+        public const string Forbidden = "UPK1151";
+
+        public const string NotFound = "UPK1200";
+        public const string FeedNotFound = "UPK1201";
+        public const string PackageNotFound = "UPK1202";
+        // the package is not in the local registry
+        public const string NotInstalled = "UPK1203";
+        public const string NotInCache = "UPK1204";
+        public const string FileNotFound = "UPK1205";
+
+        public const string Conflict = "UPK1300";
+        public const string FileExists = "UPK1301";
+        public const string Pinned = "UPK1302";
+        public const string DependencyConflict = "UPK1303";
+        public const string AlreadyInstalled = "UPK1304";
+
+        public const string Invalid = "UPK1400";
+        // the file is not a zip archive with a upack.json
+        public const string InvalidPackage = "UPK1401";
+        public const string InvalidManifest = "UPK1402";
+        public const string HashMismatch = "UPK1403";
+        public const string IncompatiblePlatform = "UPK1404";
+        // a lock, pin, or registry file that upack wrote could not be read
+        public const string InvalidStateFile = "UPK1405";
+        public const string InvalidVersion = "UPK1406";
+
+        public static string GetDefault(ExitCode exitCode)
+        {
+            switch (exitCode)
+            {
+                case ExitCode.InvalidArguments:
+                    return InvalidArguments;
+                case ExitCode.NetworkError:
+                    return Network;
+                case ExitCode.AuthenticationFailed:
+                    return Unauthorized;
+                case ExitCode.NotFound:
+                    return NotFound;
+                case ExitCode.Conflict:
+                    return Conflict;
+                case ExitCode.ValidationFailed:
+                    return Invalid;
+                default:
+                    return Failed;
+            }
+        }
+
+        // Formats an error for display as its code and message, followed by the URL or path it concerns if the message does not
+        // already include it, and the likely fix:
+        //   UPK1150: The server rejected the username or password given
+        //     URL: https://proget/upack/Feed/versions?name=deploy
+        //     Fix: Specify --user or --api-key, or store credentials for the feed with upack login.
+        public static string Format(UpackException ex)
+        {
+            var text = new StringBuilder(ex.Code).Append(": ").Append(ex.Message);
+
+            if (!string.IsNullOrEmpty(ex.Location) && ex.Message.IndexOf(ex.Location, StringComparison.OrdinalIgnoreCase) < 0)
+            {
+                text.AppendLine();
+                text.Append(ex.Location.Contains("://") ? "  URL: " : "  Path: ").Append(ex.Location);
+            }
+
+            if (!string.IsNullOrEmpty(ex.Hint))
+            {
+                text.AppendLine();
+                text.Append("  Fix: ").Append(ex.Hint);
+            }
+
+            return text.ToString();
+        }
+    }
+}
@@ -0,0 +1,23 @@
+﻿namespace Inedo.UPack.CLI
+{
+    // The process exit codes of upack, so that scripts can tell why a command failed. These values must not change.
+    public enum ExitCode
+    {
+        Success = 0,
+        // a failure that does not fall into one of the classes below
+        Failed = 1,
+        // invalid or missing arguments; the usage of the command is displayed
+        InvalidArguments = 2,
+        Canceled = 3,
+        // the feed could not be reached, or responded with an error other than those below
+        NetworkError = 10,
+        // the feed rejected the credentials (401 or 403)
+        AuthenticationFailed = 11,
+        // a package, version, feed, or file was not found
+        NotFound = 12,
+        // an existing file, installation, pin, or dependency conflicts with the operation
+        Conflict = 13,
+        // a package, manifest, hash, or other input is not valid
+        ValidationFailed = 14
+    }
+}
@@ -0,0 +1,385 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Net.Security;
+using System.Security.Cryptography;
+using System.Security.Cryptography.X509Certificates;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    // Settings applied to every HTTP request that upack makes. The feed client creates its requests with WebRequest.Create,
+    // so registering a creator for http:// and https:// URLs lets the settings reach requests made inside the client.
+    internal static class FeedHttp
+    {
+        private static readonly TimeSpan MaxRetryDelay = TimeSpan.FromSeconds(30);
+        private static readonly TimeSpan MaxRetryAfter = TimeSpan.FromMinutes(2);
+        private static readonly Random Jitter = new Random();
+        private static bool registered;
+
+        public static X509Certificate2 ClientCertificate { get; set; }
+        public static X509Certificate2Collection TrustedCertificates { get; set; }
+        public static string BearerToken { get; set; }
+        public static IWebProxy Proxy { get; set; }
+        public static int? ConnectTimeout { get; set; }
+        public static int? TransferTimeout { get; set; }
+        public static int Retries { get; set; } = 3;
+        public static int MaxConnections { get; set; } = 8;
+        public static string UserAgent { get; set; } = $"upack/{typeof(FeedHttp).Assembly.GetName().Version.ToString(3)} ({Platform.CurrentOS}/{Platform.CurrentArchitecture})";
+        public static List<KeyValuePair<string, string>> Headers { get; } = new List<KeyValuePair<string, string>>();
+
+        public static void Register()
+        {
+            if (registered)
+                return;
+
+            registered = true;
+
+            // connections are kept alive and shared by every request to the same host, so that installing several packages
+            // from a feed does not pay for a new connection and TLS handshake each time; the .NET Framework default is only two
+            ServicePointManager.DefaultConnectionLimit = MaxConnections;
+
+            WebRequest.RegisterPrefix("http://", RequestCreator.Instance);
+            WebRequest.RegisterPrefix("https://", RequestCreator.Instance);
+        }
+
+        // Parses a --header value of the form "Name: value". A User-Agent header replaces the default user agent; other headers
+        // that HttpWebRequest manages itself, such as Host and Content-Length, are rejected.
+        public static void AddHeader(string header)
+        {
+            int colon = header.IndexOf(':');
+            var name = colon > 0 ? header.Substring(0, colon).Trim() : null;
+            if (string.IsNullOrEmpty(name) || name.Any(c => c <= ' ' || c >= 127))
+                throw new UpackException(ExitCode.InvalidArguments, $"--header must be in the format \"«name»: «value»\": {header}");
+
+            var value = header.Substring(colon + 1).Trim();
+            if (string.Equals(name, "User-Agent", StringComparison.OrdinalIgnoreCase))
+                UserAgent = value;
+            else if (WebHeaderCollection.IsRestricted(name))
+                throw new UpackException(ExitCode.InvalidArguments, $"The {name} header cannot be set with --header.");
+            else
+                Headers.Add(new KeyValuePair<string, string>(name, value));
+        }
+
+        private static void Configure(HttpWebRequest request)
+        {
+            request.UserAgent = UserAgent;
+            foreach (var header in Headers)
+                request.Headers.Add(header.Key, header.Value);
+
+            if (ClientCertificate != null)
+                request.ClientCertificates.Add(ClientCertificate);
+            if (TrustedCertificates != null)
+                request.ServerCertificateValidationCallback = ValidateServerCertificate;
+            if (Proxy != null)
+                request.Proxy = Proxy;
+            if (ConnectTimeout != null)
+                request.Timeout = ConnectTimeout.Value;
+            if (TransferTimeout != null)
+                request.ReadWriteTimeout = TransferTimeout.Value;
+            if (BearerToken != null)
+                request.Headers[HttpRequestHeader.Authorization] = "Bearer " + BearerToken;
+
+            // the feed client sets the method and the rest of the headers after the request is created
+            Log.Verbose("Requesting " + request.RequestUri);
+            Log.DebugHeaders(">", request.Headers);
+        }
+
+        // Creates a request that upack sends itself rather than through the feed client, with the credentials the client would
+        // send: basic authentication with the specified credentials, or the default credentials of the process.
+        public static HttpWebRequest CreateRequest(string url, NetworkCredential credentials)
+        {
+            var request = (HttpWebRequest)WebRequest.Create(url);
+            if (credentials == null)
+            {
+                if (BearerToken == null)
+                    request.UseDefaultCredentials = true;
+            }
+            else
+            {
+                request.Headers[HttpRequestHeader.Authorization] = "Basic " + Convert.ToBase64String(Encoding.UTF8.GetBytes(credentials.UserName + ":" + credentials.Password));
+            }
+
+            return request;
+        }
+
+        // Every request to a feed goes through here. Connection failures, timeouts, and 408, 429, 502, 503, and 504 responses
+        // are retried with exponential backoff, waiting as long as a Retry-After header asks if it is no more than two minutes.
+        public static async Task<T> SendAsync<T>(Func<Task<T>> request, CancellationToken cancellationToken)
+        {
+            for (int attempt = 1; ; attempt++)
+            {
+                try
+                {
+                    return await request().ConfigureAwait(false);
+                }
+                catch (WebException ex) when (attempt <= Retries && IsTransient(ex, out var retryAfter) && (retryAfter == null || retryAfter <= MaxRetryAfter))
+                {
+                    var delay = retryAfter ?? GetBackoff(attempt);
+                    var reason = ex.Response is HttpWebResponse response ? $"{(int)response.StatusCode} {response.StatusDescription}" : ex.Status.ToString();
+                    Log.DebugHeaders("<", ex.Response?.Headers);
+                    ex.Response?.Dispose();
+
+                    Log.Warning($"Request failed ({reason}); retrying in {Math.Ceiling(delay.TotalSeconds)} second{(delay.TotalSeconds > 1 ? "s" : string.Empty)} (retry {attempt} of {Retries})...");
+                    await Task.Delay(delay, cancellationToken).ConfigureAwait(false);
+                }
+            }
+        }
+
+        public static Task SendAsync(Func<Task> request, CancellationToken cancellationToken)
+        {
+            return SendAsync(async () => { await request().ConfigureAwait(false); return true; }, cancellationToken);
+        }
+
+        private static bool IsTransient(WebException ex, out TimeSpan? retryAfter)
+        {
+            retryAfter = null;
+
+            if (ex.Response is HttpWebResponse response)
+            {
+                int status = (int)response.StatusCode;
+                if (status == 429 || status == 503)
+                    retryAfter = ParseRetryAfter(response.Headers[HttpResponseHeader.RetryAfter]);
+
+                return status == 408 || status == 429 || status == 502 || status == 503 || status == 504;
+            }
+
+            switch (ex.Status)
+            {
+                case WebExceptionStatus.ConnectFailure:
+                case WebExceptionStatus.ConnectionClosed:
+                case WebExceptionStatus.KeepAliveFailure:
+                case WebExceptionStatus.ReceiveFailure:
+                case WebExceptionStatus.SendFailure:
+                case WebExceptionStatus.PipelineFailure:
+                case WebExceptionStatus.Timeout:
+                    return true;
+                default:
+                    return false;
+            }
+        }
+
+        // Retry-After is either a number of seconds or an HTTP date.
+        private static TimeSpan? ParseRetryAfter(string value)
+        {
+            if (string.IsNullOrWhiteSpace(value))
+                return null;
+
+            if (int.TryParse(value.Trim(), out int seconds))
+                return TimeSpan.FromSeconds(Math.Max(seconds, 0));
+
+            if (DateTimeOffset.TryParse(value, System.Globalization.CultureInfo.InvariantCulture, System.Globalization.DateTimeStyles.AssumeUniversal, out var date))
+            {
+                var delay = date - DateTimeOffset.UtcNow;
+                return delay > TimeSpan.Zero ? delay : TimeSpan.Zero;
+            }
+
+            return null;
+        }
+
+        // 1, 2, 4, 8... seconds up to 30, each increased by up to a quarter so that concurrent clients do not retry in step.
+        private static TimeSpan GetBackoff(int attempt)
+        {
+            var delay = TimeSpan.FromSeconds(Math.Min(Math.Pow(2, attempt - 1), MaxRetryDelay.TotalSeconds));
+            lock (Jitter)
+            {
+                return TimeSpan.FromMilliseconds(delay.TotalMilliseconds * (1 + Jitter.NextDouble() / 4));
+            }
+        }
+
+        // A server certificate that the system does not trust is accepted if its chain ends in one of the certificates from
+        // --ca-cert; any other problem, such as a host name mismatch, still fails the request.
+        private static bool ValidateServerCertificate(object sender, X509Certificate certificate, X509Chain chain, SslPolicyErrors errors)
+        {
+            if (errors == SslPolicyErrors.None)
+                return true;
+            if (errors != SslPolicyErrors.RemoteCertificateChainErrors || certificate == null)
+                return false;
+
+            using (var customChain = new X509Chain())
+            {
+                customChain.ChainPolicy.ExtraStore.AddRange(TrustedCertificates);
+                customChain.ChainPolicy.VerificationFlags = X509VerificationFlags.AllowUnknownCertificateAuthority;
+                customChain.ChainPolicy.RevocationMode = X509RevocationMode.NoCheck;
+
+                if (!customChain.Build(new X509Certificate2(certificate)))
+                    return false;
+
+                var root = customChain.ChainElements[customChain.ChainElements.Count - 1].Certificate;
+                return TrustedCertificates.Cast<X509Certificate2>().Any(c => c.Thumbprint == root.Thumbprint);
+            }
+        }
+
+        // Reads every certificate of a PEM bundle, or a single DER-encoded certificate.
+        public static X509Certificate2Collection LoadTrustedCertificates(string path)
+        {
+            if (!File.Exists(path))
+                throw new UpackException($"The CA certificate file '{path}' does not exist.");
+
+            var certificates = new X509Certificate2Collection();
+            try
+            {
+                var bytes = File.ReadAllBytes(path);
+                var blocks = ReadPemBlocks(Encoding.ASCII.GetString(bytes), "CERTIFICATE").ToList();
+                if (blocks.Count == 0)
+                    blocks.Add(bytes);
+
+                foreach (var block in blocks)
+                    certificates.Add(new X509Certificate2(block));
+            }
+            catch (CryptographicException ex)
+            {
+                throw new UpackException($"The CA certificate file '{path}' could not be loaded: {ex.Message}", ex);
+            }
+
+            return certificates;
+        }
+
+        // A .pfx or .p12 file is read as PKCS #12, protected by the password in UPACK_CLIENT_CERT_PASSWORD if there is one;
+        // anything else is read as PEM, with the private key either in the same file or in keyPath.
+        public static X509Certificate2 LoadClientCertificate(string certificatePath, string keyPath)
+        {
+            if (!File.Exists(certificatePath))
+                throw new UpackException($"The client certificate '{certificatePath}' does not exist.");
+            if (!string.IsNullOrEmpty(keyPath) && !File.Exists(keyPath))
+                throw new UpackException($"The client key '{keyPath}' does not exist.");
+
+            try
+            {
+                var extension = Path.GetExtension(certificatePath);
+                if (string.Equals(extension, ".pfx", StringComparison.OrdinalIgnoreCase) || string.Equals(extension, ".p12", StringComparison.OrdinalIgnoreCase))
+                {
+                    if (!string.IsNullOrEmpty(keyPath))
+                        throw new UpackException("--client-key cannot be specified with a .pfx or .p12 client certificate, which already contains its key.");
+
+                    var certificate = new X509Certificate2(certificatePath, Environment.GetEnvironmentVariable("UPACK_CLIENT_CERT_PASSWORD"), X509KeyStorageFlags.UserKeySet);
+                    if (!certificate.HasPrivateKey)
+                        throw new UpackException($"The client certificate '{certificatePath}' does not contain a private key.");
+
+                    return certificate;
+                }
+
+                return LoadPem(certificatePath, keyPath);
+            }
+            catch (CryptographicException ex)
+            {
+                throw new UpackException($"The client certificate '{certificatePath}' could not be loaded: {ex.Message}", ex);
+            }
+        }
+
+        private static X509Certificate2 LoadPem(string certificatePath, string keyPath)
+        {
+            var certificateText = File.ReadAllText(certificatePath);
+            var keyText = string.IsNullOrEmpty(keyPath) ? certificateText : File.ReadAllText(keyPath);
+
+            var certificateBytes = ReadPemBlock(certificateText, "CERTIFICATE");
+            if (certificateBytes == null)
+                throw new UpackException($"The client certificate '{certificatePath}' is not a PEM certificate or a .pfx or .p12 file.");
+
+#if NETCOREAPP
+            var certificate = new X509Certificate2(certificateBytes);
+            X509Certificate2 withKey;
+
+            var pkcs8 = ReadPemBlock(keyText, "PRIVATE KEY");
+            var rsaKey = ReadPemBlock(keyText, "RSA PRIVATE KEY");
+            var ecKey = ReadPemBlock(keyText, "EC PRIVATE KEY");
+
+            if (rsaKey != null || (pkcs8 != null && certificate.GetRSAPublicKey() != null))
+            {
+                using (var rsa = RSA.Create())
+                {
+                    if (rsaKey != null)
+                        rsa.ImportRSAPrivateKey(rsaKey, out _);
+                    else
+                        rsa.ImportPkcs8PrivateKey(pkcs8, out _);
+
+                    withKey = certificate.CopyWithPrivateKey(rsa);
+                }
+            }
+            else if (ecKey != null || (pkcs8 != null && certificate.GetECDsaPublicKey() != null))
+            {
+                using (var ecdsa = ECDsa.Create())
+                {
+                    if (ecKey != null)
+                        ecdsa.ImportECPrivateKey(ecKey, out _);
+                    else
+                        ecdsa.ImportPkcs8PrivateKey(pkcs8, out _);
+
+                    withKey = certificate.CopyWithPrivateKey(ecdsa);
+                }
+            }
+            else
+            {
+                throw new UpackException(string.IsNullOrEmpty(keyPath)
+                    ? $"The client certificate '{certificatePath}' does not contain a private key; specify it with --client-key."
+                    : $"The client key '{keyPath}' is not an unencrypted PEM RSA or EC private key.");
+            }
+
+            // SslStream on Windows cannot use an ephemeral key, so the certificate is round-tripped through PKCS #12
+            using (withKey)
+            {
+                return new X509Certificate2(withKey.Export(X509ContentType.Pkcs12), (string)null, X509KeyStorageFlags.UserKeySet);
+            }
+#else
+            throw new UpackException("PEM client certificates require the .NET Core version of upack; convert the certificate and key to a .pfx file instead.");
+#endif
+        }
+
+        // Returns the contents of the first -----BEGIN «label»----- block, or null if there is none.
+        private static byte[] ReadPemBlock(string text, string label) => ReadPemBlocks(text, label).FirstOrDefault();
+
+        private static IEnumerable<byte[]> ReadPemBlocks(string text, string label)
+        {
+            var header = $"-----BEGIN {label}-----";
+            var footer = $"-----END {label}-----";
+
+            int start = text.IndexOf(header, StringComparison.Ordinal);
+            while (start >= 0)
+            {
+                start += header.Length;
+                int end = text.IndexOf(footer, start, StringComparison.Ordinal);
+                if (end < 0)
+                    yield break;
+
+                var base64 = new StringBuilder();
+                foreach (var c in text.Substring(start, end - start))
+                {
+                    if (!char.IsWhiteSpace(c))
+                        base64.Append(c);
+                }
+
+                byte[] bytes;
+                try
+                {
+                    bytes = Convert.FromBase64String(base64.ToString());
+                }
+                catch (FormatException)
+                {
+                    bytes = null;
+                }
+
+                if (bytes != null)
+                    yield return bytes;
+
+                start = text.IndexOf(header, end + footer.Length, StringComparison.Ordinal);
+            }
+        }
+
+        private sealed class RequestCreator : IWebRequestCreate
+        {
+            public static readonly RequestCreator Instance = new RequestCreator();
+
+            public WebRequest Create(Uri uri)
+            {
+                // CreateHttp does not consult the registered prefixes, so this does not recurse
+                var request = WebRequest.CreateHttp(uri);
+                Configure(request);
+                return request;
+            }
+        }
+    }
+}
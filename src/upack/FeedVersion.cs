@@ -0,0 +1,38 @@
+﻿using System.Collections.Generic;
+using System.Linq;
+using Inedo.UPack.Net;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // A version of a package as listed by the versions endpoint of a feed, whether it was read through the feed client or from
+    // the version list cache.
+    internal sealed class FeedVersion
+    {
+        public UniversalPackageVersion Version { get; set; }
+        public IReadOnlyDictionary<string, object> Properties { get; set; }
+
+        public static FeedVersion FromRemote(RemoteUniversalPackageVersion version)
+        {
+            return new FeedVersion
+            {
+                Version = version.Version,
+                Properties = version.AllProperties?.ToDictionary(p => p.Key, p => p.Value)
+            };
+        }
+
+        // Returns null if the object does not have a valid version.
+        public static FeedVersion FromJson(JObject obj)
+        {
+            var version = UniversalPackageVersion.TryParse((string)obj["version"]);
+            if (version == null)
+                return null;
+
+            return new FeedVersion
+            {
+                Version = version,
+                Properties = obj.Properties().ToDictionary(p => p.Name, p => p.Value is JValue value ? value.Value : (object)p.Value)
+            };
+        }
+    }
+}
@@ -0,0 +1,232 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.IO.Compression;
+using System.Linq;
+using System.Net;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Net;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("files")]
+    [Description("Lists the files contained in a local universal package, or in a remote universal package without downloading it.")]
+    public sealed class Files : FeedCommand
+    {
+        [DisplayName("package")]
+        [Description("Path of a valid .upack file, or the name and group of a remote package, such as group/name.")]
+        [PositionalArgument(0)]
+        public string PackagePath { get; set; }
+
+        [DisplayName("version")]
+        [Description("For a remote package, the package version, a version range, or latest, latest-stable, or latest-prerelease. If not specified, the latest version is used.")]
+        [PositionalArgument(1, Optional = true)]
+        public string Version { get; set; }
+
+        [DisplayName("source")]
+        [Description("URL of a upack API endpoint. Required for a remote package.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_FEED")]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("user")]
+        [Description("User name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("summary")]
+        [Description("Instead of listing every file, display the number and total size of files per extension and the largest files.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Summary { get; set; } = false;
+
+        [DisplayName("top")]
+        [Description("Number of largest files to display with --summary; the default is 10.")]
+        [ExtraArgument]
+        public string Top { get; set; }
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            int top = 10;
+            if (!string.IsNullOrEmpty(this.Top) && (!int.TryParse(this.Top, out top) || top < 0))
+                throw new UpackException(ExitCode.InvalidArguments, "--top must be a non-negative integer.");
+
+            var localPath = Path.GetFullPath(Path.Combine(Environment.CurrentDirectory, this.PackagePath));
+            List<PackageFile> files;
+            if (this.PackagePath.EndsWith(".upack", StringComparison.OrdinalIgnoreCase) || File.Exists(localPath))
+            {
+                if (!string.IsNullOrEmpty(this.Version))
+                    throw new UpackException(ExitCode.InvalidArguments, "version cannot be specified for a local package file.");
+
+                files = ReadLocalFiles(localPath);
+            }
+            else
+            {
+                if (string.IsNullOrEmpty(this.SourceUrl))
+                    throw new UpackException(ExitCode.InvalidArguments, "--source is required unless package is a local file.");
+
+                files = await this.ReadRemoteFilesAsync(cancellationToken);
+            }
+
+            bool compressed = files.All(f => f.CompressedLength.HasValue);
+
+            if (!this.Summary)
+            {
+                foreach (var file in files)
+                    Console.WriteLine($"{file.Length,14:N0}  {file.Path}{(string.IsNullOrEmpty(file.Hash) ? string.Empty : "  " + file.Hash)}");
+            }
+            else
+            {
+                Console.WriteLine("Extension          Files            Size  Compressed");
+                var extensions = from f in files
+                                 group f by Path.GetExtension(f.Path).ToLowerInvariant() into g
+                                 orderby g.Sum(f => f.Length) descending
+                                 select g;
+
+                foreach (var extension in extensions)
+                {
+                    var name = extension.Key == string.Empty ? "(none)" : extension.Key;
+                    var ratio = compressed ? FormatRatio(extension.Sum(f => f.CompressedLength.Value), extension.Sum(f => f.Length)) : "-";
+                    Console.WriteLine($"{name,-12} {extension.Count(),11:N0} {extension.Sum(f => f.Length),15:N0} {ratio,11}");
+                }
+
+                if (top > 0 && files.Count > 0)
+                {
+                    Console.WriteLine();
+                    Console.WriteLine("Largest files:");
+                    foreach (var file in files.OrderByDescending(f => f.Length).Take(top))
+                        Console.WriteLine($"{file.Length,14:N0}  {file.Path}");
+                }
+            }
+
+            Console.WriteLine();
+            if (compressed)
+                Console.WriteLine($"{files.Count} files, {files.Sum(f => f.Length):N0} bytes ({files.Sum(f => f.CompressedLength.Value):N0} bytes compressed)");
+            else
+                Console.WriteLine($"{files.Count} files, {files.Sum(f => f.Length):N0} bytes");
+
+            WriteResult(
+                new JArray(
+                    files.Select(
+                        f => new JObject
+                        {
+                            ["path"] = f.Path,
+                            ["size"] = f.Length,
+                            ["compressedSize"] = f.CompressedLength,
+                            ["hash"] = f.Hash
+                        }
+                    )
+                )
+            );
+
+            return 0;
+        }
+
+        private static List<PackageFile> ReadLocalFiles(string path)
+        {
+            ZipArchive zip;
+            try
+            {
+                zip = new ZipArchive(File.OpenRead(path), ZipArchiveMode.Read);
+            }
+            catch (Exception ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                {
+                    Code = ErrorCodes.InvalidPackage,
+                    Location = path
+                };
+            }
+
+            using (zip)
+            {
+                return zip.Entries
+                    .Where(e => e.FullName.StartsWith(DefaultContentRoot, StringComparison.OrdinalIgnoreCase) && !e.FullName.EndsWith("/"))
+                    .Select(e => new PackageFile(e.FullName.Substring(DefaultContentRoot.Length), e.Length, e.CompressedLength, null))
+                    .ToList();
+            }
+        }
+
+        // Feeds that support it return the file list with the version when includeFileList is requested; the package itself is not downloaded.
+        private async Task<List<PackageFile>> ReadRemoteFilesAsync(CancellationToken cancellationToken)
+        {
+            var client = CreateClient(this.SourceUrl, this.Authentication, this.ApiKey);
+
+            UniversalPackageId packageId;
+            try
+            {
+                packageId = UniversalPackageId.Parse(this.PackagePath);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            var version = await this.GetVersionAsync(client, packageId, this.Version, false, false, cancellationToken);
+
+            RemoteUniversalPackageVersion remoteVersion;
+            try
+            {
+                remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(packageId, version, true, cancellationToken), cancellationToken);
+            }
+            catch (WebException ex)
+            {
+                throw ConvertWebException(ex, PackageNotFoundMessage);
+            }
+
+            if (remoteVersion == null)
+                throw new UpackException(ExitCode.NotFound, $"{packageId} {version} was not found in {this.SourceUrl}.")
+                {
+                    Code = ErrorCodes.PackageNotFound
+                };
+
+            if (remoteVersion.AllProperties == null || !remoteVersion.AllProperties.TryGetValue("fileList", out var fileList) || fileList == null || !(JToken.FromObject(fileList) is JArray entries))
+                throw new UpackException($"{this.SourceUrl} did not return a file list for {packageId} {version}; the feed may not support listing package contents.");
+
+            var files = new List<PackageFile>();
+            foreach (var entry in entries.OfType<JObject>())
+            {
+                var name = ((string)entry["name"])?.Replace('\\', '/');
+                if (string.IsNullOrEmpty(name) || name.EndsWith("/"))
+                    continue;
+
+                // some feeds list raw archive paths, others paths relative to the package contents
+                if (name.StartsWith(DefaultContentRoot, StringComparison.OrdinalIgnoreCase))
+                    name = name.Substring(DefaultContentRoot.Length);
+                else if (string.Equals(name, "upack.json", StringComparison.OrdinalIgnoreCase))
+                    continue;
+
+                var hash = (string)entry["sha256"] ?? (string)entry["sha1"];
+                files.Add(new PackageFile(name, (long?)entry["size"] ?? 0, null, hash));
+            }
+
+            return files;
+        }
+
+        private sealed class PackageFile
+        {
+            public PackageFile(string path, long length, long? compressedLength, string hash)
+            {
+                this.Path = path;
+                this.Length = length;
+                this.CompressedLength = compressedLength;
+                this.Hash = hash;
+            }
+
+            public string Path { get; }
+            public long Length { get; }
+            public long? CompressedLength { get; }
+            public string Hash { get; }
+        }
+    }
+}
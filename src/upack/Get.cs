@@ -4,12 +4,13 @@ using System.IO;
 using System.Net;
 using System.Threading;
 using System.Threading.Tasks;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("get")]
     [Description("Downloads a universal package from a feed without installing it.")]
-    public sealed class Get : Command
+    public sealed class Get : FeedCommand
     {
         [DisplayName("package")]
         [Description("Package name and group, such as group/name.")]
@@ -17,7 +18,7 @@ namespace Inedo.UPack.CLI
         public string PackageName { get; set; }
 
         [DisplayName("version")]
-        [Description("Package version. If not specified, the latest version is retrieved.")]
+        [Description("Package version, a version range such as ^2.3, ~1.4, 2.x, 1.2.*, or \">=1.2 <2.0\" to retrieve the latest matching version, or latest, latest-stable, or latest-prerelease. If not specified, the latest version is retrieved.")]
         [PositionalArgument(1, Optional = true)]
         public string Version { get; set; }
 
@@ -39,25 +40,75 @@ namespace Inedo.UPack.CLI
         [UseEnvironmentVariableAsDefault("UPACK_USER")]
         public NetworkCredential Authentication { get; set; }
 
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("infer-group")]
+        [Description("When the package name does not include a group, use the group that follows the feed name in the source URL, such as https://proget/upack/Feed/«group».")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_INFER_GROUP")]
+        public bool InferGroup { get; set; } = false;
+
         [DisplayName("overwrite")]
         [Description("When specified, overwrite files in the target directory.")]
         [ExtraArgument]
         [DefaultValue(false)]
         public bool Overwrite { get; set; }
 
+        [DisplayName("download-threads")]
+        [Description("Number of connections to download a large package over in parallel, when the feed supports range requests; the default is 1.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_DOWNLOAD_THREADS")]
+        public string DownloadThreads { get; set; }
+
         [DisplayName("prerelease")]
         [Description("When version is not specified, will download the latest prerelase version instead of the latest stable version.")]
         [ExtraArgument]
         [DefaultValue(false)]
         public bool Prerelease { get; set; }
 
+        [DisplayName("include-yanked")]
+        [Description("When version is not specified, also consider versions that the feed has unlisted or deprecated.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IncludeYanked { get; set; } = false;
+
+        [DisplayName("legacy-versions")]
+        [Description("Accept four-part versions such as 1.2.3.4, treating the fourth part as build metadata (1.2.3+4).")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_LEGACY_VERSIONS")]
+        public bool LegacyVersions { get; set; } = false;
+
+        protected override bool AllowLegacyVersions => this.LegacyVersions;
+
+        [DisplayName("warnings-as-errors")]
+        [Description("Fail instead of displaying a warning.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_WARNINGS_AS_ERRORS")]
+        public bool WarningsAsErrors { get; set; } = false;
+
+        protected override bool TreatWarningsAsErrors => this.WarningsAsErrors;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
+            int downloadThreads = 1;
+            if (!string.IsNullOrEmpty(this.DownloadThreads) && (!int.TryParse(this.DownloadThreads, out downloadThreads) || downloadThreads < 1))
+                throw new UpackException(ExitCode.InvalidArguments, "--download-threads must be a positive integer.");
+
             var targetDirectory = this.TargetDirectory;
             if (string.IsNullOrEmpty(targetDirectory))
                 targetDirectory = Environment.CurrentDirectory;
 
-            var client = CreateClient(this.SourceUrl, this.Authentication);
+            var sourceUrl = this.SourceUrl;
+            var inferredGroup = this.InferGroup ? InferGroupFromSource(ref sourceUrl) : null;
+
+            var client = CreateClient(sourceUrl, this.Authentication, this.ApiKey);
             UniversalPackageId id;
             try
             {
@@ -65,25 +116,50 @@ namespace Inedo.UPack.CLI
             }
             catch (ArgumentException ex)
             {
-                throw new UpackException("Invalid package ID: " + ex.Message, ex);
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
             }
 
-            var version = await GetVersionAsync(client, id, this.Version, this.Prerelease, cancellationToken);
+            if (string.IsNullOrEmpty(id.Group) && !string.IsNullOrEmpty(inferredGroup))
+                id = new UniversalPackageId(inferredGroup, id.Name);
+
+            var version = await GetVersionAsync(client, id, this.Version, this.Prerelease, this.IncludeYanked, cancellationToken);
 
             var fileName = Path.Combine(targetDirectory, $"{id.Name}-{version.Major}.{version.Minor}.{version.Patch}.upack");
-            if (File.Exists(fileName) && !this.Overwrite)
-                throw new UpackException($"File {fileName} already exists and --overwrite is not specified.");
+            bool overwrite = this.Overwrite;
+            if (File.Exists(fileName) && !overwrite)
+            {
+                if (!Confirm($"{fileName} already exists. Overwrite?", false))
+                    throw new UpackException(ExitCode.Conflict, $"File {fileName} already exists and --overwrite is not specified.")
+                    {
+                        Code = ErrorCodes.FileExists
+                    };
+
+                overwrite = true;
+            }
 
-            Console.WriteLine($"Saving package to {fileName}...");
+            Log.Info($"Saving package to {fileName}...");
 
             // use FileMode.Create/CreateNew here to guard against race condition with File.Exists
-            using (var destStream = new FileStream(fileName, this.Overwrite ? FileMode.Create : FileMode.CreateNew, FileAccess.Write, FileShare.None))
+            HexString sha1;
+            using (var destStream = new FileStream(fileName, overwrite ? FileMode.Create : FileMode.CreateNew, FileAccess.Write, FileShare.None))
             using (var stream = await openPackageAsync())
             {
+                sha1 = GetSHA1(stream);
                 stream.CopyTo(destStream);
             }
 
-            Console.WriteLine("Package downloaded.");
+            Log.Success("Package downloaded.");
+
+            WriteResult(
+                new JObject
+                {
+                    ["group"] = id.Group,
+                    ["name"] = id.Name,
+                    ["version"] = version.ToString(),
+                    ["path"] = fileName,
+                    ["sha1"] = sha1.ToString()
+                }
+            );
 
             return 0;
 
@@ -91,9 +167,13 @@ namespace Inedo.UPack.CLI
             {
                 try
                 {
-                    var s = await client.GetPackageStreamAsync(id, version, cancellationToken);
+                    var s = await DownloadPackageAsync(client, sourceUrl, this.Authentication, this.ApiKey, id, version, downloadThreads, cancellationToken);
                     if (s == null)
-                        throw new UpackException(PackageNotFoundMessage);
+                        throw new UpackException(ExitCode.NotFound, PackageNotFoundMessage)
+                        {
+                            Code = ErrorCodes.PackageNotFound,
+                            Location = sourceUrl
+                        };
 
                     return s;
                 }
@@ -2,6 +2,7 @@
 using System.ComponentModel;
 using System.Threading;
 using System.Threading.Tasks;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
@@ -20,6 +21,7 @@ namespace Inedo.UPack.CLI
             var sha1 = GetSHA1(this.PackagePath);
 
             Console.WriteLine(sha1);
+            WriteResult(new JObject { ["sha1"] = sha1.ToString() });
 
             return Task.FromResult(0);
         }
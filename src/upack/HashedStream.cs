@@ -0,0 +1,106 @@
+﻿using System;
+using System.IO;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    // A downloaded package with the SHA1 and SHA256 hashes of its contents, which are computed in the same pass that receives
+    // it, so that verifying and registering a package of several GB does not read it from disk again.
+    internal sealed class HashedStream : Stream
+    {
+        private readonly Stream inner;
+
+        public HashedStream(Stream inner, HexString sha1, HexString sha256)
+        {
+            this.inner = inner;
+            this.SHA1 = sha1;
+            this.SHA256 = sha256;
+        }
+
+        public HexString SHA1 { get; }
+        public HexString SHA256 { get; }
+
+        // Copies a network stream to a temporary file, hashing each block as it is written; the source is disposed.
+        public static async Task<HashedStream> CopyToTempFileAsync(Stream source, CancellationToken cancellationToken)
+        {
+            using (source)
+            {
+                var file = new FileStream(Path.GetTempFileName(), FileMode.Create, FileAccess.ReadWrite, FileShare.None, 4096, FileOptions.DeleteOnClose | FileOptions.Asynchronous);
+                try
+                {
+                    using (var sha1 = System.Security.Cryptography.SHA1.Create())
+                    using (var sha256 = System.Security.Cryptography.SHA256.Create())
+                    {
+                        var buffer = new byte[81920];
+                        int read;
+                        while ((read = await source.ReadAsync(buffer, 0, buffer.Length, cancellationToken)) > 0)
+                        {
+                            sha1.TransformBlock(buffer, 0, read, null, 0);
+                            sha256.TransformBlock(buffer, 0, read, null, 0);
+                            await file.WriteAsync(buffer, 0, read, cancellationToken);
+                        }
+
+                        sha1.TransformFinalBlock(new byte[0], 0, 0);
+                        sha256.TransformFinalBlock(new byte[0], 0, 0);
+
+                        file.Position = 0;
+                        return new HashedStream(file, new HexString(sha1.Hash), new HexString(sha256.Hash));
+                    }
+                }
+                catch
+                {
+                    file.Dispose();
+                    throw;
+                }
+            }
+        }
+
+        // Reads a seekable stream once to compute both hashes, for a package whose parts were received out of order.
+        public static HashedStream Compute(Stream stream)
+        {
+            using (var sha1 = System.Security.Cryptography.SHA1.Create())
+            using (var sha256 = System.Security.Cryptography.SHA256.Create())
+            {
+                var buffer = new byte[81920];
+                int read;
+                while ((read = stream.Read(buffer, 0, buffer.Length)) > 0)
+                {
+                    sha1.TransformBlock(buffer, 0, read, null, 0);
+                    sha256.TransformBlock(buffer, 0, read, null, 0);
+                }
+
+                sha1.TransformFinalBlock(new byte[0], 0, 0);
+                sha256.TransformFinalBlock(new byte[0], 0, 0);
+
+                stream.Position = 0;
+                return new HashedStream(stream, new HexString(sha1.Hash), new HexString(sha256.Hash));
+            }
+        }
+
+        public override bool CanRead => this.inner.CanRead;
+        public override bool CanSeek => this.inner.CanSeek;
+        public override bool CanWrite => false;
+        public override long Length => this.inner.Length;
+        public override long Position
+        {
+            get => this.inner.Position;
+            set => this.inner.Position = value;
+        }
+
+        public override int Read(byte[] buffer, int offset, int count) => this.inner.Read(buffer, offset, count);
+        public override Task<int> ReadAsync(byte[] buffer, int offset, int count, CancellationToken cancellationToken) => this.inner.ReadAsync(buffer, offset, count, cancellationToken);
+        public override long Seek(long offset, SeekOrigin origin) => this.inner.Seek(offset, origin);
+        public override void Flush() => this.inner.Flush();
+        public override void SetLength(long value) => throw new NotSupportedException();
+        public override void Write(byte[] buffer, int offset, int count) => throw new NotSupportedException();
+
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing)
+                this.inner.Dispose();
+
+            base.Dispose(disposing);
+        }
+    }
+}
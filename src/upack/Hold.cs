@@ -0,0 +1,96 @@
+﻿using System;
+using System.ComponentModel;
+using System.IO;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("hold")]
+    [Description("Pins the package installed in a directory to a version or version range by writing a .upack-pin file there; install will not replace it with a version outside the pin.")]
+    public sealed class Hold : Command
+    {
+        [DisplayName("package")]
+        [Description("Package name and group, such as group/name.")]
+        [PositionalArgument(0)]
+        public string PackageName { get; set; }
+
+        [DisplayName("version")]
+        [Description("Version or version range, such as 1.2.3, ~1.2, or ^1, to keep the package at.")]
+        [PositionalArgument(1, Optional = true)]
+        public string Version { get; set; }
+
+        [DisplayName("at-path")]
+        [Description("Directory the package is installed to. If not specified, the current working directory is used.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string AtPath { get; set; }
+
+        [DisplayName("reason")]
+        [Description("The reason for holding the package, stored in the pin file.")]
+        [ExtraArgument]
+        public string Reason { get; set; }
+
+        [DisplayName("release")]
+        [Description("Remove the pin file instead of writing one.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Release { get; set; } = false;
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var directory = string.IsNullOrEmpty(this.AtPath) ? Environment.CurrentDirectory : this.AtPath;
+
+            UniversalPackageId id;
+            try
+            {
+                id = UniversalPackageId.Parse(this.PackageName);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            var existing = PackagePin.TryRead(directory);
+            if (existing != null && !existing.IsFor(id))
+                throw new UpackException(ExitCode.Conflict, $"{directory} is already pinned to {existing}.")
+                {
+                    Code = ErrorCodes.Pinned,
+                    Hint = "Release the pin with upack hold --release first."
+                };
+
+            if (this.Release)
+            {
+                if (existing == null)
+                {
+                    Log.Info($"{id} is not held at {directory}.");
+                    return Task.FromResult(0);
+                }
+
+                File.Delete(Path.Combine(directory, PackagePin.FileName));
+                Log.Success($"Released {existing} at {directory}.");
+                return Task.FromResult(0);
+            }
+
+            if (string.IsNullOrEmpty(this.Version))
+                throw new UpackException(ExitCode.InvalidArguments, "A version or version range is required unless --release is specified.");
+
+            if (VersionRange.TryParse(this.Version) == null)
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid UPack version number or range: {this.Version}");
+
+            var pin = new PackagePin
+            {
+                Group = id.Group,
+                Name = id.Name,
+                Version = this.Version,
+                Reason = this.Reason,
+                Date = this.Clock.Now.ToString("o"),
+                By = Environment.UserName
+            };
+
+            pin.Write(directory);
+            Log.Success($"Holding {pin} at {directory}.");
+            return Task.FromResult(0);
+        }
+    }
+}
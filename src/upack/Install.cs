@@ -1,32 +1,46 @@
 ﻿using System;
+using System.Collections.Generic;
 using System.ComponentModel;
 using System.IO;
+using System.Linq;
 using System.Net;
+using System.Security.Cryptography;
+using System.Text;
 using System.Threading;
 using System.Threading.Tasks;
+using Inedo.UPack.Net;
 using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("install")]
     [Description("Downloads the specified universal package and extracts its contents to a directory.")]
-    public sealed class Install : Command
+    public sealed class Install : FeedCommand
     {
+        private List<FeedSource> sources = new List<FeedSource>();
+        private int downloadThreads = 1;
+        private int? maxDepth;
+        private List<UniversalPackageId> excludedDependencies = new List<UniversalPackageId>();
+        private List<LocalPackage> localPackages;
+        private ProgressDisplay progressDisplay;
+
         [DisplayName("package")]
         [Description("Package name and group, such as group/name.")]
         [PositionalArgument(0)]
         public string PackageName { get; set; }
 
         [DisplayName("version")]
-        [Description("Package version. If not specified, the latest version is retrieved.")]
+        [Description("Package version, a version range such as ^2.3, ~1.4, 2.x, 1.2.*, or \">=1.2 <2.0\" to retrieve the latest matching version, or latest, latest-stable, or latest-prerelease. If not specified, the latest version is retrieved.")]
         [PositionalArgument(1, Optional = true)]
         public string Version { get; set; }
 
         [DisplayName("source")]
-        [Description("URL of a upack API endpoint.")]
-        [ExtraArgument(Optional = false)]
+        [Description("URL of a upack API endpoint. May be specified more than once, or as a comma-separated list, to try each feed in order. Required unless --offline is specified.")]
+        [ExtraArgument]
         [UseEnvironmentVariableAsDefault("UPACK_FEED")]
-        public string SourceUrl { get; set; }
+        public string[] SourceUrls { get; set; }
 
         [DisplayName("target")]
         [Description("Directory where the contents of the package will be extracted.")]
@@ -40,6 +54,19 @@ namespace Inedo.UPack.CLI
         [UseEnvironmentVariableAsDefault("UPACK_USER")]
         public NetworkCredential Authentication { get; set; }
 
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("infer-group")]
+        [Description("When the package name does not include a group, use the group that follows the feed name in the source URL, such as https://proget/upack/Feed/«group».")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_INFER_GROUP")]
+        public bool InferGroup { get; set; } = false;
+
         [DisplayName("overwrite")]
         [Description("When specified, overwrite files in the target directory.")]
         [ExtraArgument]
@@ -52,6 +79,21 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool Prerelease { get; set; } = false;
 
+        [DisplayName("include-yanked")]
+        [Description("When version is not specified, also consider versions that the feed has unlisted or deprecated.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IncludeYanked { get; set; } = false;
+
+        [DisplayName("legacy-versions")]
+        [Description("Accept four-part versions such as 1.2.3.4, treating the fourth part as build metadata (1.2.3+4).")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_LEGACY_VERSIONS")]
+        public bool LegacyVersions { get; set; } = false;
+
+        protected override bool AllowLegacyVersions => this.LegacyVersions;
+
         [DisplayName("comment")]
         [Description("The reason for installing the package, for the local registry.")]
         [ExtraArgument]
@@ -63,6 +105,30 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool UserRegistry { get; set; } = false;
 
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("lock-timeout")]
+        [Description("Number of seconds to wait for another process to release the registry lock before failing. If not specified, waits indefinitely.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_LOCK_TIMEOUT")]
+        public string LockTimeout { get; set; }
+
+        [DisplayName("lock-poll-interval")]
+        [Description("Number of seconds to wait between attempts to acquire the registry lock; the default is 0.5.")]
+        [ExtraArgument]
+        public string LockPollInterval { get; set; }
+
         [DisplayName("unregistered")]
         [Description("Do not register the package in a local registry.")]
         [ExtraArgument]
@@ -75,19 +141,209 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool CachePackages { get; set; } = false;
 
+        [DisplayName("download-threads")]
+        [Description("Number of connections to download a large package over in parallel, when the feed supports range requests; the default is 1.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_DOWNLOAD_THREADS")]
+        public string DownloadThreads { get; set; }
+
         [DisplayName("preserve-timestamps")]
         [Description("Set extracted file timestamps to the timestamp of the file in the archive instead of the current time.")]
         [ExtraArgument]
         [DefaultValue(false)]
         public bool PreserveTimestamps { get; set; } = false;
 
+        [DisplayName("content-root")]
+        [Description("Directory inside the archive that contains the package contents; the default is package/. Use / to extract everything except upack.json from the archive root.")]
+        [ExtraArgument]
+        public string ContentRoot { get; set; }
+
+        [DisplayName("ignore-pin")]
+        [Description("Install the requested version even if the target directory has a .upack-pin file that does not allow it.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IgnorePin { get; set; } = false;
+
+        [DisplayName("on-existing")]
+        [Description("What to do when the same version of the package is already registered at the target directory: reinstall (the default), skip, verify, or fail.")]
+        [ExtraArgument]
+        public string OnExisting { get; set; }
+
+        [DisplayName("show-readme")]
+        [Description("After installing, display the README file included in the package contents, if there is one.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ShowReadme { get; set; } = false;
+
+        [DisplayName("run-as")]
+        [Description("When running as root on Linux or macOS, extract the package as this user so that the extracted files are owned by it; downloading, caching, and registering are still done as root.")]
+        [ExtraArgument]
+        public string RunAs { get; set; }
+
+        [DisplayName("offline")]
+        [Description("Resolve the version and read the package only from the package cache of the local registry, without contacting the feed.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Offline { get; set; } = false;
+
+        [DisplayName("with-dependencies")]
+        [Description("Also install the packages listed as dependencies in the manifest, and their dependencies, into the target directory, registering each one.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool WithDependencies { get; set; } = false;
+
+        [DisplayName("conflict")]
+        [Description("With --with-dependencies, what to do when two packages contain different files at the same path: fail (the default), highest-version to use the file from the package with the highest version, first-wins to use the file from the package resolved first, or report to use the file from the package resolved first and display a warning.")]
+        [ExtraArgument]
+        public string Conflict { get; set; }
+
+        [DisplayName("max-depth")]
+        [Description("With --with-dependencies, only install dependencies up to this many levels below the package; 1 installs only the dependencies listed in its manifest.")]
+        [ExtraArgument]
+        public string MaxDepth { get; set; }
+
+        [DisplayName("exclude")]
+        [Description("With --with-dependencies, do not install this dependency (group/name) or the dependencies that only it requires, such as a package that is already provided by the base image. May be specified more than once.")]
+        [ExtraArgument]
+        public string[] Exclude { get; set; }
+
+        [DisplayName("local-source")]
+        [Description("With --with-dependencies, a directory of .upack files to take the package and its dependencies from, when it has a version that satisfies the requirement, instead of downloading them from the feed.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string LocalSource { get; set; }
+
+        [DisplayName("graph")]
+        [Description("With --with-dependencies, resolve the dependencies and write the graph to standard output instead of installing: dot for a Graphviz digraph, or json for each package with its dependencies and the SHA256 hash of each of its files.")]
+        [ExtraArgument]
+        public string Graph { get; set; }
+
+        [DisplayName("ignore-platform")]
+        [Description("Install the package even if its manifest lists operating systems or architectures that do not include this machine.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IgnorePlatform { get; set; } = false;
+
+        [DisplayName("warnings-as-errors")]
+        [Description("Fail instead of displaying a warning.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_WARNINGS_AS_ERRORS")]
+        public bool WarningsAsErrors { get; set; } = false;
+
+        protected override bool TreatWarningsAsErrors => this.WarningsAsErrors;
+
+        [DisplayName("lock")]
+        [Description("Record the installed version and SHA1 hash of the package in the lock file.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Lock { get; set; } = false;
+
+        [DisplayName("locked")]
+        [Description("Install the version recorded in the lock file, and fail if the package is not in it or its contents have changed.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Locked { get; set; } = false;
+
+        [DisplayName("lockfile")]
+        [Description("Path of the lock file; the default is upack.lock in the current working directory.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string LockFile { get; set; }
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
             var targetDirectory = this.TargetDirectory;
             if (string.IsNullOrEmpty(targetDirectory))
                 targetDirectory = Environment.CurrentDirectory;
 
-            var client = CreateClient(this.SourceUrl, this.Authentication);
+            if (!string.IsNullOrEmpty(this.RunAs))
+            {
+                var runAsError = RunAsUser.CheckSupported();
+                if (runAsError != null)
+                    throw new UpackException(ExitCode.InvalidArguments, runAsError);
+            }
+
+            var onExisting = string.IsNullOrEmpty(this.OnExisting) ? "reinstall" : this.OnExisting.ToLowerInvariant();
+            if (onExisting != "reinstall" && onExisting != "skip" && onExisting != "verify" && onExisting != "fail")
+                throw new UpackException(ExitCode.InvalidArguments, "--on-existing must be reinstall, skip, verify, or fail.");
+
+            var conflictStrategy = string.IsNullOrEmpty(this.Conflict) ? "fail" : this.Conflict.ToLowerInvariant();
+            if (conflictStrategy != "fail" && conflictStrategy != "highest-version" && conflictStrategy != "first-wins" && conflictStrategy != "report")
+                throw new UpackException(ExitCode.InvalidArguments, "--conflict must be fail, highest-version, first-wins, or report.");
+
+            if (!string.IsNullOrEmpty(this.DownloadThreads) && (!int.TryParse(this.DownloadThreads, out this.downloadThreads) || this.downloadThreads < 1))
+                throw new UpackException(ExitCode.InvalidArguments, "--download-threads must be a positive integer.");
+
+            if (!string.IsNullOrEmpty(this.MaxDepth))
+            {
+                if (!int.TryParse(this.MaxDepth, out int depth) || depth < 0)
+                    throw new UpackException(ExitCode.InvalidArguments, "--max-depth must be a non-negative integer.");
+                this.maxDepth = depth;
+            }
+
+            foreach (var excluded in this.Exclude ?? new string[0])
+            {
+                try
+                {
+                    this.excludedDependencies.Add(UniversalPackageId.Parse(excluded));
+                }
+                catch (ArgumentException ex)
+                {
+                    throw new UpackException(ExitCode.InvalidArguments, $"Invalid package ID for --exclude: {ex.Message}", ex);
+                }
+            }
+
+            if ((this.maxDepth != null || this.excludedDependencies.Count > 0) && !this.WithDependencies)
+                throw new UpackException(ExitCode.InvalidArguments, "--max-depth and --exclude require --with-dependencies.");
+
+            if (!string.IsNullOrEmpty(this.LocalSource))
+            {
+                if (!this.WithDependencies)
+                    throw new UpackException(ExitCode.InvalidArguments, "--local-source requires --with-dependencies.");
+                if (!Directory.Exists(this.LocalSource))
+                    throw new UpackException(ExitCode.InvalidArguments, $"The local source directory '{this.LocalSource}' does not exist.");
+
+                this.localPackages = ReadLocalPackages(this.LocalSource);
+            }
+
+            var graphFormat = this.Graph?.ToLowerInvariant();
+            if (graphFormat != null && graphFormat != "dot" && graphFormat != "json")
+                throw new UpackException(ExitCode.InvalidArguments, "--graph must be dot or json.");
+            if (graphFormat != null && !this.WithDependencies)
+                throw new UpackException(ExitCode.InvalidArguments, "--graph requires --with-dependencies.");
+
+            var sourceUrls = (this.SourceUrls ?? new string[0])
+                .SelectMany(s => s.Split(','))
+                .Select(s => s.Trim())
+                .Where(s => s.Length > 0)
+                .ToList();
+
+            string inferredGroup = null;
+            if (this.InferGroup)
+            {
+                for (int i = 0; i < sourceUrls.Count; i++)
+                {
+                    var url = sourceUrls[i];
+                    var group = InferGroupFromSource(ref url);
+                    sourceUrls[i] = url;
+
+                    // the group applies to the package on every source, so the sources must agree on it
+                    if (group != null && inferredGroup != null && !string.Equals(group, inferredGroup, StringComparison.OrdinalIgnoreCase))
+                        throw new UpackException(ExitCode.InvalidArguments, $"--infer-group found the groups {inferredGroup} and {group} in the source URLs; specify the group in the package name instead.");
+
+                    inferredGroup = group ?? inferredGroup;
+                }
+            }
+
+            if (sourceUrls.Count == 0 && !this.Offline)
+                throw new UpackException(ExitCode.InvalidArguments, "--source is required unless --offline is specified.");
+
+            if (!this.Offline)
+                this.sources = sourceUrls.Select(u => new FeedSource(u, CreateClient(u, this.Authentication, this.ApiKey))).ToList();
+
+            // the feed the package came from, which is recorded in the registry and the lock file
+            FeedSource source = null;
             UniversalPackageId id;
             try
             {
@@ -95,74 +351,845 @@ namespace Inedo.UPack.CLI
             }
             catch (ArgumentException ex)
             {
-                throw new UpackException("Invalid package ID: " + ex.Message, ex);
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            if (string.IsNullOrEmpty(id.Group) && !string.IsNullOrEmpty(inferredGroup))
+                id = new UniversalPackageId(inferredGroup, id.Name);
+
+            var requestedVersion = this.Version;
+            var lockPath = string.IsNullOrEmpty(this.LockFile) ? Path.Combine(Environment.CurrentDirectory, PackageLock.FileName) : this.LockFile;
+            LockedPackage locked = null;
+            if (this.Locked)
+            {
+                var lockFile = PackageLock.TryRead(lockPath);
+                if (lockFile == null)
+                    throw new UpackException(ExitCode.NotFound, $"{lockPath} does not exist; use --lock to create it.")
+                    {
+                        Code = ErrorCodes.FileNotFound
+                    };
+
+                locked = lockFile.Find(id);
+                if (locked == null)
+                    throw new UpackException(ExitCode.NotFound, $"{id} is not in {lockPath}; use --lock to add it.")
+                    {
+                        Location = lockPath
+                    };
+
+                var lockedVersion = this.ParseVersion(locked.Version);
+                if (lockedVersion == null)
+                    throw new UpackException(ExitCode.ValidationFailed, $"{lockPath} records an invalid version for {id}: {locked.Version}")
+                    {
+                        Code = ErrorCodes.InvalidStateFile
+                    };
+
+                if (!string.IsNullOrEmpty(requestedVersion) && !IsLatestKeyword(requestedVersion))
+                {
+                    var requested = this.ParseVersion(requestedVersion);
+                    bool allowed = requested != null ? requested.Equals(lockedVersion) : VersionRange.TryParse(requestedVersion)?.IsMatch(lockedVersion, true) == true;
+                    if (!allowed)
+                        throw new UpackException(ExitCode.Conflict, $"{lockPath} locks {locked}, which does not match the requested version {requestedVersion}; install with --lock to update the lock file.")
+                        {
+                            Location = lockPath
+                        };
+                }
+
+                requestedVersion = locked.Version;
+            }
+
+            var pin = this.IgnorePin ? null : PackagePin.TryRead(targetDirectory);
+            if (pin != null && pin.IsFor(id) && string.IsNullOrEmpty(requestedVersion))
+            {
+                Log.Info($"{targetDirectory} is held at {pin.Version}.");
+                requestedVersion = pin.Version;
+            }
+
+            UniversalPackageVersion version;
+            var local = this.FindLocalPackage(id, requestedVersion);
+            if (local != null)
+            {
+                version = local.Version;
+            }
+            else if (this.Offline)
+            {
+                using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+                {
+                    version = this.GetCachedVersion(registry, id, requestedVersion, this.Prerelease);
+                }
+            }
+            else
+            {
+                version = await this.FromFirstSourceAsync(
+                    this.sources,
+                    async s =>
+                    {
+                        var resolved = await this.GetVersionAsync(s.Client, id, requestedVersion, this.Prerelease, this.IncludeYanked, cancellationToken);
+                        source = s;
+                        return resolved;
+                    }
+                );
+            }
+
+            if (pin != null)
+            {
+                if (!pin.IsFor(id))
+                    throw new UpackException(ExitCode.Conflict, $"{targetDirectory} is pinned to {pin}; use upack hold --release or --ignore-pin to install a different package there.")
+                    {
+                        Code = ErrorCodes.Pinned
+                    };
+
+                var range = VersionRange.TryParse(pin.Version);
+                if (range != null && !range.IsMatch(version, true))
+                    throw new UpackException(ExitCode.Conflict, $"{targetDirectory} is pinned to {pin}, which does not allow version {version}; use upack hold to change the pin or --ignore-pin to install anyway.")
+                    {
+                        Code = ErrorCodes.Pinned
+                    };
+            }
+
+            bool verifyOnly = false;
+            if (onExisting != "reinstall" && graphFormat == null)
+            {
+                InstalledPackage existing;
+                using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+                {
+                    existing = (await registry.GetInstalledPackagesAsync()).FirstOrDefault(
+                        p => string.Equals(p.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                            && string.Equals(p.Name, id.Name, StringComparison.OrdinalIgnoreCase)
+                            && string.Equals(p.Version, version.ToString(), StringComparison.OrdinalIgnoreCase)
+                            && !string.IsNullOrEmpty(p.InstallPath)
+                            && string.Equals(Path.GetFullPath(p.InstallPath).TrimEnd(Path.DirectorySeparatorChar), Path.GetFullPath(targetDirectory).TrimEnd(Path.DirectorySeparatorChar), StringComparison.OrdinalIgnoreCase)
+                    );
+                }
+
+                if (existing != null)
+                {
+                    if (onExisting == "skip")
+                    {
+                        Log.Info($"{id} {version} is already installed at {targetDirectory}.");
+                        WriteResult(GetResult("skipped", id, version, targetDirectory));
+                        return 0;
+                    }
+
+                    if (onExisting == "fail")
+                        throw new UpackException(ExitCode.Conflict, $"{id} {version} is already installed at {targetDirectory}; use --on-existing=reinstall to install it again.")
+                        {
+                            Code = ErrorCodes.AlreadyInstalled
+                        };
+
+                    verifyOnly = true;
+                }
+            }
+
+            if (this.WithDependencies)
+                this.progressDisplay = ProgressDisplay.Start(!JsonOutput && !Console.IsOutputRedirected);
+
+            var packageStream = local != null ? File.OpenRead(local.Path) : await EnsureSeekableAsync(await this.FromFirstSourceAsync(this.GetSourcesFor(source), s => { source = s; return this.OpenPackageAsync(s, id, version, cancellationToken); }), cancellationToken);
+            var sourceUrl = local?.Path ?? source?.Url ?? sourceUrls.FirstOrDefault();
+            var sha1 = GetSHA1(packageStream);
+            var size = packageStream.Length;
+
+            if (locked != null && !string.IsNullOrEmpty(locked.SHA1) && !string.Equals(sha1.ToString(), locked.SHA1, StringComparison.OrdinalIgnoreCase))
+            {
+                packageStream.Dispose();
+                throw new UpackException(ExitCode.ValidationFailed, $"The SHA1 hash of {id} {version} is {sha1}, but {lockPath} expects {locked.SHA1}; the package has changed since it was locked.")
+                {
+                    Code = ErrorCodes.HashMismatch,
+                    Location = lockPath,
+                    Hint = "If the change is expected, update the lock file by installing without --locked."
+                };
             }
 
-            var version = await GetVersionAsync(client, id, this.Version, this.Prerelease, cancellationToken);
+            string readme = null;
+            var dependencies = new List<ResolvedDependency>();
+            try
+            {
+                using (var package = new UniversalPackage(packageStream))
+                {
+                    id = new UniversalPackageId(package.Group, package.Name);
+                    version = package.Version;
+
+                    if (verifyOnly)
+                        return this.VerifyInstalledFiles(package, id, version, targetDirectory);
+
+                    if (!this.IgnorePlatform)
+                    {
+                        var problem = Platform.CheckCompatible(package.GetFullMetadata());
+                        if (problem != null)
+                            throw new UpackException(ExitCode.ValidationFailed, $"{id} {version} {problem}; use --ignore-platform to install it anyway.")
+                            {
+                                Code = ErrorCodes.IncompatiblePlatform
+                            };
+                    }
+
+                    bool overwrite;
+                    ResolvedDependency root = null;
+                    if (this.WithDependencies)
+                    {
+                        root = new ResolvedDependency { Id = id, Version = version, Package = package, SHA1 = sha1, Size = size, RequiredBy = "the command line", Source = sourceUrl };
+                        await this.ResolveDependenciesAsync(root, dependencies, this.Locked ? PackageLock.TryRead(lockPath) : null, lockPath, cancellationToken);
 
-            using (var package = new UniversalPackage(await openPackageAsync()))
+                        if (graphFormat != null)
+                        {
+                            this.progressDisplay?.Clear();
+                            if (graphFormat == "json")
+                            {
+                                var graph = this.FormatJsonGraph(root, dependencies);
+                                if (JsonOutput)
+                                    WriteResult(graph);
+                                else
+                                    Console.WriteLine(graph.ToString(Formatting.Indented));
+                            }
+                            else
+                            {
+                                var graph = FormatDotGraph(root, dependencies);
+                                if (JsonOutput)
+                                    WriteResult(new JObject { ["graph"] = graph });
+                                else
+                                    Console.Write(graph);
+                            }
+
+                            return 0;
+                        }
+
+                        // every file has been checked against the target directory and the other packages, so packages that
+                        // ship identical copies of a file may overwrite each other
+                        this.progressDisplay?.Clear();
+                        this.CheckForConflicts(root, dependencies, targetDirectory, conflictStrategy);
+                        overwrite = true;
+
+                        var contentRoot = NormalizeContentRoot(this.ContentRoot);
+                        this.progressDisplay?.BeginExtraction(
+                            dependencies.Count + 1,
+                            new[] { package }.Concat(dependencies.Select(d => d.Package)).Sum(p => p.Entries.Count(e => !e.IsDirectory && GetContentPath(e, contentRoot) != null))
+                                - dependencies.Sum(d => d.ExcludedPaths.Count) - root.ExcludedPaths.Count
+                        );
+                    }
+                    else
+                    {
+                        overwrite = ConfirmOverwrite(package, targetDirectory, this.ContentRoot, this.Overwrite);
+                    }
+
+                    using (string.IsNullOrEmpty(this.RunAs) ? null : RunAsUser.Switch(this.RunAs))
+                    {
+                        await UnpackZipAsync(targetDirectory, overwrite, package, this.PreserveTimestamps, this.ContentRoot, cancellationToken, root?.ExcludedPaths);
+                        foreach (var dependency in dependencies)
+                        {
+                            Log.Info($"Installing dependency {dependency.Id} {dependency.Version}...");
+                            await UnpackZipAsync(targetDirectory, overwrite, dependency.Package, this.PreserveTimestamps, this.ContentRoot, cancellationToken, dependency.ExcludedPaths);
+                        }
+                    }
+
+                    if (this.ShowReadme)
+                        readme = Readme.ReadFromPackage(package, NormalizeContentRoot(this.ContentRoot));
+                }
+            }
+            finally
             {
-                id = new UniversalPackageId(package.Group, package.Name);
-                version = package.Version;
-                await UnpackZipAsync(targetDirectory, this.Overwrite, package, this.PreserveTimestamps, cancellationToken);
+                foreach (var dependency in dependencies)
+                    dependency.Package.Dispose();
+
+                this.progressDisplay?.Dispose();
             }
 
+            // Only register once the package has been fully extracted so that failed installs never appear in the registry.
             if (!this.Unregistered)
             {
-                using (var registry = PackageRegistry.GetRegistry(this.UserRegistry))
-                {
-                    await registry.LockAsync(cancellationToken);
-                    await registry.RegisterPackageAsync(
-                        new RegisteredPackage
-                        {
-                            FeedUrl = this.SourceUrl,
-                            Group = id.Group,
-                            Name = id.Name,
-                            Version = version.ToString(),
-                            InstallPath = targetDirectory,
-                            InstallationDate = DateTimeOffset.Now.ToString("o"),
-                            InstallationReason = this.Comment,
-                            InstalledBy = Environment.UserName,
-                            InstalledUsing = "upack/" + typeof(Program).Assembly.GetName().Version.ToString()
+                await this.RegisterAsync(sourceUrl, id, version, targetDirectory, sha1, size, this.Comment, cancellationToken);
+                foreach (var dependency in dependencies)
+                    await this.RegisterAsync(dependency.Source ?? sourceUrl, dependency.Id, dependency.Version, targetDirectory, dependency.SHA1, dependency.Size, $"Dependency of {dependency.RequiredBy}", cancellationToken);
+            }
+
+            if (this.Lock)
+            {
+                var lockFile = PackageLock.TryRead(lockPath) ?? new PackageLock();
+                lockFile.Set(
+                    new LockedPackage
+                    {
+                        Group = id.Group,
+                        Name = id.Name,
+                        Version = version.ToString(),
+                        SHA1 = sha1.ToString(),
+                        Source = sourceUrl
+                    }
+                );
+                foreach (var dependency in dependencies)
+                {
+                    lockFile.Set(
+                        new LockedPackage
+                        {
+                            Group = dependency.Id.Group,
+                            Name = dependency.Id.Name,
+                            Version = dependency.Version.ToString(),
+                            SHA1 = dependency.SHA1.ToString(),
+                            Source = dependency.Source ?? sourceUrl
                         }
                     );
                 }
+                lockFile.Write(lockPath);
+                Log.Info($"Locked {id} {version}{(dependencies.Count > 0 ? $" and {dependencies.Count} dependencies" : string.Empty)} in {lockPath}.");
+            }
+
+            if (this.ShowReadme)
+            {
+                Console.WriteLine();
+                Console.WriteLine(readme?.TrimEnd() ?? $"{id} {version} does not include a README.");
             }
 
+            var result = GetResult("installed", id, version, targetDirectory);
+            result["source"] = sourceUrl;
+            result["sha1"] = sha1.ToString();
+            result["size"] = size;
+            result["dependencies"] = new JArray(
+                dependencies.Select(
+                    d => new JObject
+                    {
+                        ["group"] = d.Id.Group,
+                        ["name"] = d.Id.Name,
+                        ["version"] = d.Version.ToString(),
+                        ["source"] = d.Source ?? sourceUrl,
+                        ["sha1"] = d.SHA1.ToString(),
+                        ["size"] = d.Size,
+                        ["requiredBy"] = d.RequiredBy
+                    }
+                )
+            );
+            WriteResult(result);
+
             return 0;
+        }
+
+        // The --json result of an install; status is installed, skipped, or verified.
+        private static JObject GetResult(string status, UniversalPackageId id, UniversalPackageVersion version, string targetDirectory)
+        {
+            return new JObject
+            {
+                ["status"] = status,
+                ["group"] = id.Group,
+                ["name"] = id.Name,
+                ["version"] = version.ToString(),
+                ["path"] = targetDirectory
+            };
+        }
 
-            async Task<Stream> openPackageAsync()
+        private async Task<Stream> OpenPackageAsync(FeedSource source, UniversalPackageId id, UniversalPackageVersion version, CancellationToken cancellationToken)
+        {
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry, this.LockTimeout, this.LockPollInterval))
             {
-                using (var registry = PackageRegistry.GetRegistry(this.UserRegistry))
+                if (this.CachePackages || this.Offline)
+                {
+                    var s = await registry.TryOpenFromCacheAsync(id, version, cancellationToken);
+                    if (s != null)
+                        return s;
+
+                    if (this.Offline)
+                        throw new UpackException(ExitCode.NotFound, $"{id} {version} is not in the package cache of {registry.RegistryRoot}.")
+                        {
+                            Code = ErrorCodes.NotInCache
+                        };
+                }
+
+                try
                 {
+                    var s = await DownloadPackageAsync(source.Client, source.Url, this.Authentication, this.ApiKey, id, version, this.downloadThreads, cancellationToken);
+                    if (s == null)
+                        throw new UpackException(ExitCode.NotFound, PackageNotFoundMessage)
+                        {
+                            Code = ErrorCodes.PackageNotFound,
+                            Location = source.Url
+                        };
+
                     if (this.CachePackages)
                     {
-                        var s = await registry.TryOpenFromCacheAsync(id, version, cancellationToken);
-                        if (s != null)
-                            return s;
+                        // the hashes of the download still describe the cached copy
+                        var hashed = (HashedStream)s;
+                        await registry.WriteToCacheAsync(id, version, s, cancellationToken);
+                        s.Dispose();
+                        return new HashedStream(await registry.TryOpenFromCacheAsync(id, version, cancellationToken), hashed.SHA1, hashed.SHA256);
                     }
 
-                    try
+                    return s;
+                }
+                catch (WebException ex)
+                {
+                    throw ConvertWebException(ex, PackageNotFoundMessage);
+                }
+            }
+        }
+
+        // Runs the action against each source in order until one succeeds, so that mirrored feeds fail over to each other; the
+        // error from every source but the last is reported as a warning. With --offline there are no sources, and the action gets null.
+        private async Task<T> FromFirstSourceAsync<T>(IReadOnlyList<FeedSource> sources, Func<FeedSource, Task<T>> action)
+        {
+            if (sources.Count == 0)
+                return await action(null);
+
+            for (int i = 0; ; i++)
+            {
+                try
+                {
+                    return await action(sources[i]);
+                }
+                catch (UpackException ex) when (i < sources.Count - 1)
+                {
+                    Log.Warning($"{sources[i].Url}: {ex.Message} Trying {sources[i + 1].Url}.");
+                }
+            }
+        }
+
+        // The package is downloaded from the feed its version was resolved on, and then from the others in order.
+        private IReadOnlyList<FeedSource> GetSourcesFor(FeedSource preferred)
+        {
+            if (preferred == null)
+                return this.sources;
+
+            return new[] { preferred }.Concat(this.sources.Where(s => s != preferred)).ToList();
+        }
+
+        private async Task RegisterAsync(string sourceUrl, UniversalPackageId id, UniversalPackageVersion version, string targetDirectory, HexString sha1, long size, string reason, CancellationToken cancellationToken)
+        {
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry, this.LockTimeout, this.LockPollInterval))
+            {
+                await registry.LockAsync(cancellationToken);
+                await registry.RegisterPackageAsync(
+                    new InstalledPackage
+                    {
+                        FeedUrl = sourceUrl,
+                        Group = id.Group,
+                        Name = id.Name,
+                        Version = version.ToString(),
+                        InstallPath = targetDirectory,
+                        InstallationDate = this.Clock.Now.ToString("o"),
+                        InstallationReason = reason,
+                        InstalledBy = Environment.UserName,
+                        InstalledUsing = "upack/" + typeof(Program).Assembly.GetName().Version.ToString(),
+                        SHA1 = sha1.ToString(),
+                        Size = size
+                    },
+                    cancellationToken
+                );
+
+                Log.Event("register", new JObject { ["package"] = id.ToString(), ["version"] = version.ToString(), ["path"] = targetDirectory, ["registry"] = registry.RegistryRoot });
+            }
+        }
+
+        // Walks the dependencies listed in each manifest breadth-first, downloading every package in the closure once. A package
+        // that is required again, including through a cycle, must be satisfied by the version already selected for it.
+        private async Task ResolveDependenciesAsync(ResolvedDependency root, List<ResolvedDependency> resolved, PackageLock lockFile, string lockPath, CancellationToken cancellationToken)
+        {
+            var pending = new Queue<KeyValuePair<ResolvedDependency, string>>();
+            foreach (var dependency in root.GetDependencies())
+                pending.Enqueue(new KeyValuePair<ResolvedDependency, string>(root, dependency));
+
+            while (pending.Count > 0)
+            {
+                var next = pending.Dequeue();
+                this.progressDisplay?.SetQueued(pending.Count);
+                var parent = next.Key;
+                var text = next.Value;
+
+                ParseDependency(text, out var id, out var constraint);
+                if (id == null)
+                    throw new UpackException(ExitCode.ValidationFailed, $"{parent.Id} {parent.Version} has an invalid dependency: {text}")
                     {
-                        var s = await client.GetPackageStreamAsync(id, version, cancellationToken);
-                        if (s == null)
-                            throw new UpackException(PackageNotFoundMessage);
+                        Code = ErrorCodes.InvalidManifest
+                    };
+
+                var selected = root.IsFor(id) ? root : resolved.FirstOrDefault(d => d.IsFor(id));
+                if (selected != null)
+                {
+                    if (!string.IsNullOrEmpty(constraint) && !IsLatestKeyword(constraint) && !this.Satisfies(selected.Version, constraint))
+                        throw new UpackException(ExitCode.Conflict, $"Dependency conflict: {parent.Id} {parent.Version} requires {id} {constraint}, but {id} {selected.Version} is required by {selected.RequiredBy}.")
+                        {
+                            Code = ErrorCodes.DependencyConflict
+                        };
+
+                    parent.Dependencies.Add(new KeyValuePair<string, ResolvedDependency>(text, selected));
+                    continue;
+                }
+
+                if (this.excludedDependencies.Any(e => string.Equals(e.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase) && string.Equals(e.Name, id.Name, StringComparison.OrdinalIgnoreCase)))
+                {
+                    Log.Info($"Skipping dependency {id} of {parent.Id} {parent.Version} (--exclude).");
+                    continue;
+                }
+
+                if (parent.Depth + 1 > this.maxDepth)
+                {
+                    Log.Info($"Skipping dependency {id} of {parent.Id} {parent.Version} (--max-depth={this.maxDepth}).");
+                    continue;
+                }
+
+                var requestedVersion = constraint;
+                LockedPackage locked = null;
+                if (lockFile != null)
+                {
+                    locked = lockFile.Find(id);
+                    if (locked == null)
+                        throw new UpackException(ExitCode.NotFound, $"{id}, a dependency of {parent.Id} {parent.Version}, is not in {lockPath}; use --lock to add it.")
+                        {
+                            Location = lockPath
+                        };
 
-                        if (this.CachePackages)
+                    if (!string.IsNullOrEmpty(constraint) && !IsLatestKeyword(constraint) && !this.Satisfies(this.ParseVersion(locked.Version), constraint))
+                        throw new UpackException(ExitCode.Conflict, $"{lockPath} locks {locked}, which does not satisfy the requirement of {parent.Id} {parent.Version} for {constraint}; install with --lock to update the lock file.")
                         {
-                            await registry.WriteToCacheAsync(id, version, s, cancellationToken);
-                            s.Dispose();
-                            return await registry.TryOpenFromCacheAsync(id, version, cancellationToken);
+                            Code = ErrorCodes.DependencyConflict,
+                            Location = lockPath
+                        };
+
+                    requestedVersion = locked.Version;
+                }
+
+                UniversalPackageVersion version;
+                FeedSource source = null;
+                var local = this.FindLocalPackage(id, requestedVersion);
+                if (local != null)
+                {
+                    version = local.Version;
+                }
+                else if (this.Offline)
+                {
+                    using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+                    {
+                        version = this.GetCachedVersion(registry, id, requestedVersion, this.Prerelease);
+                    }
+                }
+                else
+                {
+                    version = await this.FromFirstSourceAsync(
+                        this.sources,
+                        async s =>
+                        {
+                            var resolvedVersion = await this.GetVersionAsync(s.Client, id, requestedVersion, this.Prerelease, this.IncludeYanked, cancellationToken);
+                            source = s;
+                            return resolvedVersion;
                         }
+                    );
+                }
 
-                        return s;
+                var stream = local != null ? File.OpenRead(local.Path) : await EnsureSeekableAsync(await this.FromFirstSourceAsync(this.GetSourcesFor(source), s => { source = s; return this.OpenPackageAsync(s, id, version, cancellationToken); }), cancellationToken);
+                var dependency = new ResolvedDependency
+                {
+                    Id = id,
+                    Version = version,
+                    SHA1 = GetSHA1(stream),
+                    Size = stream.Length,
+                    RequiredBy = $"{parent.Id} {parent.Version}",
+                    Source = local?.Path ?? source?.Url,
+                    Depth = parent.Depth + 1
+                };
+
+                if (locked != null && !string.IsNullOrEmpty(locked.SHA1) && !string.Equals(dependency.SHA1.ToString(), locked.SHA1, StringComparison.OrdinalIgnoreCase))
+                {
+                    stream.Dispose();
+                    throw new UpackException(ExitCode.ValidationFailed, $"The SHA1 hash of {id} {version} is {dependency.SHA1}, but {lockPath} expects {locked.SHA1}; the package has changed since it was locked.")
+                    {
+                        Code = ErrorCodes.HashMismatch,
+                        Location = lockPath,
+                        Hint = "If the change is expected, update the lock file by installing without --locked."
+                    };
+                }
+
+                dependency.Package = new UniversalPackage(stream);
+                resolved.Add(dependency);
+                parent.Dependencies.Add(new KeyValuePair<string, ResolvedDependency>(text, dependency));
+                Log.Info($"Resolved dependency {id} {version} (required by {dependency.RequiredBy}).");
+
+                if (!this.IgnorePlatform)
+                {
+                    var problem = Platform.CheckCompatible(dependency.Package.GetFullMetadata());
+                    if (problem != null)
+                        throw new UpackException(ExitCode.ValidationFailed, $"{id} {version}, a dependency of {dependency.RequiredBy}, {problem}; use --ignore-platform to install it anyway.")
+                        {
+                            Code = ErrorCodes.IncompatiblePlatform
+                        };
+                }
+
+                foreach (var child in dependency.GetDependencies())
+                    pending.Enqueue(new KeyValuePair<ResolvedDependency, string>(dependency, child));
+            }
+        }
+
+        // Reads the ID and version of each .upack file in the directory, whatever its name; a file that is not a valid package is
+        // reported and ignored.
+        private List<LocalPackage> ReadLocalPackages(string directory)
+        {
+            var packages = new List<LocalPackage>();
+            foreach (var path in Directory.EnumerateFiles(directory, "*.upack"))
+            {
+                try
+                {
+                    using (var package = new UniversalPackage(path))
+                    {
+                        packages.Add(new LocalPackage { Id = new UniversalPackageId(package.Group, package.Name), Version = package.Version, Path = Path.GetFullPath(path) });
+                    }
+                }
+                catch (Exception ex) when (ex is InvalidDataException || ex is IOException || ex is UnauthorizedAccessException || ex is FormatException || ex is ArgumentException)
+                {
+                    this.Warn($"{path} is not a valid universal package and will not be used: {ex.Message}");
+                }
+            }
+
+            Log.Verbose($"Found {packages.Count} packages in {directory}.");
+            return packages;
+        }
+
+        // Returns the highest version of the package in --local-source that satisfies the requirement, or null if there is none.
+        // As with feeds, prerelease versions are only considered with --prerelease unless an exact version is required.
+        private LocalPackage FindLocalPackage(UniversalPackageId id, string requestedVersion)
+        {
+            if (this.localPackages == null)
+                return null;
+
+            var candidates = this.localPackages.Where(
+                p => string.Equals(p.Id.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                    && string.Equals(p.Id.Name, id.Name, StringComparison.OrdinalIgnoreCase)
+            );
+
+            if (string.IsNullOrEmpty(requestedVersion) || IsLatestKeyword(requestedVersion))
+            {
+                bool prerelease = this.Prerelease || string.Equals(requestedVersion, "latest-prerelease", StringComparison.OrdinalIgnoreCase);
+                candidates = candidates.Where(p => prerelease || string.IsNullOrEmpty(p.Version.Prerelease));
+            }
+            else
+            {
+                var exact = this.ParseVersion(requestedVersion);
+                var range = exact == null ? VersionRange.TryParse(requestedVersion) : null;
+                candidates = candidates.Where(p => exact != null ? p.Version.Equals(exact) : range?.IsMatch(p.Version, this.Prerelease) == true);
+            }
+
+            var match = candidates.OrderByDescending(p => p.Version).FirstOrDefault();
+            if (match != null)
+                Log.Info($"Using {id} {match.Version} from {match.Path}.");
+
+            return match;
+        }
+
+        // Formats the resolved packages as a Graphviz digraph, with a node for each package and an edge labeled with the
+        // requirement for each dependency listed in a manifest.
+        private static string FormatDotGraph(ResolvedDependency root, List<ResolvedDependency> dependencies)
+        {
+            string Quote(string value) => "\"" + value.Replace("\\", "\\\\").Replace("\"", "\\\"") + "\"";
+            string Node(ResolvedDependency resolved) => Quote($"{resolved.Id}:{resolved.Version}");
+
+            var text = new StringBuilder();
+            text.AppendLine("digraph dependencies {");
+            foreach (var package in new[] { root }.Concat(dependencies))
+            {
+                text.AppendLine($"  {Node(package)};");
+                foreach (var dependency in package.Dependencies)
+                    text.AppendLine($"  {Node(package)} -> {Node(dependency.Value)} [label={Quote(dependency.Key)}];");
+            }
+            text.AppendLine("}");
+            return text.ToString();
+        }
+
+        // Describes the resolved packages as JSON: the root package, and each package in the closure with where it came from, the
+        // package selected for each dependency listed in its manifest, and the size and SHA256 hash of each of its files.
+        private JObject FormatJsonGraph(ResolvedDependency root, List<ResolvedDependency> dependencies)
+        {
+            var contentRoot = NormalizeContentRoot(this.ContentRoot);
+            return new JObject
+            {
+                ["root"] = $"{root.Id}:{root.Version}",
+                ["packages"] = new JArray(
+                    new[] { root }.Concat(dependencies).Select(
+                        p => new JObject
+                        {
+                            ["group"] = p.Id.Group,
+                            ["name"] = p.Id.Name,
+                            ["version"] = p.Version.ToString(),
+                            ["source"] = p.Source,
+                            ["sha1"] = p.SHA1.ToString(),
+                            ["size"] = p.Size,
+                            ["requiredBy"] = p.RequiredBy,
+                            ["depth"] = p.Depth,
+                            ["dependencies"] = new JArray(
+                                p.Dependencies.Select(
+                                    d => new JObject
+                                    {
+                                        ["requirement"] = d.Key,
+                                        ["package"] = $"{d.Value.Id}:{d.Value.Version}"
+                                    }
+                                )
+                            ),
+                            ["files"] = new JArray(
+                                p.Package.Entries
+                                    .Where(e => !e.IsDirectory)
+                                    .Select(e => new { Entry = e, Path = GetContentPath(e, contentRoot) })
+                                    .Where(e => e.Path != null)
+                                    .Select(e => DescribeFile(e.Entry, e.Path))
+                            )
+                        }
+                    )
+                )
+            };
+        }
+
+        private static JObject DescribeFile(UniversalPackageEntry entry, string path)
+        {
+            using (var hash = SHA256.Create())
+            using (var stream = entry.Open())
+            {
+                var buffer = new byte[81920];
+                long size = 0;
+                int read;
+                while ((read = stream.Read(buffer, 0, buffer.Length)) > 0)
+                {
+                    hash.TransformBlock(buffer, 0, read, null, 0);
+                    size += read;
+                }
+
+                hash.TransformFinalBlock(buffer, 0, 0);
+                return new JObject
+                {
+                    ["path"] = path,
+                    ["size"] = size,
+                    ["sha256"] = new HexString(hash.Hash).ToString()
+                };
+            }
+        }
+
+        // Fails before anything is extracted if two packages in the closure contain different files at the same path, unless the
+        // conflict strategy picks one of them and adds the path to the ExcludedPaths of the others, or if a file already exists in
+        // the target directory, --overwrite was not specified, and replacing it is not confirmed.
+        private void CheckForConflicts(ResolvedDependency root, List<ResolvedDependency> dependencies, string targetDirectory, string strategy)
+        {
+            var contentRoot = NormalizeContentRoot(this.ContentRoot);
+            var owners = new Dictionary<string, KeyValuePair<ResolvedDependency, HexString>>(StringComparer.OrdinalIgnoreCase);
+            var conflicts = new List<string>();
+            var existing = new List<string>();
+
+            foreach (var package in new[] { root }.Concat(dependencies))
+            {
+                foreach (var entry in package.Package.Entries)
+                {
+                    var contentPath = GetContentPath(entry, contentRoot);
+                    if (contentPath == null || entry.IsDirectory)
+                        continue;
+
+                    HexString hash;
+                    using (var entryStream = entry.Open())
+                    {
+                        hash = GetHash(entryStream, "SHA1");
                     }
-                    catch (WebException ex)
+
+                    if (owners.TryGetValue(contentPath, out var owner))
                     {
-                        throw ConvertWebException(ex, PackageNotFoundMessage);
+                        if (owner.Value == hash)
+                            continue;
+
+                        var conflict = $"{contentPath} differs between {owner.Key.Id} {owner.Key.Version} and {package.Id} {package.Version}";
+                        if (strategy == "fail")
+                        {
+                            conflicts.Add(conflict);
+                        }
+                        else if (strategy == "highest-version" && package.Version.CompareTo(owner.Key.Version) > 0)
+                        {
+                            owner.Key.ExcludedPaths.Add(contentPath);
+                            owners[contentPath] = new KeyValuePair<ResolvedDependency, HexString>(package, hash);
+                            Log.Info($"{conflict}; using the file from {package.Id} {package.Version}.");
+                        }
+                        else
+                        {
+                            package.ExcludedPaths.Add(contentPath);
+                            if (strategy == "report")
+                                this.Warn(conflict + ".");
+                            else
+                                Log.Info($"{conflict}; using the file from {owner.Key.Id} {owner.Key.Version}.");
+                        }
+
+                        continue;
                     }
+
+                    owners.Add(contentPath, new KeyValuePair<ResolvedDependency, HexString>(package, hash));
+
+                    if (!this.Overwrite && File.Exists(Path.Combine(targetDirectory, contentPath)))
+                        existing.Add($"{contentPath} from {package.Id} {package.Version} already exists in {targetDirectory}; use --overwrite to replace it");
                 }
             }
+
+            // there is no point in asking if the installation will fail anyway
+            if (existing.Count > 0 && (conflicts.Count > 0 || !Confirm($"{existing.Count} file{(existing.Count == 1 ? " already exists" : "s already exist")} in {targetDirectory}. Overwrite?", false)))
+                conflicts.AddRange(existing);
+
+            if (conflicts.Count > 0)
+                throw new UpackException(ExitCode.Conflict, "Unable to install the package with its dependencies:" + Environment.NewLine + "  " + string.Join(Environment.NewLine + "  ", conflicts))
+                {
+                    Code = ErrorCodes.DependencyConflict,
+                    Hint = "Use --conflict=highest-version or --conflict=first-wins to choose one of the conflicting files, or --conflict=report to list them and continue."
+                };
+        }
+
+        private bool Satisfies(UniversalPackageVersion version, string constraint)
+        {
+            if (version == null)
+                return false;
+
+            var exact = this.ParseVersion(constraint);
+            if (exact != null)
+                return exact.Equals(version);
+
+            return VersionRange.TryParse(constraint)?.IsMatch(version, true) == true;
+        }
+
+        // Compares the files in an existing installation with the package contents instead of extracting them again.
+        private int VerifyInstalledFiles(UniversalPackage package, UniversalPackageId id, UniversalPackageVersion version, string targetDirectory)
+        {
+            var root = NormalizeContentRoot(this.ContentRoot);
+            int files = 0;
+            int problems = 0;
+
+            foreach (var entry in package.Entries)
+            {
+                var contentPath = GetContentPath(entry, root);
+                if (contentPath == null || entry.IsDirectory)
+                    continue;
+
+                files++;
+                var targetPath = Path.Combine(targetDirectory, contentPath);
+                if (!File.Exists(targetPath))
+                {
+                    Console.WriteLine("Missing: " + contentPath);
+                    problems++;
+                    continue;
+                }
+
+                HexString expected;
+                using (var entryStream = entry.Open())
+                {
+                    expected = GetHash(entryStream, "SHA1");
+                }
+
+                if (GetSHA1(targetPath) != expected)
+                {
+                    Console.WriteLine("Modified: " + contentPath);
+                    problems++;
+                }
+            }
+
+            if (problems > 0)
+                throw new UpackException(ExitCode.ValidationFailed, $"{problems} of {files} files in {targetDirectory} do not match {id} {version}.")
+                {
+                    Code = ErrorCodes.HashMismatch,
+                    Hint = "Install the package again with --on-existing=reinstall to restore the original files."
+                };
+
+            Log.Success($"{id} {version} is already installed at {targetDirectory}; all {files} files match the package.");
+            WriteResult(GetResult("verified", id, version, targetDirectory));
+            return 0;
+        }
+
+        private sealed class FeedSource
+        {
+            public FeedSource(string url, UniversalFeedClient client)
+            {
+                this.Url = url;
+                this.Client = client;
+            }
+
+            public string Url { get; }
+            public UniversalFeedClient Client { get; }
         }
     }
 }
@@ -0,0 +1,49 @@
+﻿using System.Collections.Generic;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class InstalledPackage
+    {
+        [JsonProperty("group")]
+        public string Group { get; set; }
+
+        [JsonProperty("name")]
+        public string Name { get; set; }
+
+        [JsonProperty("version")]
+        public string Version { get; set; }
+
+        [JsonProperty("path")]
+        public string InstallPath { get; set; }
+
+        [JsonProperty("feedUrl")]
+        public string FeedUrl { get; set; }
+
+        [JsonProperty("installationDate")]
+        public string InstallationDate { get; set; }
+
+        [JsonProperty("installationReason")]
+        public string InstallationReason { get; set; }
+
+        [JsonProperty("installedUsing")]
+        public string InstalledUsing { get; set; }
+
+        [JsonProperty("installedBy")]
+        public string InstalledBy { get; set; }
+
+        [JsonProperty("sha1")]
+        public string SHA1 { get; set; }
+
+        [JsonProperty("size")]
+        public long? Size { get; set; }
+
+        // Properties written by other tools are preserved when the registry is rewritten.
+        [JsonExtensionData]
+        public IDictionary<string, JToken> ExtensionData { get; set; }
+
+        public override string ToString() => (string.IsNullOrEmpty(this.Group) ? this.Name : this.Group + ":" + this.Name) + " " + this.Version;
+    }
+}
@@ -1,9 +1,12 @@
 ﻿using System;
 using System.Collections.Generic;
 using System.ComponentModel;
+using System.IO;
+using System.Linq;
 using System.Threading;
 using System.Threading.Tasks;
 using Inedo.UPack.Packaging;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
@@ -17,54 +20,217 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool UserRegistry { get; set; } = false;
 
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("all-registries")]
+        [Description("List packages in the machine, user, and project registries, and in the registry specified by --registry-path, annotated with the registry each one is in.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool AllRegistries { get; set; } = false;
+
+        [DisplayName("search")]
+        [Description("Only list packages whose group or name contains the specified text, or that are present in the package cache with a tag that contains it.")]
+        [ExtraArgument]
+        public string Search { get; set; }
+
+        [DisplayName("warnings-as-errors")]
+        [Description("Fail instead of displaying a warning.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_WARNINGS_AS_ERRORS")]
+        public bool WarningsAsErrors { get; set; } = false;
+
+        protected override bool TreatWarningsAsErrors => this.WarningsAsErrors;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
-            IReadOnlyList<RegisteredPackage> packages;
-            using (var registry = PackageRegistry.GetRegistry(this.UserRegistry))
+            var registries = this.AllRegistries ? this.GetAllRegistries() : new Dictionary<string, Registry> { [string.Empty] = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry) };
+
+            int count = 0;
+            var results = new JArray();
+            foreach (var entry in registries)
             {
-                await registry.LockAsync(cancellationToken);
-                try
+                using (var registry = entry.Value)
                 {
-                    packages = await registry.GetInstalledPackagesAsync();
-                }
-                finally
-                {
-                    await registry.UnlockAsync();
+                    IReadOnlyList<InstalledPackage> packages;
+                    try
+                    {
+                        packages = await registry.GetInstalledPackagesAsync();
+                    }
+                    catch (UpackException ex) when (this.AllRegistries)
+                    {
+                        this.Warn($"unable to read {entry.Key} registry: {ex.Message}");
+                        continue;
+                    }
+
+                    foreach (var pkg in packages)
+                    {
+                        if (!string.IsNullOrEmpty(this.Search) && !await this.MatchesSearchAsync(registry, pkg, cancellationToken))
+                            continue;
+
+                        var result = JObject.FromObject(pkg);
+
+                        PrintPackage(pkg);
+                        if (this.AllRegistries)
+                        {
+                            Console.WriteLine($"Registry: {entry.Key} ({registry.RegistryRoot})");
+                            result["registry"] = entry.Key;
+                        }
+                        if (Log.Verbosity >= Verbosity.Verbose)
+                            result["cache"] = await PrintCachedHashesAsync(registry, pkg, cancellationToken);
+                        Console.WriteLine();
+                        results.Add(result);
+                        count++;
+                    }
                 }
             }
 
-            foreach (var pkg in packages)
+            Console.WriteLine($"{count} packages");
+
+            WriteResult(results);
+
+            return 0;
+        }
+
+        private Dictionary<string, Registry> GetAllRegistries()
+        {
+            var registries = new Dictionary<string, Registry>
             {
-                if (!string.IsNullOrEmpty(pkg.Group))
-                {
-                    Console.WriteLine($"{pkg.Group}:{pkg.Name} {pkg.Version}");
-                }
-                else
-                {
-                    Console.WriteLine($"{pkg.Name} {pkg.Version}");
-                }
-                if (!string.IsNullOrEmpty(pkg.FeedUrl))
-                {
-                    Console.WriteLine($"From {pkg.FeedUrl}");
-                }
-                if (!string.IsNullOrEmpty(pkg.InstallPath) || pkg.InstallationDate != null)
+                ["machine"] = Registry.GetRegistry(false),
+                ["user"] = Registry.GetRegistry(true),
+                ["project"] = Registry.GetProjectRegistry(Environment.CurrentDirectory)
+            };
+
+            if (!string.IsNullOrEmpty(this.RegistryPath))
+                registries["custom"] = new Registry(this.RegistryPath);
+
+            // only include registries that exist, and don't list the same one twice
+            var seen = new HashSet<string>(StringComparer.OrdinalIgnoreCase);
+            foreach (var name in registries.Keys.ToList())
+            {
+                var root = Path.GetFullPath(registries[name].RegistryRoot);
+                if (!Directory.Exists(root) || !seen.Add(root))
+                    registries.Remove(name);
+            }
+
+            return registries;
+        }
+
+        // Tags are not recorded in the registry, so they can only be searched for packages in the package cache.
+        private async Task<bool> MatchesSearchAsync(Registry registry, InstalledPackage pkg, CancellationToken cancellationToken)
+        {
+            if ((pkg.Group + "/" + pkg.Name).IndexOf(this.Search, StringComparison.OrdinalIgnoreCase) >= 0)
+                return true;
+
+            var version = UniversalPackageVersion.TryParse(pkg.Version);
+            if (version == null)
+                return false;
+
+            using (var stream = await registry.TryOpenFromCacheAsync(new UniversalPackageId(pkg.Group, pkg.Name), version, cancellationToken))
+            {
+                if (stream == null)
+                    return false;
+
+                using (var package = new UniversalPackage(stream, true))
                 {
-                    Console.WriteLine($"Installed to {(string.IsNullOrEmpty(pkg.InstallPath) ? "<unknown path>" : pkg.InstallPath)} on {(string.IsNullOrEmpty(pkg.InstallationDate) ? "<unknown date>" : pkg.InstallationDate)}");
+                    return package.GetFullMetadata().GetTags().Any(t => t.IndexOf(this.Search, StringComparison.OrdinalIgnoreCase) >= 0);
                 }
-                if (!string.IsNullOrEmpty(pkg.InstalledBy) || !string.IsNullOrEmpty(pkg.InstalledUsing))
+            }
+        }
+
+        private static void PrintPackage(InstalledPackage pkg)
+        {
+            if (!string.IsNullOrEmpty(pkg.Group))
+            {
+                Console.WriteLine($"{pkg.Group}:{pkg.Name} {pkg.Version}");
+            }
+            else
+            {
+                Console.WriteLine($"{pkg.Name} {pkg.Version}");
+            }
+            if (!string.IsNullOrEmpty(pkg.FeedUrl))
+            {
+                Console.WriteLine($"From {pkg.FeedUrl}");
+            }
+            if (!string.IsNullOrEmpty(pkg.InstallPath) || pkg.InstallationDate != null)
+            {
+                Console.WriteLine($"Installed to {(string.IsNullOrEmpty(pkg.InstallPath) ? "<unknown path>" : pkg.InstallPath)} on {(string.IsNullOrEmpty(pkg.InstallationDate) ? "<unknown date>" : pkg.InstallationDate)}");
+            }
+            if (!string.IsNullOrEmpty(pkg.InstalledBy) || !string.IsNullOrEmpty(pkg.InstalledUsing))
+            {
+                Console.WriteLine($"Installed by {(string.IsNullOrEmpty(pkg.InstalledBy) ? "<unknown user>" : pkg.InstalledBy)} using {(string.IsNullOrEmpty(pkg.InstalledUsing) ? "<unknown application>" : pkg.InstalledUsing)}");
+            }
+            if (!string.IsNullOrEmpty(pkg.InstallationReason))
+            {
+                Console.WriteLine($"Comment: {pkg.InstallationReason}");
+            }
+            if (!string.IsNullOrEmpty(pkg.SHA1) || pkg.Size.HasValue)
+            {
+                Console.WriteLine($"Package SHA1 {(string.IsNullOrEmpty(pkg.SHA1) ? "<unknown>" : pkg.SHA1)}, {(pkg.Size.HasValue ? pkg.Size + " bytes" : "<unknown size>")}");
+            }
+        }
+
+        // Returns the details that are displayed, or null if the package is not in the package cache.
+        private static async Task<JObject> PrintCachedHashesAsync(Registry registry, InstalledPackage pkg, CancellationToken cancellationToken)
+        {
+            var version = UniversalPackageVersion.TryParse(pkg.Version);
+            if (version == null)
+                return null;
+
+            using (var stream = await registry.TryOpenFromCacheAsync(new UniversalPackageId(pkg.Group, pkg.Name), version, cancellationToken))
+            {
+                if (stream == null)
                 {
-                    Console.WriteLine($"Installed by {(string.IsNullOrEmpty(pkg.InstalledBy) ? "<unknown user>" : pkg.InstalledBy)} using {(string.IsNullOrEmpty(pkg.InstalledUsing) ? "<unknown application>" : pkg.InstalledUsing)}");
+                    Console.WriteLine("Not in package cache");
+                    return null;
                 }
-                if (!string.IsNullOrEmpty(pkg.InstallationReason))
+
+                var details = new JObject();
+
+                details["sha1"] = GetHash(stream, "SHA1").ToString();
+                Console.WriteLine($"SHA1: {details["sha1"]}");
+                stream.Position = 0;
+                details["sha256"] = GetHash(stream, "SHA256").ToString();
+                Console.WriteLine($"SHA256: {details["sha256"]}");
+                stream.Position = 0;
+
+                // there is nothing to verify yet, but scripts can rely on the field being present
+                details["signature"] = "unsigned";
+                Console.WriteLine($"Signature: {details["signature"]}");
+
+                using (var package = new UniversalPackage(stream, true))
                 {
-                    Console.WriteLine($"Comment: {pkg.InstallationReason}");
+                    var info = package.GetFullMetadata();
+                    if (!string.IsNullOrEmpty(info.GetLicense()))
+                    {
+                        details["license"] = info.GetLicense();
+                        Console.WriteLine($"License: {info.GetLicense()}");
+                    }
+                    if (!string.IsNullOrEmpty(info.GetLicenseUrl()))
+                    {
+                        details["licenseUrl"] = info.GetLicenseUrl();
+                        Console.WriteLine($"License URL: {info.GetLicenseUrl()}");
+                    }
+                    if (info.GetTags().Count > 0)
+                    {
+                        details["tags"] = new JArray(info.GetTags());
+                        Console.WriteLine($"Tags: {string.Join(", ", info.GetTags())}");
+                    }
                 }
-                Console.WriteLine();
-            }
-
-            Console.WriteLine($"{packages.Count} packages");
 
-            return 0;
+                return details;
+            }
         }
     }
 }
@@ -0,0 +1,10 @@
+﻿namespace Inedo.UPack.CLI
+{
+    // A .upack file in the directory given by install --local-source.
+    internal sealed class LocalPackage
+    {
+        public UniversalPackageId Id { get; set; }
+        public UniversalPackageVersion Version { get; set; }
+        public string Path { get; set; }
+    }
+}
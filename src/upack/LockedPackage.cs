@@ -0,0 +1,32 @@
+﻿using System;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class LockedPackage
+    {
+        [JsonProperty("group")]
+        public string Group { get; set; }
+
+        [JsonProperty("name")]
+        public string Name { get; set; }
+
+        [JsonProperty("version")]
+        public string Version { get; set; }
+
+        [JsonProperty("sha1")]
+        public string SHA1 { get; set; }
+
+        [JsonProperty("source")]
+        public string Source { get; set; }
+
+        public bool IsFor(UniversalPackageId id)
+        {
+            return string.Equals(this.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                && string.Equals(this.Name, id.Name, StringComparison.OrdinalIgnoreCase);
+        }
+
+        public override string ToString() => (string.IsNullOrEmpty(this.Group) ? this.Name : this.Group + "/" + this.Name) + " " + this.Version;
+    }
+}
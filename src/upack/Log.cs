@@ -0,0 +1,159 @@
+﻿using System;
+using System.Diagnostics;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Text;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    internal enum Verbosity
+    {
+        Quiet,
+        Normal,
+        Verbose,
+        Debug
+    }
+
+    // Messages about what a command is doing, as opposed to its result, which commands write to Console.Out directly.
+    // With --quiet only errors are displayed; --verbose adds each extracted file and requested URL, and --debug adds headers.
+    // With --log-file, significant actions are also appended to a file as JSON lines, whatever the verbosity. Errors, warnings,
+    // and successes are colored when written to a console, unless --no-color or the NO_COLOR environment variable is set.
+    internal static class Log
+    {
+        private static readonly string[] SecretHeaderParts = { "auth", "cookie", "key", "token", "secret", "password" };
+        private static readonly object FileLock = new object();
+        private static StreamWriter file;
+
+        public static Verbosity Verbosity { get; set; } = Verbosity.Normal;
+        public static bool UseColor { get; set; } = true;
+        // Set while progress rows are drawn on the console, to remove them before a message is written where they were.
+        public static Action BeforeConsoleWrite { get; set; }
+
+        public static void Info(string message)
+        {
+            if (Verbosity >= Verbosity.Normal)
+            {
+                BeforeConsoleWrite?.Invoke();
+                Console.WriteLine(message);
+            }
+        }
+
+        public static void Success(string message)
+        {
+            if (Verbosity >= Verbosity.Normal)
+                WriteLine(Console.Out, Console.IsOutputRedirected, ConsoleColor.Green, message);
+        }
+
+        public static void Warning(string message)
+        {
+            Event("warning", new JObject { ["message"] = message });
+            if (Verbosity >= Verbosity.Normal)
+                WriteLine(Console.Error, Console.IsErrorRedirected, ConsoleColor.Yellow, message);
+        }
+
+        // Errors are displayed even with --quiet.
+        public static void Error(string message)
+        {
+            WriteLine(Console.Error, Console.IsErrorRedirected, ConsoleColor.Red, message);
+        }
+
+        public static void Verbose(string message)
+        {
+            if (Verbosity >= Verbosity.Verbose)
+            {
+                BeforeConsoleWrite?.Invoke();
+                Console.WriteLine(message);
+            }
+        }
+
+        public static void Debug(string message)
+        {
+            if (Verbosity >= Verbosity.Debug)
+            {
+                BeforeConsoleWrite?.Invoke();
+                Console.Error.WriteLine(message);
+            }
+        }
+
+        // Headers that may carry credentials, such as Authorization, Cookie, or X-ApiKey, are written without their values.
+        public static void DebugHeaders(string prefix, WebHeaderCollection headers)
+        {
+            if (Verbosity < Verbosity.Debug || headers == null)
+                return;
+
+            foreach (var name in headers.AllKeys)
+            {
+                bool secret = SecretHeaderParts.Any(p => name.IndexOf(p, StringComparison.OrdinalIgnoreCase) >= 0);
+                Console.Error.WriteLine($"{prefix} {name}: {(secret ? "(redacted)" : headers[name])}");
+            }
+        }
+
+        private static void WriteLine(TextWriter writer, bool redirected, ConsoleColor color, string message)
+        {
+            BeforeConsoleWrite?.Invoke();
+            if (!UseColor || redirected)
+            {
+                writer.WriteLine(message);
+                return;
+            }
+
+            // the color is reset before the line ends, so that it does not bleed into the next line if the console scrolls
+            Console.ForegroundColor = color;
+            try
+            {
+                writer.Write(message);
+            }
+            finally
+            {
+                Console.ResetColor();
+            }
+
+            writer.WriteLine();
+        }
+
+        // The file is shared, so that several upack processes on an agent can append to the same log.
+        public static void OpenFile(string path)
+        {
+            var fullPath = Path.GetFullPath(path);
+            Directory.CreateDirectory(Path.GetDirectoryName(fullPath));
+            file = new StreamWriter(new FileStream(fullPath, FileMode.Append, FileAccess.Write, FileShare.ReadWrite | FileShare.Delete), new UTF8Encoding(false)) { AutoFlush = true };
+        }
+
+        public static void CloseFile()
+        {
+            lock (FileLock)
+            {
+                file?.Dispose();
+                file = null;
+            }
+        }
+
+        // Writes a line such as {"time":"...","pid":1234,"event":"download-start","package":"group/name",...} to the log file.
+        public static void Event(string name, JObject details = null)
+        {
+            if (file == null)
+                return;
+
+            var entry = new JObject
+            {
+                ["time"] = DateTimeOffset.UtcNow.ToString("o"),
+                ["pid"] = Process.GetCurrentProcess().Id,
+                ["event"] = name
+            };
+
+            if (details != null)
+            {
+                foreach (var property in details.Properties())
+                    entry[property.Name] = property.Value;
+            }
+
+            lock (FileLock)
+            {
+                file?.WriteLine(entry.ToString(Formatting.None));
+            }
+        }
+    }
+}
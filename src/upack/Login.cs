@@ -0,0 +1,44 @@
+﻿using System;
+using System.ComponentModel;
+using System.Net;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("login")]
+    [Description("Stores credentials for a upack feed in the credential store of the operating system, so that commands that use the feed, or any feed under the URL, no longer need --user or --api-key.")]
+    public sealed class Login : Command
+    {
+        [DisplayName("source")]
+        [Description("URL of a upack API endpoint, or of a server to use the credentials for every feed on it.")]
+        [PositionalArgument(0)]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("user")]
+        [Description("User name and password to store. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("API key to store, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            if (this.Authentication != null && !string.IsNullOrEmpty(this.ApiKey))
+                throw new UpackException(ExitCode.InvalidArguments, "--user and --api-key cannot both be specified.");
+
+            var credentials = !string.IsNullOrEmpty(this.ApiKey) ? new NetworkCredential("api", this.ApiKey) : this.Authentication;
+            if (credentials == null)
+                throw new UpackException(ExitCode.InvalidArguments, "--user or --api-key is required.");
+
+            CredentialStore.Save(this.SourceUrl, credentials);
+            Log.Success($"Credentials for {credentials.UserName} stored for {CredentialStore.GetKey(this.SourceUrl)} in {CredentialStore.Name}.");
+            return Task.FromResult(0);
+        }
+    }
+}
@@ -0,0 +1,30 @@
+﻿using System;
+using System.ComponentModel;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("logout")]
+    [Description("Removes the credentials stored by login for a upack feed from the credential store of the operating system.")]
+    public sealed class Logout : Command
+    {
+        [DisplayName("source")]
+        [Description("URL that was specified for login.")]
+        [PositionalArgument(0)]
+        public string SourceUrl { get; set; }
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var key = CredentialStore.GetKey(this.SourceUrl);
+            if (!CredentialStore.Delete(this.SourceUrl))
+            {
+                Log.Info($"No credentials are stored for {key}.");
+                return Task.FromResult(0);
+            }
+
+            Log.Success($"Removed the credentials for {key} from {CredentialStore.Name}.");
+            return Task.FromResult(0);
+        }
+    }
+}
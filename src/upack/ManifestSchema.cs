@@ -0,0 +1,162 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Text;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // Checks a manifest against the JSON schema embedded as upack.schema.json. Only the parts of JSON Schema that the embedded
+    // schema uses are interpreted: type, items, properties, required, and maxLength.
+    internal static class ManifestSchema
+    {
+        private static readonly Lazy<JObject> Schema = new Lazy<JObject>(Load);
+
+        public static List<string> Check(UniversalPackageMetadata info)
+        {
+            var manifest = new JObject();
+            foreach (var item in info)
+                manifest[item.Key] = item.Value == null ? JValue.CreateNull() : JToken.FromObject(item.Value);
+
+            return Check(manifest);
+        }
+
+        // Returns a description of each problem, in the order of the properties of the manifest.
+        public static List<string> Check(JObject manifest)
+        {
+            var problems = new List<string>();
+            var properties = (JObject)Schema.Value["properties"];
+
+            foreach (var required in Schema.Value["required"].Values<string>())
+            {
+                if (manifest[required] == null)
+                    problems.Add($"{required} is required.");
+            }
+
+            foreach (var property in manifest.Properties())
+            {
+                if (properties[property.Name] is JObject propertySchema)
+                {
+                    CheckValue(property.Value, propertySchema, property.Name, problems);
+                }
+                else
+                {
+                    var similar = FindSimilarName(property.Name, properties.Properties().Select(p => p.Name));
+                    if (similar != null)
+                        problems.Add($"{property.Name} is not a known property; did you mean {similar}?");
+                }
+            }
+
+            return problems;
+        }
+
+        private static void CheckValue(JToken value, JObject schema, string path, List<string> problems)
+        {
+            if (value.Type == JTokenType.Null)
+            {
+                problems.Add($"{path} must not be null.");
+                return;
+            }
+
+            var types = schema["type"] is JArray array ? array.Values<string>().ToList() : new List<string> { (string)schema["type"] };
+            var actual = GetSchemaType(value);
+            if (types.Count > 0 && types[0] != null && !types.Contains(actual))
+            {
+                problems.Add($"{path} must be {string.Join(" or ", types.Select(t => (t == "array" || t == "object" ? "an " : "a ") + t))}, but is {(actual == "array" || actual == "object" ? "an " : "a ")}{actual}.");
+                return;
+            }
+
+            if (value.Type == JTokenType.String && schema["maxLength"] != null && ((string)value).Length > (int)schema["maxLength"])
+                problems.Add($"{path} must be at most {(int)schema["maxLength"]} characters long.");
+
+            if (value is JArray items && schema["items"] is JObject itemSchema)
+            {
+                for (int i = 0; i < items.Count; i++)
+                    CheckValue(items[i], itemSchema, $"{path}[{i}]", problems);
+            }
+
+            if (value is JObject obj && schema["properties"] is JObject propertySchemas)
+            {
+                foreach (var property in obj.Properties())
+                {
+                    if (propertySchemas[property.Name] is JObject propertySchema)
+                        CheckValue(property.Value, propertySchema, $"{path}.{property.Name}", problems);
+                }
+            }
+        }
+
+        private static string GetSchemaType(JToken value)
+        {
+            switch (value.Type)
+            {
+                case JTokenType.Object:
+                    return "object";
+                case JTokenType.Array:
+                    return "array";
+                case JTokenType.Integer:
+                case JTokenType.Float:
+                    return "number";
+                case JTokenType.Boolean:
+                    return "boolean";
+                default:
+                    return "string";
+            }
+        }
+
+        // An unknown property is suspicious when it differs from a known one only in casing or by a typo or two,
+        // such as Version or dependancies; other unknown properties are allowed as custom metadata.
+        private static string FindSimilarName(string name, IEnumerable<string> knownNames)
+        {
+            foreach (var known in knownNames)
+            {
+                if (string.Equals(name, known, StringComparison.OrdinalIgnoreCase))
+                    return known;
+            }
+
+            if (name.Length < 4)
+                return null;
+
+            return knownNames
+                .Select(k => new { Name = k, Distance = GetEditDistance(name.ToLowerInvariant(), k.ToLowerInvariant()) })
+                .Where(k => k.Distance <= (name.Length < 7 ? 1 : 2))
+                .OrderBy(k => k.Distance)
+                .Select(k => k.Name)
+                .FirstOrDefault();
+        }
+
+        private static int GetEditDistance(string a, string b)
+        {
+            var previous = new int[b.Length + 1];
+            var current = new int[b.Length + 1];
+            for (int j = 0; j <= b.Length; j++)
+                previous[j] = j;
+
+            for (int i = 1; i <= a.Length; i++)
+            {
+                current[0] = i;
+                for (int j = 1; j <= b.Length; j++)
+                {
+                    int substitution = previous[j - 1] + (a[i - 1] == b[j - 1] ? 0 : 1);
+                    current[j] = Math.Min(substitution, Math.Min(previous[j] + 1, current[j - 1] + 1));
+                }
+
+                var swap = previous;
+                previous = current;
+                current = swap;
+            }
+
+            return previous[b.Length];
+        }
+
+        private static JObject Load()
+        {
+            using (var stream = typeof(ManifestSchema).Assembly.GetManifestResourceStream("upack.schema.json"))
+            using (var reader = new JsonTextReader(new StreamReader(stream, Encoding.UTF8)))
+            {
+                return JObject.Load(reader);
+            }
+        }
+    }
+}
@@ -1,49 +1,121 @@
-using System;
+﻿using System;
 using System.ComponentModel;
 using System.IO;
+using System.Linq;
 using System.Net;
 using System.Text;
 using System.Threading;
 using System.Threading.Tasks;
+using Inedo.UPack.Net;
+using Inedo.UPack.Packaging;
 using Newtonsoft.Json;
 using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("metadata")]
-    [Description("Displays metadata for a remote universal package.")]
-    public sealed class Metadata : Command
+    [Description("Displays metadata for a remote universal package, a local .upack file, or an installed package.")]
+    public sealed class Metadata : FeedCommand
     {
         [DisplayName("package")]
-        [Description("Package name and group, such as group/name.")]
+        [Description("Package name and group, such as group/name, or the path of a local .upack file.")]
         [PositionalArgument(0)]
         public string PackageName { get; set; }
 
         [DisplayName("version")]
-        [Description("Package version. If not specified, the latest version is retrieved.")]
+        [Description("Package version, a version range, or latest, latest-stable, or latest-prerelease. If not specified, the latest version is retrieved.")]
         [PositionalArgument(1, Optional = true)]
         public string Version { get; set; }
 
         [DisplayName("source")]
-        [Description("URL of a upack API endpoint.")]
-        [ExtraArgument(Optional = false)]
+        [Description("URL of a upack API endpoint. Required unless package is a local file or --installed is specified.")]
+        [ExtraArgument]
         [UseEnvironmentVariableAsDefault("UPACK_FEED")]
         public string SourceUrl { get; set; }
 
         [DisplayName("user")]
-        [Description("User name and password to use for servers that require authentication. Example: \"username:password\" or \"api:api-key\"")]
+        [Description("User name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
         [ExtraArgument]
         [UseEnvironmentVariableAsDefault("UPACK_USER")]
         public NetworkCredential Authentication { get; set; }
 
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
         [DisplayName("file")]
         [Description("The metadata file to display relative to the .upack root; the default is upack.json.")]
         [ExtraArgument]
         public string FilePath { get; set; }
 
+        [DisplayName("show-readme")]
+        [Description("After the metadata, display the README file included in the package contents, if there is one.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ShowReadme { get; set; } = false;
+
+        [DisplayName("installed")]
+        [Description("Display the package as registered in the local registry instead of querying a feed.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Installed { get; set; } = false;
+
+        [DisplayName("userregistry")]
+        [Description("With --installed, read the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("With --installed, read the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("With --installed, directory of the local registry to read instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("infer-group")]
+        [Description("When the package name does not include a group, use the group that follows the feed name in the source URL, such as https://proget/upack/Feed/«group».")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_INFER_GROUP")]
+        public bool InferGroup { get; set; } = false;
+
+        [DisplayName("legacy-versions")]
+        [Description("Accept four-part versions such as 1.2.3.4, treating the fourth part as build metadata (1.2.3+4).")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_LEGACY_VERSIONS")]
+        public bool LegacyVersions { get; set; } = false;
+
+        protected override bool AllowLegacyVersions => this.LegacyVersions;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
-            var client = CreateClient(this.SourceUrl, this.Authentication);
+            if (JsonOutput && this.ShowReadme)
+                throw new UpackException(ExitCode.InvalidArguments, "--show-readme cannot be used with --json.");
+
+            if (this.Installed)
+                return await this.ShowInstalledAsync(cancellationToken);
+
+            var localPath = Path.Combine(Environment.CurrentDirectory, this.PackageName ?? string.Empty);
+            if (this.PackageName != null && (this.PackageName.EndsWith(".upack", StringComparison.OrdinalIgnoreCase) || File.Exists(localPath)))
+                return this.ShowLocal(Path.GetFullPath(localPath));
+
+            if (string.IsNullOrEmpty(this.SourceUrl))
+                throw new UpackException(ExitCode.InvalidArguments, "--source is required unless package is a local file or --installed is specified.");
+
+            var sourceUrl = this.SourceUrl;
+            var inferredGroup = this.InferGroup ? InferGroupFromSource(ref sourceUrl) : null;
+
+            var client = CreateClient(sourceUrl, this.Authentication, this.ApiKey);
 
             UniversalPackageId packageId;
             try
@@ -52,21 +124,23 @@ namespace Inedo.UPack.CLI
             }
             catch (ArgumentException ex)
             {
-                throw new UpackException("Invalid package ID: " + ex.Message, ex);
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
             }
 
+            if (string.IsNullOrEmpty(packageId.Group) && !string.IsNullOrEmpty(inferredGroup))
+                packageId = new UniversalPackageId(inferredGroup, packageId.Name);
+
             UniversalPackageVersion version = null;
             if (!string.IsNullOrEmpty(this.Version))
             {
-                version = UniversalPackageVersion.TryParse(this.Version);
-                if (version == null)
-                    throw new UpackException($"Invalid UPack version number: {this.Version}");
+                // keywords such as latest-stable and version ranges are resolved against the feed
+                version = this.ParseVersion(this.Version) ?? await this.GetVersionAsync(client, packageId, this.Version, false, false, cancellationToken);
             }
 
             JObject data;
             try
             {
-                using (var stream = await client.GetPackageFileStreamAsync(packageId, version, string.IsNullOrEmpty(this.FilePath) ? "upack.json" : this.FilePath, cancellationToken))
+                using (var stream = await FeedHttp.SendAsync(() => client.GetPackageFileStreamAsync(packageId, version, string.IsNullOrEmpty(this.FilePath) ? "upack.json" : this.FilePath, cancellationToken), cancellationToken))
                 using (var reader = new StreamReader(stream, Encoding.UTF8, true, 4096, true))
                 using (var jsonReader = new JsonTextReader(reader) { CloseInput = false })
                 {
@@ -90,15 +164,225 @@ namespace Inedo.UPack.CLI
                     error += r.StatusDescription;
                 }
 
-                throw new UpackException(error, ex);
+                throw new UpackException(GetExitCode(ex), error, ex);
             }
 
-            foreach (var p in data.Properties())
+            if (JsonOutput)
+            {
+                WriteResult(data);
+                return 0;
+            }
+
+            PrintProperties(data);
+
+            if (string.IsNullOrEmpty(this.FilePath))
+                await PrintChecksumsAsync(client, packageId, version, cancellationToken);
+
+            if (this.ShowReadme)
             {
-                Console.WriteLine($"{p.Name} = {p.Value}");
+                version = version ?? await this.GetVersionAsync(client, packageId, null, false, false, cancellationToken);
+                var readme = await Readme.ReadFromFeedAsync(client, packageId, version, cancellationToken);
+                Console.WriteLine();
+                Console.WriteLine(readme?.TrimEnd() ?? $"{packageId} {version} does not include a README.");
             }
 
             return 0;
         }
+
+        private int ShowLocal(string path)
+        {
+            if (!File.Exists(path))
+                throw new UpackException(ExitCode.NotFound, $"The package file '{path}' does not exist.")
+                {
+                    Code = ErrorCodes.FileNotFound
+                };
+
+            JObject data;
+            string readme = null;
+            try
+            {
+                using (var package = new UniversalPackage(path))
+                {
+                    data = ReadFile(package, path);
+                    if (this.ShowReadme)
+                        readme = Readme.ReadFromPackage(package, DefaultContentRoot);
+                }
+            }
+            catch (Exception ex) when (ex is InvalidDataException || ex is IOException || ex is JsonException)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                {
+                    Code = ErrorCodes.InvalidPackage,
+                    Location = path
+                };
+            }
+
+            if (JsonOutput)
+            {
+                WriteResult(data);
+                return 0;
+            }
+
+            PrintProperties(data);
+
+            if (string.IsNullOrEmpty(this.FilePath))
+            {
+                Console.WriteLine();
+                Console.WriteLine($"SHA1: {GetSHA1(path)}");
+                using (var file = File.OpenRead(path))
+                {
+                    Console.WriteLine($"SHA256: {GetHash(file, "SHA256")}");
+                }
+
+                // universal packages have no signature format, so every package is reported as unsigned
+                Console.WriteLine("Signature: unsigned");
+            }
+
+            if (this.ShowReadme)
+            {
+                Console.WriteLine();
+                Console.WriteLine(readme?.TrimEnd() ?? $"{path} does not include a README.");
+            }
+
+            return 0;
+        }
+
+        // Registry entries do not include the manifest, so it is only displayed when the package is in the package cache.
+        private async Task<int> ShowInstalledAsync(CancellationToken cancellationToken)
+        {
+            UniversalPackageId packageId;
+            try
+            {
+                packageId = UniversalPackageId.Parse(this.PackageName);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+            {
+                var matches = (await registry.GetInstalledPackagesAsync())
+                    .Where(p => string.Equals(p.Group ?? string.Empty, packageId.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                        && string.Equals(p.Name, packageId.Name, StringComparison.OrdinalIgnoreCase)
+                        && (string.IsNullOrEmpty(this.Version) || string.Equals(p.Version, this.Version, StringComparison.OrdinalIgnoreCase)))
+                    .ToList();
+
+                if (matches.Count == 0)
+                    throw new UpackException(ExitCode.NotFound, $"{packageId}{(string.IsNullOrEmpty(this.Version) ? string.Empty : " " + this.Version)} is not registered in {registry.RegistryRoot}.")
+                    {
+                        Code = ErrorCodes.NotInstalled
+                    };
+
+                var entries = new JArray();
+
+                for (int i = 0; i < matches.Count; i++)
+                {
+                    var installed = matches[i];
+                    var registered = JObject.FromObject(installed);
+
+                    var version = UniversalPackageVersion.TryParse(installed.Version);
+                    var cached = version != null ? await registry.TryOpenFromCacheAsync(packageId, version, cancellationToken) : null;
+
+                    if (JsonOutput)
+                    {
+                        if (cached != null)
+                        {
+                            using (var package = new UniversalPackage(cached))
+                            {
+                                registered["manifest"] = ReadFile(package, registry.GetCachedPackagePath(packageId, version));
+                            }
+                        }
+
+                        entries.Add(registered);
+                        continue;
+                    }
+
+                    if (i > 0)
+                        Console.WriteLine();
+
+                    if (cached != null)
+                    {
+                        string readme = null;
+                        using (var package = new UniversalPackage(cached))
+                        {
+                            PrintProperties(ReadFile(package, registry.GetCachedPackagePath(packageId, version)));
+                            if (this.ShowReadme)
+                                readme = Readme.ReadFromPackage(package, DefaultContentRoot);
+                        }
+
+                        foreach (var name in new[] { "group", "name", "version" })
+                            registered.Remove(name);
+
+                        PrintProperties(registered);
+
+                        if (this.ShowReadme)
+                        {
+                            Console.WriteLine();
+                            Console.WriteLine(readme?.TrimEnd() ?? $"{packageId} {version} does not include a README.");
+                        }
+                    }
+                    else
+                    {
+                        PrintProperties(registered);
+                    }
+                }
+
+                if (JsonOutput)
+                    WriteResult(entries);
+            }
+
+            return 0;
+        }
+
+        private JObject ReadFile(UniversalPackage package, string path)
+        {
+            var fileName = string.IsNullOrEmpty(this.FilePath) ? "upack.json" : this.FilePath.Replace('\\', '/').TrimStart('/');
+            var entry = package.Entries.FirstOrDefault(e => string.Equals(e.RawPath.Replace('\\', '/'), fileName, StringComparison.OrdinalIgnoreCase));
+            if (entry == null)
+                throw new UpackException(ExitCode.NotFound, $"{fileName} was not found in {path}.");
+
+            using (var stream = entry.Open())
+            using (var reader = new StreamReader(stream, Encoding.UTF8, true))
+            using (var jsonReader = new JsonTextReader(reader))
+            {
+                return JObject.Load(jsonReader);
+            }
+        }
+
+        private static void PrintProperties(JObject data)
+        {
+            foreach (var p in data.Properties())
+            {
+                // tags are a list of keywords, so they read better on one line than as a JSON array
+                if (p.Name == "tags" && p.Value is JArray tags && tags.All(t => t.Type == JTokenType.String))
+                    Console.WriteLine($"{p.Name} = {string.Join(", ", tags.Select(t => (string)t))}");
+                else
+                    Console.WriteLine($"{p.Name} = {p.Value}");
+            }
+        }
+
+        private async Task PrintChecksumsAsync(UniversalFeedClient client, UniversalPackageId packageId, UniversalPackageVersion version, CancellationToken cancellationToken)
+        {
+            RemoteUniversalPackageVersion remoteVersion;
+            try
+            {
+                version = version ?? await GetVersionAsync(client, packageId, null, false, false, cancellationToken);
+                remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(packageId, version, false, cancellationToken), cancellationToken);
+            }
+            catch (WebException ex)
+            {
+                throw ConvertWebException(ex, PackageNotFoundMessage);
+            }
+
+            if (remoteVersion == null)
+                return;
+
+            Console.WriteLine();
+            Console.WriteLine($"SHA1: {remoteVersion.SHA1}");
+            if (remoteVersion.AllProperties != null && remoteVersion.AllProperties.TryGetValue("sha256", out var sha256) && sha256 != null)
+                Console.WriteLine($"SHA256: {sha256}");
+            Console.WriteLine("Signature: unsigned");
+        }
     }
 }
@@ -0,0 +1,258 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Net;
+using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("metadata diff")]
+    [Description("Compares the upack.json of two packages and reports properties and dependencies that were added, removed, or changed.")]
+    public sealed class MetadataDiff : FeedCommand
+    {
+        private static readonly string[] AuditProperties = { "createdDate", "createdReason", "createdUsing", "createdBy", "repackageHistory" };
+
+        private UniversalFeedClient client;
+
+        [DisplayName("before")]
+        [Description("Path of the earlier .upack file, or a package on the feed specified as group/name:version.")]
+        [PositionalArgument(0)]
+        public string Before { get; set; }
+
+        [DisplayName("after")]
+        [Description("Path of the later .upack file, or a package on the feed specified as group/name:version.")]
+        [PositionalArgument(1)]
+        public string After { get; set; }
+
+        [DisplayName("source")]
+        [Description("URL of a upack API endpoint. Required when either package is on a feed.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_FEED")]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("user")]
+        [Description("User name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("ignore-audit")]
+        [Description("Do not compare the audit properties written by pack and repack, such as createdDate and repackageHistory.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IgnoreAudit { get; set; } = false;
+
+        [DisplayName("exit-code")]
+        [Description("Exit with code 1 if there are any differences.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ExitCode { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            if (string.IsNullOrEmpty(this.SourceUrl) && (!IsLocal(this.Before) || !IsLocal(this.After)))
+                throw new UpackException(ExitCode.InvalidArguments, "--source is required when a package is specified as group/name:version.");
+
+            var before = await this.ReadManifestAsync(this.Before, cancellationToken);
+            var after = await this.ReadManifestAsync(this.After, cancellationToken);
+
+            if (this.IgnoreAudit)
+            {
+                foreach (var name in AuditProperties)
+                {
+                    before.Remove(name);
+                    after.Remove(name);
+                }
+            }
+
+            int added = 0;
+            int removed = 0;
+            int changed = 0;
+
+            var names = before.Properties().Select(p => p.Name).Concat(after.Properties().Select(p => p.Name)).Distinct();
+            foreach (var name in names)
+            {
+                var oldValue = before[name];
+                var newValue = after[name];
+
+                if (oldValue == null)
+                {
+                    Console.WriteLine($"+ {name} = {Format(newValue)}");
+                    added++;
+                }
+                else if (newValue == null)
+                {
+                    Console.WriteLine($"- {name} = {Format(oldValue)}");
+                    removed++;
+                }
+                else if (!JToken.DeepEquals(oldValue, newValue))
+                {
+                    if (name == "dependencies" && oldValue is JArray oldDependencies && newValue is JArray newDependencies)
+                    {
+                        CompareDependencies(oldDependencies, newDependencies, ref added, ref removed, ref changed);
+                    }
+                    else
+                    {
+                        Console.WriteLine($"~ {name}: {Format(oldValue)} -> {Format(newValue)}");
+                        changed++;
+                    }
+                }
+            }
+
+            int differences = added + removed + changed;
+            if (differences == 0)
+                Console.WriteLine("No differences.");
+            else
+                Console.WriteLine($"{added} added, {removed} removed, {changed} changed.");
+
+            return this.ExitCode && differences > 0 ? 1 : 0;
+        }
+
+        // Dependencies are matched by package ID, so that a new version of a dependency is reported as a change rather than
+        // as one dependency removed and another added.
+        private static void CompareDependencies(JArray before, JArray after, ref int added, ref int removed, ref int changed)
+        {
+            var oldDependencies = GetDependencies(before);
+            var newDependencies = GetDependencies(after);
+
+            foreach (var dependency in oldDependencies)
+            {
+                if (!newDependencies.TryGetValue(dependency.Key, out var newConstraint))
+                {
+                    Console.WriteLine($"- dependency {dependency.Key}{FormatConstraint(dependency.Value)}");
+                    removed++;
+                }
+                else if (!string.Equals(dependency.Value, newConstraint, StringComparison.OrdinalIgnoreCase))
+                {
+                    Console.WriteLine($"~ dependency {dependency.Key}: {dependency.Value ?? "any version"} -> {newConstraint ?? "any version"}");
+                    changed++;
+                }
+            }
+
+            foreach (var dependency in newDependencies)
+            {
+                if (!oldDependencies.ContainsKey(dependency.Key))
+                {
+                    Console.WriteLine($"+ dependency {dependency.Key}{FormatConstraint(dependency.Value)}");
+                    added++;
+                }
+            }
+        }
+
+        private static Dictionary<string, string> GetDependencies(JArray dependencies)
+        {
+            var result = new Dictionary<string, string>(StringComparer.OrdinalIgnoreCase);
+            foreach (var token in dependencies)
+            {
+                var text = token.Type == JTokenType.String ? (string)token : token.ToString(Formatting.None);
+                ParseDependency(text, out var id, out var constraint);
+                if (id != null)
+                    result[id.ToString()] = string.IsNullOrEmpty(constraint) ? null : constraint;
+                else
+                    result[text] = null;
+            }
+
+            return result;
+        }
+
+        private async Task<JObject> ReadManifestAsync(string package, CancellationToken cancellationToken)
+        {
+            string text;
+            if (IsLocal(package))
+            {
+                var path = Path.GetFullPath(Path.Combine(Environment.CurrentDirectory, package));
+                if (!File.Exists(path))
+                    throw new UpackException(ExitCode.NotFound, $"The package file '{path}' does not exist.")
+                    {
+                        Code = ErrorCodes.FileNotFound
+                    };
+
+                try
+                {
+                    using (var localPackage = new UniversalPackage(path))
+                    {
+                        text = await ReadManifestTextAsync(localPackage);
+                    }
+                }
+                catch (Exception ex) when (ex is InvalidDataException || ex is IOException)
+                {
+                    throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                    {
+                        Code = ErrorCodes.InvalidPackage,
+                        Location = path
+                    };
+                }
+
+                if (text == null)
+                    throw new UpackException(ExitCode.NotFound, $"upack.json was not found in {path}.");
+            }
+            else
+            {
+                int colon = package.LastIndexOf(':');
+                if (colon <= 0 || colon == package.Length - 1)
+                    throw new UpackException($"{package} is not a .upack file or a package specified as group/name:version.");
+
+                UniversalPackageId packageId;
+                try
+                {
+                    packageId = UniversalPackageId.Parse(package.Substring(0, colon));
+                }
+                catch (ArgumentException ex)
+                {
+                    throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+                }
+
+                this.client = this.client ?? CreateClient(this.SourceUrl, this.Authentication, this.ApiKey);
+                var version = await this.GetVersionAsync(this.client, packageId, package.Substring(colon + 1), false, false, cancellationToken);
+
+                try
+                {
+                    using (var stream = await FeedHttp.SendAsync(() => this.client.GetPackageFileStreamAsync(packageId, version, "upack.json", cancellationToken), cancellationToken))
+                    using (var reader = new StreamReader(stream, Encoding.UTF8, true))
+                    {
+                        text = await reader.ReadToEndAsync();
+                    }
+                }
+                catch (WebException ex)
+                {
+                    throw ConvertWebException(ex, PackageNotFoundMessage);
+                }
+            }
+
+            try
+            {
+                using (var reader = new JsonTextReader(new StringReader(text)) { DateParseHandling = DateParseHandling.None })
+                {
+                    return JObject.Load(reader);
+                }
+            }
+            catch (JsonException ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, $"The upack.json of {package} is not valid JSON: {ex.Message}", ex)
+                {
+                    Code = ErrorCodes.InvalidManifest
+                };
+            }
+        }
+
+        private static bool IsLocal(string package) => package.EndsWith(".upack", StringComparison.OrdinalIgnoreCase) || File.Exists(Path.Combine(Environment.CurrentDirectory, package));
+
+        private static string Format(JToken value) => value.Type == JTokenType.String ? (string)value : value.ToString(Formatting.None);
+
+        private static string FormatConstraint(string constraint) => string.IsNullOrEmpty(constraint) ? string.Empty : " " + constraint;
+    }
+}
@@ -1,15 +1,24 @@
 ﻿using System;
+using System.Collections.Generic;
 using System.ComponentModel;
 using System.IO;
+using System.IO.Compression;
+using System.Linq;
+using System.Net;
+using System.Text;
+using System.Text.RegularExpressions;
 using System.Threading;
 using System.Threading.Tasks;
+using Inedo.UPack.Net;
 using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("pack")]
     [Description("Creates a new universal package using specified metadata and source directory.")]
-    public sealed class Pack : Command
+    public sealed class Pack : FeedCommand
     {
         [DisplayName("manifest")]
         [AlternateName("metadata")]
@@ -18,6 +27,11 @@ namespace Inedo.UPack.CLI
         [ExpandPath]
         public string Manifest { get; set; }
 
+        [DisplayName("var")]
+        [Description("Value of a ${«name»} placeholder in the manifest file, in the format «name»=«value». May be specified more than once; other placeholders are read from environment variables.")]
+        [ExtraArgument]
+        public string[] Variables { get; set; }
+
         [DisplayName("source")]
         [Description("File or directory containing files to add to the package.")]
         [PositionalArgument(0)]
@@ -60,6 +74,27 @@ namespace Inedo.UPack.CLI
         [ExtraArgument]
         public string IconUrl { get; set; }
 
+        [DisplayName("license")]
+        [Description("SPDX license expression, such as MIT or Apache-2.0 OR MIT. If metadata file is provided, value will be ignored.")]
+        [ExtraArgument]
+        public string License { get; set; }
+
+        [DisplayName("license-url")]
+        [Description("Absolute URL of the license text. If metadata file is provided, value will be ignored.")]
+        [ExtraArgument]
+        public string LicenseUrl { get; set; }
+
+        [DisplayName("readme")]
+        [Description("Path of a README file to embed at the archive root, where the readme and metadata --show-readme commands display it without extracting the package.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string ReadmePath { get; set; }
+
+        [DisplayName("tag")]
+        [Description("Tag used to categorize the package. May be specified more than once. If metadata file is provided, value will be ignored.")]
+        [ExtraArgument]
+        public string[] Tags { get; set; }
+
         [DisplayName("no-audit")]
         [Description("Do not store audit information in the UPack manifest.")]
         [ExtraArgument]
@@ -70,18 +105,121 @@ namespace Inedo.UPack.CLI
         [ExtraArgument]
         public string Note { get; set; }
 
+        [DisplayName("root")]
+        [Description("Directory inside the archive where the contents will be stored; the default is package/, which is required by the universal package format.")]
+        [ExtraArgument]
+        public string ContentRoot { get; set; }
+
+        [DisplayName("analyze")]
+        [Description("After creating the package, report entries that compress poorly and files with duplicate contents.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Analyze { get; set; } = false;
+
+        [DisplayName("reproducible")]
+        [Description("Use a fixed date for the audit information and every file in the package, so that packing the same contents always produces an identical file. The date is read from the SOURCE_DATE_EPOCH environment variable, or is 2000-01-01 if it is not set.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Reproducible { get; set; } = false;
+
+        [DisplayName("detect-deps")]
+        [Description("Add a dependency on each package registered in the local registry with an install path in this directory or below it. Separate multiple directories with the path separator character.")]
+        [ExtraArgument]
+        public string DetectDependencies { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("With --detect-deps, read the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("With --detect-deps, read the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("With --detect-deps, directory of the local registry to read instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("check-remote")]
+        [Description("Before creating the package, warn if the feed specified by --source already has this version or uses different casing for the group or name.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool CheckRemote { get; set; } = false;
+
+        [DisplayName("source")]
+        [Description("With --check-remote, URL of a upack API endpoint.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_FEED")]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("user")]
+        [Description("With --check-remote, user name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("With --check-remote, API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("strict")]
+        [Description("Also check the types of all known upack.json properties against the embedded JSON schema, and reject unknown properties with names similar to known ones.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Strict { get; set; } = false;
+
+        [DisplayName("warnings-as-errors")]
+        [Description("Fail instead of displaying a warning.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_WARNINGS_AS_ERRORS")]
+        public bool WarningsAsErrors { get; set; } = false;
+
+        protected override bool TreatWarningsAsErrors => this.WarningsAsErrors;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
             if (this.NoAudit && !string.IsNullOrEmpty(this.Note))
+                throw new UpackException(ExitCode.InvalidArguments, "--no-audit cannot be used with --note.");
+
+            if (this.CheckRemote && string.IsNullOrEmpty(this.SourceUrl))
+                throw new UpackException(ExitCode.InvalidArguments, "--check-remote requires --source or the UPACK_FEED environment variable.");
+
+            if (this.Reproducible)
             {
-                Console.Error.WriteLine("--no-audit cannot be used with --note.");
-                return 2;
+                var epoch = Environment.GetEnvironmentVariable("SOURCE_DATE_EPOCH");
+                if (string.IsNullOrEmpty(epoch))
+                {
+                    this.Clock = new FixedClock(new DateTimeOffset(2000, 1, 1, 0, 0, 0, TimeSpan.Zero));
+                }
+                else if (long.TryParse(epoch, out var seconds) && seconds >= 0)
+                {
+                    this.Clock = new FixedClock(new DateTimeOffset(1970, 1, 1, 0, 0, 0, TimeSpan.Zero).AddSeconds(seconds));
+                }
+                else
+                {
+                    throw new UpackException(ExitCode.InvalidArguments, "SOURCE_DATE_EPOCH must be a non-negative number of seconds.");
+                }
             }
 
             UniversalPackageMetadata info;
 
+            if (this.Variables != null && string.IsNullOrWhiteSpace(this.Manifest))
+                throw new UpackException(ExitCode.InvalidArguments, "--var can only be used with --manifest.");
+
             if (string.IsNullOrWhiteSpace(this.Manifest))
             {
+                if (!string.IsNullOrEmpty(this.Version) && UniversalPackageVersion.TryParse(this.Version) == null)
+                    throw new UpackException(ExitCode.InvalidArguments, $"Invalid parameters: invalid version {this.Version}: {VersionCheck.Explain(this.Version) ?? "it is not a valid UPack version number."}");
+
                 info = new UniversalPackageMetadata
                 {
                     Group = this.Group,
@@ -91,16 +229,34 @@ namespace Inedo.UPack.CLI
                     Description = this.PackageDescription,
                     Icon = this.IconUrl
                 };
+
+                if (!string.IsNullOrEmpty(this.License))
+                    info["license"] = this.License;
+                if (!string.IsNullOrEmpty(this.LicenseUrl))
+                    info["licenseUrl"] = this.LicenseUrl;
+                if (this.Tags != null)
+                    info.SetTags(this.Tags);
             }
             else
             {
                 if (!File.Exists(this.Manifest))
+                    throw new UpackException(ExitCode.InvalidArguments, $"The manifest file '{this.Manifest}' does not exist.");
+
+                var variables = new Dictionary<string, string>(StringComparer.Ordinal);
+                foreach (var variable in this.Variables ?? new string[0])
                 {
-                    Console.Error.WriteLine($"The manifest file '{this.Manifest}' does not exist.");
-                    return 2;
+                    var parts = variable.Split(new[] { '=' }, 2);
+                    if (parts.Length != 2 || !PlaceholderNameRegex.IsMatch(parts[0]))
+                        throw new UpackException(ExitCode.InvalidArguments, "--var must be in the format \"«name»=«value»\", where the name contains only letters, digits, and underscores.");
+
+                    variables[parts[0]] = parts[1];
                 }
 
-                using (var metadataStream = File.OpenRead(this.Manifest))
+                var text = SubstitutePlaceholders(File.ReadAllText(this.Manifest), variables, out var unresolved);
+                if (unresolved.Count > 0)
+                    throw new UpackException(ExitCode.InvalidArguments, $"The manifest file '{this.Manifest}' has unresolved placeholders: {string.Join(", ", unresolved)}. Specify them with --var or environment variables.");
+
+                using (var metadataStream = new MemoryStream(Encoding.UTF8.GetBytes(text)))
                 {
                     info = await ReadManifestAsync(metadataStream);
                 }
@@ -108,42 +264,65 @@ namespace Inedo.UPack.CLI
 
             var error = ValidateManifest(info);
             if (error != null)
-            {
-                Console.Error.WriteLine("Invalid {0}: {1}", string.IsNullOrWhiteSpace(this.Manifest) ? "parameters" : "upack.json", error);
-                return 2;
-            }
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid {(string.IsNullOrWhiteSpace(this.Manifest) ? "parameters" : "upack.json")}: {error}");
+
+            if (this.Strict)
+                CheckManifestSchema(info);
+
+            if (!string.IsNullOrEmpty(this.DetectDependencies))
+                await this.AddDetectedDependenciesAsync(info);
+
+            if (this.CheckRemote)
+                await this.CheckRemoteAsync(info, cancellationToken);
 
             PrintManifest(info);
 
             if (!this.NoAudit)
             {
-                info["createdDate"] = DateTime.UtcNow.ToString("u");
+                info["createdDate"] = this.Clock.Now.UtcDateTime.ToString("u");
                 if (!string.IsNullOrEmpty(this.Note))
                 {
                     info["createdReason"] = this.Note;
                 }
                 info["createdUsing"] = "upack/" + typeof(Pack).Assembly.GetName().Version.ToString(3);
-                info["createdBy"] = Environment.UserName;
+                // the user name would make the package differ between users and machines
+                if (!this.Reproducible)
+                    info["createdBy"] = Environment.UserName;
             }
 
             if (!Directory.Exists(this.SourcePath) && !File.Exists(this.SourcePath))
-            {
-                Console.Error.WriteLine($"The source directory '{this.SourcePath}' does not exist.");
-                return 2;
-            }
+                throw new UpackException(ExitCode.InvalidArguments, $"The source directory '{this.SourcePath}' does not exist.");
 
             string relativePackageFileName = $"{info.Name}-{info.Version.Major}.{info.Version.Minor}.{info.Version.Patch}.upack";
             string targetFileName = Path.Combine(this.TargetDirectory ?? Environment.CurrentDirectory, relativePackageFileName);
 
             if (File.Exists(Path.Combine(this.SourcePath, relativePackageFileName)))
             {
-                Console.Error.WriteLine("Warning: output file already exists in source directory and may be included inadvertently in the package contents.");
+                this.Warn("output file already exists in source directory and may be included inadvertently in the package contents.");
             }
 
+            var root = NormalizeContentRoot(this.ContentRoot);
+            if (!string.IsNullOrEmpty(this.ReadmePath))
+            {
+                if (!File.Exists(this.ReadmePath))
+                    throw new UpackException(ExitCode.InvalidArguments, $"The README file '{this.ReadmePath}' does not exist.");
+
+                if (root == string.Empty)
+                    throw new UpackException(ExitCode.InvalidArguments, "--readme cannot be used when the contents are stored in the archive root.");
+            }
+
+            if (root != DefaultContentRoot)
+                this.Warn($"contents will be stored in {(root == string.Empty ? "the archive root" : root)} instead of {DefaultContentRoot}; the package will not be readable by standard universal package tools.");
+
             string tmpPath = Path.GetTempFileName();
             using (var builder = new UniversalPackageBuilder(tmpPath, info))
             {
-                if (Directory.Exists(this.SourcePath))
+                // the raw path adds files in a stable order
+                if (root != DefaultContentRoot || this.Reproducible)
+                {
+                    await this.AddContentsRawAsync(builder, root, cancellationToken);
+                }
+                else if (Directory.Exists(this.SourcePath))
                 {
                     await builder.AddContentsAsync(
                         this.SourcePath,
@@ -160,13 +339,301 @@ namespace Inedo.UPack.CLI
                         await builder.AddFileAsync(file, Path.GetFileName(this.SourcePath), File.GetLastWriteTimeUtc(this.SourcePath), cancellationToken);
                     }
                 }
+
+                if (!string.IsNullOrEmpty(this.ReadmePath))
+                {
+                    using (var file = File.Open(this.ReadmePath, FileMode.Open, FileAccess.Read, FileShare.Read))
+                    {
+                        await builder.AddFileRawAsync(file, GetEmbeddedReadmeName(this.ReadmePath), File.GetLastWriteTimeUtc(this.ReadmePath), cancellationToken);
+                    }
+                }
+            }
+
+            if (this.Reproducible)
+            {
+                // the builder stamps upack.json and directory entries with the current time
+                var stampedPath = Path.GetTempFileName();
+                await StampEntriesAsync(tmpPath, stampedPath, this.Clock.Now, cancellationToken);
+                File.Delete(tmpPath);
+                tmpPath = stampedPath;
             }
 
             Directory.CreateDirectory(Path.GetDirectoryName(targetFileName));
             File.Delete(targetFileName);
             File.Move(tmpPath, targetFileName);
 
+            if (this.Analyze)
+                AnalyzePackage(targetFileName);
+
+            WriteResult(
+                new JObject
+                {
+                    ["group"] = info.Group,
+                    ["name"] = info.Name,
+                    ["version"] = info.Version.ToString(),
+                    ["path"] = targetFileName,
+                    ["sha1"] = GetSHA1(targetFileName).ToString(),
+                    ["size"] = new FileInfo(targetFileName).Length
+                }
+            );
+
             return 0;
         }
+
+        private static readonly Regex PlaceholderNameRegex = new Regex(@"^[A-Za-z_][A-Za-z0-9_]*$");
+
+        // Replaces ${NAME} with the --var or environment variable of that name, escaped for use inside a JSON string;
+        // $${NAME} is written as a literal ${NAME}.
+        private static string SubstitutePlaceholders(string text, Dictionary<string, string> variables, out List<string> unresolved)
+        {
+            var missing = new List<string>();
+            var result = Regex.Replace(
+                text,
+                @"\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)\}",
+                m =>
+                {
+                    var name = m.Groups[2].Value;
+                    if (m.Groups[1].Length > 0)
+                        return "${" + name + "}";
+
+                    if (!variables.TryGetValue(name, out var value))
+                        value = Environment.GetEnvironmentVariable(name);
+
+                    if (value == null)
+                    {
+                        if (!missing.Contains(name))
+                            missing.Add(name);
+                        return m.Value;
+                    }
+
+                    var escaped = JsonConvert.ToString(value);
+                    return escaped.Substring(1, escaped.Length - 2);
+                }
+            );
+
+            unresolved = missing;
+            return result;
+        }
+
+        // The embedded file is always given a conventional README name so that it is found regardless of what it was called on disk.
+        private static string GetEmbeddedReadmeName(string path)
+        {
+            switch (Path.GetExtension(path).ToLowerInvariant())
+            {
+                case ".md":
+                case ".markdown":
+                    return "README.md";
+                case ".txt":
+                    return "README.txt";
+                default:
+                    return "README";
+            }
+        }
+
+        // Catches a version that was already published, or a group or name that the feed knows with different casing,
+        // before the package is built rather than when it is pushed.
+        private async Task CheckRemoteAsync(UniversalPackageMetadata info, CancellationToken cancellationToken)
+        {
+            var client = CreateClient(this.SourceUrl, this.Authentication, this.ApiKey);
+            var id = new UniversalPackageId(info.Group, info.Name);
+
+            IReadOnlyList<RemoteUniversalPackageVersion> versions;
+            try
+            {
+                versions = await FeedHttp.SendAsync(() => client.ListPackageVersionsAsync(id, false, null, cancellationToken), cancellationToken);
+            }
+            catch (WebException ex)
+            {
+                throw ConvertWebException(ex);
+            }
+
+            if (versions.Any(v => v.Version.Equals(info.Version)))
+                this.Warn($"{id} {info.Version} already exists in {this.SourceUrl}.");
+
+            var existing = versions.FirstOrDefault();
+            if (existing != null)
+            {
+                if (!string.Equals(existing.Group ?? string.Empty, info.Group ?? string.Empty, StringComparison.Ordinal))
+                    this.Warn($"{this.SourceUrl} has this package in group \"{existing.Group}\", which differs in casing from \"{info.Group}\".");
+                if (!string.Equals(existing.Name, info.Name, StringComparison.Ordinal))
+                    this.Warn($"{this.SourceUrl} has this package named \"{existing.Name}\", which differs in casing from \"{info.Name}\".");
+            }
+        }
+
+        private async Task AddDetectedDependenciesAsync(UniversalPackageMetadata info)
+        {
+            var roots = this.DetectDependencies
+                .Split(new[] { Path.PathSeparator }, StringSplitOptions.RemoveEmptyEntries)
+                .Select(p => Path.GetFullPath(p).TrimEnd(Path.DirectorySeparatorChar, Path.AltDirectorySeparatorChar) + Path.DirectorySeparatorChar)
+                .ToList();
+
+            IReadOnlyList<InstalledPackage> installed;
+            using (var registry = this.OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+            {
+                installed = await registry.GetInstalledPackagesAsync();
+            }
+
+            var found = installed
+                .Where(p => !string.IsNullOrEmpty(p.InstallPath) && roots.Any(r => (Path.GetFullPath(p.InstallPath).TrimEnd(Path.DirectorySeparatorChar, Path.AltDirectorySeparatorChar) + Path.DirectorySeparatorChar).StartsWith(r, StringComparison.OrdinalIgnoreCase)))
+                .GroupBy(p => (string.IsNullOrEmpty(p.Group) ? string.Empty : p.Group + "/") + p.Name, StringComparer.OrdinalIgnoreCase);
+
+            var dependencies = new List<string>();
+            if (info.ContainsKey("dependencies") && info["dependencies"] != null && JToken.FromObject(info["dependencies"]) is JArray existing)
+                dependencies.AddRange(existing.Select(t => (string)t));
+
+            foreach (var package in found)
+            {
+                // dependencies listed in the manifest take precedence over detected ones
+                if (dependencies.Any(d => string.Equals(d.Split(':')[0], package.Key, StringComparison.OrdinalIgnoreCase)))
+                    continue;
+
+                var versions = package.Select(p => p.Version).Distinct(StringComparer.OrdinalIgnoreCase).ToList();
+                var version = versions.OrderByDescending(v => UniversalPackageVersion.TryParse(v)).First();
+                if (versions.Count > 1)
+                    this.Warn($"{package.Key} is installed with more than one version ({string.Join(", ", versions)}); using {version}.");
+
+                Log.Info($"Detected dependency: {package.Key}:{version}");
+                dependencies.Add(package.Key + ":" + version);
+            }
+
+            if (dependencies.Count > 0)
+                info["dependencies"] = dependencies;
+        }
+
+        private static void AnalyzePackage(string fileName)
+        {
+            // entries smaller than this aren't worth reporting as poorly compressed
+            const long MinimumReportedSize = 64 * 1024;
+
+            using (var zip = new ZipArchive(File.OpenRead(fileName), ZipArchiveMode.Read))
+            {
+                var files = zip.Entries.Where(e => !e.FullName.EndsWith("/") && e.Length > 0).ToList();
+                long totalSize = files.Sum(f => f.Length);
+                long totalCompressed = files.Sum(f => f.CompressedLength);
+
+                Console.WriteLine();
+                Console.WriteLine($"Package size: {new FileInfo(fileName).Length:N0} bytes; {files.Count:N0} files, {totalSize:N0} bytes uncompressed ({FormatRatio(totalCompressed, totalSize)} after compression).");
+
+                var poorlyCompressed = files
+                    .Where(f => f.Length >= MinimumReportedSize && f.CompressedLength >= f.Length * 0.95)
+                    .OrderByDescending(f => f.Length)
+                    .ToList();
+
+                if (poorlyCompressed.Count > 0)
+                {
+                    Console.WriteLine();
+                    Console.WriteLine("Entries that do not compress well:");
+                    foreach (var file in poorlyCompressed)
+                        Console.WriteLine($"{file.Length,14:N0}  {FormatRatio(file.CompressedLength, file.Length),5}  {file.FullName}");
+                }
+
+                var duplicates = new List<List<ZipArchiveEntry>>();
+                foreach (var sameSize in files.GroupBy(f => f.Length).Where(g => g.Count() > 1))
+                {
+                    var byHash = new Dictionary<string, List<ZipArchiveEntry>>();
+                    foreach (var file in sameSize)
+                    {
+                        string hash;
+                        using (var stream = file.Open())
+                        {
+                            hash = GetHash(stream, "SHA1").ToString();
+                        }
+
+                        if (!byHash.TryGetValue(hash, out var list))
+                            byHash.Add(hash, list = new List<ZipArchiveEntry>());
+                        list.Add(file);
+                    }
+
+                    duplicates.AddRange(byHash.Values.Where(l => l.Count > 1));
+                }
+
+                if (duplicates.Count > 0)
+                {
+                    Console.WriteLine();
+                    Console.WriteLine("Files with identical contents:");
+                    foreach (var list in duplicates.OrderByDescending(l => l[0].Length * (l.Count - 1)))
+                    {
+                        Console.WriteLine($"{list.Count} copies of {list[0].Name} ({list[0].Length:N0} bytes each):");
+                        foreach (var file in list)
+                            Console.WriteLine("  " + file.FullName);
+                    }
+                }
+
+                Console.WriteLine();
+                if (poorlyCompressed.Count == 0 && duplicates.Count == 0)
+                {
+                    Console.WriteLine("No suggestions.");
+                    return;
+                }
+
+                Console.WriteLine("Suggestions:");
+                if (poorlyCompressed.Count > 0)
+                    Console.WriteLine($" - {poorlyCompressed.Count} entries ({poorlyCompressed.Sum(f => f.Length):N0} bytes) are already compressed or contain random data; consider whether they need to be in the package.");
+                if (duplicates.Count > 0)
+                    Console.WriteLine($" - {duplicates.Sum(l => l.Count - 1)} duplicate files use {duplicates.Sum(l => l[0].CompressedLength * (l.Count - 1)):N0} bytes of the package; consider removing the extra copies from the source directory.");
+            }
+        }
+
+        // Copies every entry of an archive to a new one with the specified timestamp. Updating the archive in place would be
+        // simpler, but ZipArchiveMode.Update holds the contents of every entry in memory, which fails for packages of several GB.
+        private static async Task StampEntriesAsync(string sourcePath, string targetPath, DateTimeOffset timestamp, CancellationToken cancellationToken)
+        {
+            using (var source = new ZipArchive(File.OpenRead(sourcePath), ZipArchiveMode.Read))
+            using (var target = new ZipArchive(new FileStream(targetPath, FileMode.Create, FileAccess.Write, FileShare.None), ZipArchiveMode.Create))
+            {
+                foreach (var entry in source.Entries)
+                {
+                    cancellationToken.ThrowIfCancellationRequested();
+
+                    var targetEntry = target.CreateEntry(entry.FullName);
+                    targetEntry.LastWriteTime = timestamp;
+
+                    if (entry.FullName.EndsWith("/"))
+                        continue;
+
+                    using (var entryStream = entry.Open())
+                    using (var targetEntryStream = targetEntry.Open())
+                    {
+                        await entryStream.CopyToAsync(targetEntryStream, 65536, cancellationToken);
+                    }
+                }
+            }
+        }
+
+        private async Task AddContentsRawAsync(UniversalPackageBuilder builder, string root, CancellationToken cancellationToken)
+        {
+            if (!Directory.Exists(this.SourcePath))
+            {
+                using (var file = File.Open(this.SourcePath, FileMode.Open, FileAccess.Read, FileShare.Read))
+                {
+                    await builder.AddFileRawAsync(file, root + Path.GetFileName(this.SourcePath), File.GetLastWriteTimeUtc(this.SourcePath), cancellationToken);
+                }
+
+                return;
+            }
+
+            var sourcePath = this.SourcePath.TrimEnd(Path.DirectorySeparatorChar, Path.AltDirectorySeparatorChar) + Path.DirectorySeparatorChar;
+
+            foreach (var directory in Directory.EnumerateDirectories(sourcePath, "*", SearchOption.AllDirectories).OrderBy(d => d, StringComparer.Ordinal))
+            {
+                if (!Directory.EnumerateFileSystemEntries(directory).Any())
+                    builder.AddEmptyDirectoryRaw(root + directory.Substring(sourcePath.Length).Replace('\\', '/') + "/");
+            }
+
+            foreach (var fileName in Directory.EnumerateFiles(sourcePath, "*", SearchOption.AllDirectories).OrderBy(f => f, StringComparer.Ordinal))
+            {
+                cancellationToken.ThrowIfCancellationRequested();
+
+                var relativePath = fileName.Substring(sourcePath.Length).Replace('\\', '/');
+                // upack.json at the archive root is always the manifest, so a source file with that name can't be stored there
+                if ((!string.IsNullOrWhiteSpace(this.Manifest) || root == string.Empty) && string.Equals(relativePath, "upack.json", StringComparison.OrdinalIgnoreCase))
+                    continue;
+
+                using (var file = File.Open(fileName, FileMode.Open, FileAccess.Read, FileShare.Read))
+                {
+                    await builder.AddFileRawAsync(file, root + relativePath, File.GetLastWriteTimeUtc(fileName), cancellationToken);
+                }
+            }
+        }
     }
 }
@@ -0,0 +1,175 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // The license of a package is stored in the "license" manifest property as an SPDX license expression, such as
+    // "MIT" or "(Apache-2.0 OR MIT) AND BSD-3-Clause", with an optional "licenseUrl" property linking to the license text.
+    internal static class PackageLicense
+    {
+        public static string GetLicense(this UniversalPackageMetadata info) => GetString(info, "license");
+        public static string GetLicenseUrl(this UniversalPackageMetadata info) => GetString(info, "licenseUrl");
+
+        // Returns a description of the problem with the license properties of a manifest, or null if they are valid.
+        public static string Validate(UniversalPackageMetadata info)
+        {
+            if (info.ContainsKey("license") && info["license"] != null)
+            {
+                var license = info["license"] as string;
+                if (string.IsNullOrWhiteSpace(license))
+                    return "license must be a non-empty SPDX license expression.";
+
+                var problem = ExplainExpression(license);
+                if (problem != null)
+                    return $"license is not a valid SPDX license expression: {problem}";
+            }
+
+            if (info.ContainsKey("licenseUrl") && info["licenseUrl"] != null)
+            {
+                var url = info["licenseUrl"] as string;
+                if (!Uri.TryCreate(url, UriKind.Absolute, out var uri) || (uri.Scheme != Uri.UriSchemeHttp && uri.Scheme != Uri.UriSchemeHttps))
+                    return "licenseUrl must be an absolute http or https URL.";
+            }
+
+            return null;
+        }
+
+        // Checks the syntax of an expression against the SPDX grammar; identifiers are not checked against the SPDX license list.
+        internal static string ExplainExpression(string expression)
+        {
+            var tokens = Tokenize(expression);
+            if (tokens.Count == 0)
+                return "it is empty.";
+
+            int index = 0;
+            var problem = ParseOr(tokens, ref index);
+            if (problem == null && index < tokens.Count)
+                problem = $"unexpected {Describe(tokens[index])}.";
+
+            return problem;
+        }
+
+        private static string ParseOr(List<string> tokens, ref int index)
+        {
+            var problem = ParseAnd(tokens, ref index);
+            while (problem == null && index < tokens.Count && IsOperator(tokens[index], "OR"))
+            {
+                index++;
+                problem = ParseAnd(tokens, ref index);
+            }
+
+            return problem;
+        }
+
+        private static string ParseAnd(List<string> tokens, ref int index)
+        {
+            var problem = ParseTerm(tokens, ref index);
+            while (problem == null && index < tokens.Count && IsOperator(tokens[index], "AND"))
+            {
+                index++;
+                problem = ParseTerm(tokens, ref index);
+            }
+
+            return problem;
+        }
+
+        private static string ParseTerm(List<string> tokens, ref int index)
+        {
+            if (index >= tokens.Count)
+                return index == 0 ? "it is empty." : $"expected a license identifier after {tokens[index - 1]}.";
+
+            var token = tokens[index];
+            if (token == "(")
+            {
+                index++;
+                var problem = ParseOr(tokens, ref index);
+                if (problem != null)
+                    return problem;
+                if (index >= tokens.Count || tokens[index] != ")")
+                    return "missing closing parenthesis.";
+
+                index++;
+                return null;
+            }
+
+            if (token == ")" || IsOperator(token, "AND") || IsOperator(token, "OR") || IsOperator(token, "WITH"))
+                return $"expected a license identifier but found {Describe(token)}.";
+
+            var licenseProblem = ExplainLicenseId(token);
+            if (licenseProblem != null)
+                return licenseProblem;
+
+            index++;
+            if (index < tokens.Count && IsOperator(tokens[index], "WITH"))
+            {
+                index++;
+                if (index >= tokens.Count || tokens[index] == "(" || tokens[index] == ")")
+                    return "expected an exception identifier after WITH.";
+                if (!IsIdString(tokens[index]))
+                    return $"{tokens[index]} is not a valid exception identifier.";
+
+                index++;
+            }
+
+            return null;
+        }
+
+        private static string ExplainLicenseId(string token)
+        {
+            var id = token;
+            if (id.StartsWith("DocumentRef-", StringComparison.Ordinal))
+            {
+                int colon = id.IndexOf(':');
+                if (colon < 0 || !IsIdString(id.Substring("DocumentRef-".Length, colon - "DocumentRef-".Length)) || !id.Substring(colon + 1).StartsWith("LicenseRef-", StringComparison.Ordinal))
+                    return $"{token} must have the form DocumentRef-«id»:LicenseRef-«id».";
+
+                id = id.Substring(colon + 1);
+            }
+
+            if (id.StartsWith("LicenseRef-", StringComparison.Ordinal))
+                return IsIdString(id.Substring("LicenseRef-".Length)) ? null : $"{token} is not a valid license reference.";
+
+            if (id.EndsWith("+", StringComparison.Ordinal))
+                id = id.Substring(0, id.Length - 1);
+
+            if (!IsIdString(id))
+                return $"{token} is not a valid license identifier; identifiers may contain only letters, digits, periods, and hyphens.";
+
+            return null;
+        }
+
+        private static List<string> Tokenize(string expression)
+        {
+            var tokens = new List<string>();
+            foreach (var word in expression.Split(new[] { ' ', '\t', '\r', '\n' }, StringSplitOptions.RemoveEmptyEntries))
+            {
+                int start = 0;
+                for (int i = 0; i < word.Length; i++)
+                {
+                    if (word[i] == '(' || word[i] == ')')
+                    {
+                        if (i > start)
+                            tokens.Add(word.Substring(start, i - start));
+                        tokens.Add(word[i].ToString());
+                        start = i + 1;
+                    }
+                }
+
+                if (start < word.Length)
+                    tokens.Add(word.Substring(start));
+            }
+
+            return tokens;
+        }
+
+        // SPDX allows operators to be written in either all upper or all lower case.
+        private static bool IsOperator(string token, string op) => token == op || token == op.ToLowerInvariant();
+
+        private static bool IsIdString(string text) => text.Length > 0 && text.All(c => (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '-' || c == '.');
+
+        private static string Describe(string token) => token == "(" || token == ")" ? $"'{token}'" : token;
+
+        private static string GetString(UniversalPackageMetadata info, string property) => info.ContainsKey(property) ? info[property] as string : null;
+    }
+}
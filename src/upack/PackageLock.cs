@@ -0,0 +1,66 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using System.Text;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    // Contents of an upack.lock file, which records the exact version and SHA1 hash of each package installed with
+    // --lock so that install --locked can reproduce the same set later.
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class PackageLock
+    {
+        public const string FileName = "upack.lock";
+
+        [JsonProperty("packages")]
+        public List<LockedPackage> Packages { get; set; } = new List<LockedPackage>();
+
+        public static PackageLock TryRead(string path)
+        {
+            if (!File.Exists(path))
+                return null;
+
+            try
+            {
+                var lockFile = JsonConvert.DeserializeObject<PackageLock>(File.ReadAllText(path, Encoding.UTF8)) ?? new PackageLock();
+                if (lockFile.Packages == null)
+                    lockFile.Packages = new List<LockedPackage>();
+
+                return lockFile;
+            }
+            catch (JsonException ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, $"The lock file {path} is not valid: {ex.Message}", ex)
+                {
+                    Code = ErrorCodes.InvalidStateFile,
+                    Hint = "Delete the lock file to create it again."
+                };
+            }
+        }
+
+        public void Write(string path)
+        {
+            // Keep the file sorted so that it produces stable diffs when checked in.
+            this.Packages = this.Packages
+                .OrderBy(p => p.Group ?? string.Empty, StringComparer.OrdinalIgnoreCase)
+                .ThenBy(p => p.Name, StringComparer.OrdinalIgnoreCase)
+                .ToList();
+
+            var directory = Path.GetDirectoryName(path);
+            if (!string.IsNullOrEmpty(directory))
+                Directory.CreateDirectory(directory);
+
+            File.WriteAllText(path, JsonConvert.SerializeObject(this, Formatting.Indented), new UTF8Encoding(false));
+        }
+
+        public LockedPackage Find(UniversalPackageId id) => this.Packages.FirstOrDefault(p => p.IsFor(id));
+
+        public void Set(LockedPackage package)
+        {
+            this.Packages.RemoveAll(p => p.IsFor(new UniversalPackageId(package.Group, package.Name)));
+            this.Packages.Add(package);
+        }
+    }
+}
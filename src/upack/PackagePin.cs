@@ -0,0 +1,67 @@
+﻿using System;
+using System.IO;
+using System.Text;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    // Contents of a .upack-pin file, which keeps the package installed in its directory at a version or range
+    // independently of the local registry.
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class PackagePin
+    {
+        public const string FileName = ".upack-pin";
+
+        [JsonProperty("group")]
+        public string Group { get; set; }
+
+        [JsonProperty("name")]
+        public string Name { get; set; }
+
+        [JsonProperty("version")]
+        public string Version { get; set; }
+
+        [JsonProperty("reason")]
+        public string Reason { get; set; }
+
+        [JsonProperty("date")]
+        public string Date { get; set; }
+
+        [JsonProperty("by")]
+        public string By { get; set; }
+
+        public static PackagePin TryRead(string directory)
+        {
+            var path = Path.Combine(directory, FileName);
+            if (!File.Exists(path))
+                return null;
+
+            try
+            {
+                return JsonConvert.DeserializeObject<PackagePin>(File.ReadAllText(path, Encoding.UTF8));
+            }
+            catch (JsonException ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, $"The pin file {path} is not valid: {ex.Message}", ex)
+                {
+                    Code = ErrorCodes.InvalidStateFile,
+                    Hint = "Release the pin with upack hold --release, or delete the pin file."
+                };
+            }
+        }
+
+        public void Write(string directory)
+        {
+            Directory.CreateDirectory(directory);
+            File.WriteAllText(Path.Combine(directory, FileName), JsonConvert.SerializeObject(this, Formatting.Indented), new UTF8Encoding(false));
+        }
+
+        public bool IsFor(UniversalPackageId id)
+        {
+            return string.Equals(this.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                && string.Equals(this.Name, id.Name, StringComparison.OrdinalIgnoreCase);
+        }
+
+        public override string ToString() => (string.IsNullOrEmpty(this.Group) ? this.Name : this.Group + "/" + this.Name) + " " + this.Version;
+    }
+}
@@ -0,0 +1,61 @@
+﻿using System.Collections.Generic;
+using System.Linq;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // Tags are stored in the "tags" manifest property as an array of short keywords used to categorize and filter packages.
+    internal static class PackageTags
+    {
+        public static IReadOnlyList<string> GetTags(this UniversalPackageMetadata info)
+        {
+            if (!info.ContainsKey("tags") || info["tags"] == null)
+                return new string[0];
+
+            return JToken.FromObject(info["tags"]) is JArray array
+                ? array.Where(t => t.Type == JTokenType.String).Select(t => (string)t).ToList()
+                : (IReadOnlyList<string>)new string[0];
+        }
+
+        public static void SetTags(this UniversalPackageMetadata info, IEnumerable<string> tags)
+        {
+            info["tags"] = new JArray(tags.Distinct());
+        }
+
+        // Returns a description of the problem with the tags of a manifest, or null if they are valid.
+        public static string Validate(UniversalPackageMetadata info)
+        {
+            if (!info.ContainsKey("tags") || info["tags"] == null)
+                return null;
+
+            if (!(JToken.FromObject(info["tags"]) is JArray array))
+                return "tags must be an array of strings.";
+
+            foreach (var token in array)
+            {
+                if (token.Type != JTokenType.String)
+                    return "tags must be an array of strings.";
+
+                var problem = ExplainTag((string)token);
+                if (problem != null)
+                    return problem;
+            }
+
+            return null;
+        }
+
+        internal static string ExplainTag(string tag)
+        {
+            if (string.IsNullOrEmpty(tag) || tag.Length > 50)
+                return "each tag must be between 1 and 50 characters long.";
+
+            var invalid = tag.Where(c => (c < '0' || c > '9') && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && c != '-' && c != '.' && c != '_').Distinct().ToArray();
+            if (invalid.Length == 1)
+                return $"tag {tag} contains invalid character: '{invalid[0]}'";
+            else if (invalid.Length > 1)
+                return $"tag {tag} contains invalid characters: '{string.Join("', '", invalid)}'";
+
+            return null;
+        }
+    }
+}
@@ -0,0 +1,49 @@
+﻿using System.IO;
+using System.Net;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    // Uploads a package file to the upload endpoint of a feed. The file is opened again for each attempt, independently of the
+    // stream its metadata was read from, and sent with its exact length as Content-Length and without being buffered, so that
+    // a package of several GB is streamed from disk. The HttpWebRequest of .NET Core buffers every request body regardless,
+    // so there an upload still uses as much memory as the package, as uploads through the feed client always have.
+    internal static class PackageUpload
+    {
+        public static async Task UploadAsync(string feedUrl, NetworkCredential credentials, string path, Progress progress, CancellationToken cancellationToken)
+        {
+            using (var file = new FileStream(path, FileMode.Open, FileAccess.Read, FileShare.Read, 4096, FileOptions.Asynchronous | FileOptions.SequentialScan))
+            {
+                var request = FeedHttp.CreateRequest(feedUrl.TrimEnd('/') + "/upload", credentials);
+                request.Method = "PUT";
+                request.ContentType = "application/octet-stream";
+                request.ContentLength = file.Length;
+
+                // Windows authentication sends the body again after the server's challenge, which requires it to be buffered
+                request.AllowWriteStreamBuffering = request.UseDefaultCredentials;
+
+                using (cancellationToken.Register(request.Abort))
+                {
+                    progress?.Reset(0);
+
+                    using (var requestStream = await request.GetRequestStreamAsync())
+                    {
+                        var buffer = new byte[81920];
+                        int read;
+                        while ((read = await file.ReadAsync(buffer, 0, buffer.Length, cancellationToken)) > 0)
+                        {
+                            await requestStream.WriteAsync(buffer, 0, read, cancellationToken);
+                            progress?.Add(read);
+                        }
+                    }
+
+                    using (var response = (HttpWebResponse)await request.GetResponseAsync())
+                    {
+                        Log.DebugHeaders("<", response.Headers);
+                    }
+                }
+            }
+        }
+    }
+}
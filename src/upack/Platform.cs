@@ -0,0 +1,109 @@
+﻿using System;
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+#if NETCOREAPP
+using System.Runtime.InteropServices;
+#endif
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // Packages may restrict where they can be installed with "os" and "architecture" manifest properties, each either
+    // a single name or an array of names, such as "os": ["windows"] and "architecture": ["x64", "arm64"].
+    internal static class Platform
+    {
+        private static readonly Dictionary<string, string> Aliases = new Dictionary<string, string>(StringComparer.OrdinalIgnoreCase)
+        {
+            ["win"] = "windows",
+            ["win32"] = "windows",
+            ["osx"] = "macos",
+            ["darwin"] = "macos",
+            ["amd64"] = "x64",
+            ["x86_64"] = "x64",
+            ["i386"] = "x86",
+            ["i686"] = "x86",
+            ["aarch64"] = "arm64"
+        };
+
+        public static string CurrentOS
+        {
+            get
+            {
+#if NETCOREAPP
+                if (RuntimeInformation.IsOSPlatform(OSPlatform.Windows))
+                    return "windows";
+                if (RuntimeInformation.IsOSPlatform(OSPlatform.OSX))
+                    return "macos";
+                return "linux";
+#else
+                switch (Environment.OSVersion.Platform)
+                {
+                    case PlatformID.MacOSX:
+                        return "macos";
+                    case PlatformID.Unix:
+                        // Mono reports macOS as Unix
+                        return Directory.Exists("/System/Library/CoreServices") ? "macos" : "linux";
+                    default:
+                        return "windows";
+                }
+#endif
+            }
+        }
+
+        public static string CurrentArchitecture
+        {
+            get
+            {
+#if NETCOREAPP
+                switch (RuntimeInformation.OSArchitecture)
+                {
+                    case Architecture.X86:
+                        return "x86";
+                    case Architecture.Arm:
+                        return "arm";
+                    case Architecture.Arm64:
+                        return "arm64";
+                    default:
+                        return "x64";
+                }
+#else
+                var arch = Environment.GetEnvironmentVariable("PROCESSOR_ARCHITEW6432") ?? Environment.GetEnvironmentVariable("PROCESSOR_ARCHITECTURE");
+                if (string.Equals(arch, "ARM64", StringComparison.OrdinalIgnoreCase))
+                    return "arm64";
+
+                return Environment.Is64BitOperatingSystem ? "x64" : "x86";
+#endif
+            }
+        }
+
+        // Returns a description of the constraint that the current platform does not satisfy, or null if the package may be installed here.
+        public static string CheckCompatible(UniversalPackageMetadata info)
+        {
+            var os = GetNames(info, "os");
+            if (os.Count > 0 && !os.Contains(CurrentOS, StringComparer.OrdinalIgnoreCase))
+                return $"supports only the {string.Join(", ", os)} operating system{(os.Count > 1 ? "s" : string.Empty)}, but this machine is running {CurrentOS}";
+
+            var architectures = GetNames(info, "architecture");
+            if (architectures.Count > 0 && !architectures.Contains(CurrentArchitecture, StringComparer.OrdinalIgnoreCase))
+                return $"supports only the {string.Join(", ", architectures)} architecture{(architectures.Count > 1 ? "s" : string.Empty)}, but this machine is {CurrentArchitecture}";
+
+            return null;
+        }
+
+        private static List<string> GetNames(UniversalPackageMetadata info, string property)
+        {
+            if (!info.ContainsKey(property) || info[property] == null)
+                return new List<string>();
+
+            var token = JToken.FromObject(info[property]);
+            var names = token is JArray array ? array.Select(t => (string)t) : new[] { (string)token };
+
+            return names
+                .Where(n => !string.IsNullOrWhiteSpace(n))
+                .Select(n => Aliases.TryGetValue(n.Trim(), out var alias) ? alias : n.Trim().ToLowerInvariant())
+                .Distinct()
+                .ToList();
+        }
+    }
+}
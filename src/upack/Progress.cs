@@ -0,0 +1,129 @@
+﻿using System;
+using System.Diagnostics;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // With --progress=json, the progress of each download, extraction, and upload is written to standard error as lines of JSON,
+    // so that wrappers can display their own progress bars; other lines on standard error, such as warnings, are not JSON.
+    // Each line has event (start, progress, or finish), phase, package, version, and bytes, and total when it is known.
+    // install --with-dependencies also receives every report through ProgressDisplay, whether or not --progress=json was specified.
+    internal sealed class Progress
+    {
+        private static readonly object WriteLock = new object();
+        private static readonly TimeSpan Interval = TimeSpan.FromMilliseconds(250);
+
+        private readonly string phase;
+        private readonly string package;
+        private readonly string version;
+        private readonly long? total;
+        private readonly int? totalFiles;
+        private readonly Stopwatch sinceReport = Stopwatch.StartNew();
+        private long bytes;
+        private int files;
+
+        private Progress(string phase, string package, string version, long? total, int? totalFiles)
+        {
+            this.phase = phase;
+            this.package = package;
+            this.version = version;
+            this.total = total;
+            this.totalFiles = totalFiles;
+        }
+
+        public static bool Enabled { get; set; }
+        public static ProgressDisplay Display { get; set; }
+        public static bool Active => Enabled || Display != null;
+
+        public string Phase => this.phase;
+        public string Package => this.package;
+        public string Version => this.version;
+        public long Bytes => this.bytes;
+        public long? Total => this.total;
+        public int Files => this.files;
+        public int? TotalFiles => this.totalFiles;
+
+        // Returns null unless --progress=json was specified or a display is showing progress, so that callers report through progress?.
+        public static Progress Start(string phase, UniversalPackageId id, UniversalPackageVersion version, long? total = null, int? totalFiles = null)
+        {
+            if (!Active)
+                return null;
+
+            var progress = new Progress(phase, id?.ToString(), version?.ToString(), total, totalFiles);
+            progress.Write("start");
+            Display?.Update(progress, false);
+            return progress;
+        }
+
+        // Segments of a download report from several threads at once.
+        public void Add(long count, int completedFiles = 0)
+        {
+            lock (this.sinceReport)
+            {
+                this.bytes += count;
+                this.files += completedFiles;
+                Display?.Update(this, false);
+                this.ReportIfDue();
+            }
+        }
+
+        // An upload that is retried starts again from the beginning.
+        public void Reset(long position)
+        {
+            lock (this.sinceReport)
+            {
+                this.bytes = position;
+                Display?.Update(this, false);
+                this.ReportIfDue();
+            }
+        }
+
+        public void Finish()
+        {
+            lock (this.sinceReport)
+            {
+                Display?.Update(this, true);
+                this.Write("finish");
+            }
+        }
+
+        private void ReportIfDue()
+        {
+            if (this.sinceReport.Elapsed < Interval)
+                return;
+
+            this.Write("progress");
+            this.sinceReport.Restart();
+        }
+
+        private void Write(string name)
+        {
+            if (!Enabled)
+                return;
+
+            var entry = new JObject
+            {
+                ["event"] = name,
+                ["phase"] = this.phase,
+                ["package"] = this.package,
+                ["version"] = this.version,
+                ["bytes"] = this.bytes
+            };
+
+            if (this.total.HasValue)
+                entry["total"] = this.total.Value;
+
+            if (this.totalFiles.HasValue)
+            {
+                entry["files"] = this.files;
+                entry["totalFiles"] = this.totalFiles.Value;
+            }
+
+            lock (WriteLock)
+            {
+                Console.Error.WriteLine(entry.ToString(Formatting.None));
+            }
+        }
+    }
+}
@@ -0,0 +1,300 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Diagnostics;
+using System.IO;
+using System.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // The progress of install --with-dependencies: a row for each of the most recent packages downloaded or extracted, and an
+    // overall row with the time remaining estimated from the throughput so far. On a console the rows are redrawn in place below
+    // the other messages; when output is redirected, the overall progress is written as a line each time a package finishes.
+    internal sealed class ProgressDisplay : IDisposable
+    {
+        private const int MaxPackageRows = 8;
+        private static readonly TimeSpan Interval = TimeSpan.FromMilliseconds(250);
+
+        private readonly object sync = new object();
+        private readonly List<Row> rows = new List<Row>();
+        private readonly Stopwatch sinceDraw = Stopwatch.StartNew();
+        private readonly Stopwatch phaseTime = Stopwatch.StartNew();
+        private bool interactive;
+        private bool extracting;
+        private int queued;
+        private int finishedPackages;
+        private long finishedBytes;
+        private int totalPackages;
+        private int finishedFiles;
+        private int totalFiles;
+        private int drawnLines;
+
+        private ProgressDisplay(bool interactive)
+        {
+            this.interactive = interactive;
+        }
+
+        // Returns null with --quiet or --progress=json; interactive is whether standard output is a console that can be redrawn.
+        public static ProgressDisplay Start(bool interactive)
+        {
+            if (Log.Verbosity < Verbosity.Normal || Progress.Enabled)
+                return null;
+
+            // the files listed by --verbose would scroll the rows away as fast as they are drawn
+            var display = new ProgressDisplay(interactive && Log.Verbosity == Verbosity.Normal);
+            Progress.Display = display;
+            if (display.interactive)
+                Log.BeforeConsoleWrite = display.Clear;
+
+            return display;
+        }
+
+        // The number of dependencies that are still to be resolved, for the estimate of the time remaining.
+        public void SetQueued(int count)
+        {
+            lock (this.sync)
+            {
+                this.queued = count;
+            }
+        }
+
+        // Switches the overall row from downloading to extracting, once every package in the closure is known.
+        public void BeginExtraction(int packages, int files)
+        {
+            lock (this.sync)
+            {
+                this.extracting = true;
+                this.rows.Clear();
+                this.finishedPackages = 0;
+                this.totalPackages = packages;
+                this.finishedFiles = 0;
+                this.totalFiles = files;
+                this.phaseTime.Restart();
+            }
+        }
+
+        internal void Update(Progress progress, bool finished)
+        {
+            lock (this.sync)
+            {
+                var row = this.rows.FirstOrDefault(r => r.Progress == progress);
+                if (row == null)
+                {
+                    row = new Row(progress);
+                    this.rows.Add(row);
+
+                    var oldest = this.rows.FirstOrDefault(r => r.Finished);
+                    if (this.rows.Count > MaxPackageRows && oldest != null)
+                        this.rows.Remove(oldest);
+                }
+
+                if (finished && !row.Finished)
+                {
+                    row.Finished = true;
+                    row.Elapsed.Stop();
+                    this.finishedPackages++;
+                    this.finishedBytes += progress.Bytes;
+                    this.finishedFiles += progress.Files;
+
+                    if (!this.interactive)
+                        Log.Info(this.DescribeOverall() + ".");
+                }
+
+                if (this.interactive && (finished || this.drawnLines == 0 || this.sinceDraw.Elapsed >= Interval))
+                    this.Draw();
+            }
+        }
+
+        // Removes the rows from the console, so that another message can be written where they were; they are drawn again below
+        // it with the next update.
+        public void Clear()
+        {
+            lock (this.sync)
+            {
+                if (!this.interactive || this.drawnLines == 0)
+                    return;
+
+                try
+                {
+                    int width = GetWidth();
+                    this.MoveToTop();
+                    for (int i = 0; i < this.drawnLines; i++)
+                        Console.Out.WriteLine(new string(' ', width));
+
+                    this.MoveToTop();
+                    this.drawnLines = 0;
+                }
+                catch (IOException)
+                {
+                    this.StopDrawing();
+                }
+            }
+        }
+
+        // The final state of the rows is left on the console.
+        public void Dispose()
+        {
+            lock (this.sync)
+            {
+                if (this.interactive)
+                {
+                    this.Draw();
+                    this.drawnLines = 0;
+                }
+
+                Progress.Display = null;
+                Log.BeforeConsoleWrite = null;
+            }
+        }
+
+        private void Draw()
+        {
+            var lines = this.rows.Select(r => "  " + Describe(r)).Concat(new[] { this.DescribeOverall() }).ToList();
+            try
+            {
+                int width = GetWidth();
+                this.MoveToTop();
+                foreach (var line in lines)
+                    Console.Out.WriteLine(line.Length > width ? line.Substring(0, width) : line.PadRight(width));
+
+                // a shorter display leaves blank lines below it
+                for (int i = lines.Count; i < this.drawnLines; i++)
+                    Console.Out.WriteLine(new string(' ', width));
+
+                if (this.drawnLines > lines.Count)
+                    Console.SetCursorPosition(0, Console.CursorTop - (this.drawnLines - lines.Count));
+
+                this.drawnLines = lines.Count;
+                this.sinceDraw.Restart();
+            }
+            catch (Exception ex) when (ex is IOException || ex is ArgumentOutOfRangeException)
+            {
+                this.StopDrawing();
+            }
+        }
+
+        // A console that cannot move the cursor gets lines instead.
+        private void StopDrawing()
+        {
+            this.interactive = false;
+            this.drawnLines = 0;
+            Log.BeforeConsoleWrite = null;
+        }
+
+        private void MoveToTop()
+        {
+            if (this.drawnLines > 0)
+                Console.SetCursorPosition(0, Math.Max(Console.CursorTop - this.drawnLines, 0));
+        }
+
+        private string DescribeOverall()
+        {
+            var elapsed = this.phaseTime.Elapsed.TotalSeconds;
+            var active = this.rows.Where(r => !r.Finished).Select(r => r.Progress).ToList();
+
+            if (this.extracting)
+            {
+                int files = this.finishedFiles + active.Sum(p => p.Files);
+                var text = $"Extracted {this.finishedPackages} of {this.totalPackages} packages ({files} of {this.totalFiles} files, {Percent(files, this.totalFiles)})";
+                if (files > 0 && files < this.totalFiles && elapsed > 0)
+                    text += FormatRemaining(this.totalFiles - files, files / elapsed);
+
+                return text;
+            }
+
+            long bytes = this.finishedBytes + active.Sum(p => p.Bytes);
+            var overall = $"Downloaded {this.finishedPackages} package{(this.finishedPackages == 1 ? string.Empty : "s")} ({FormatSize(bytes)}";
+            if (bytes > 0 && elapsed > 0)
+                overall += $" at {FormatSize((long)(bytes / elapsed))}/s";
+
+            overall += ")";
+            if (this.queued > 0)
+                overall += $", {this.queued} more to resolve";
+
+            // each dependency that is still to be resolved is assumed to be the average size of those downloaded so far
+            if (this.finishedPackages > 0 && bytes > 0 && elapsed > 0)
+            {
+                double remaining = this.queued * ((double)this.finishedBytes / this.finishedPackages)
+                    + active.Where(p => p.Total.HasValue).Sum(p => Math.Max(p.Total.Value - p.Bytes, 0));
+                if (remaining > 0)
+                    overall += FormatRemaining(remaining, bytes / elapsed);
+            }
+
+            return overall;
+        }
+
+        private static string Describe(Row row)
+        {
+            var progress = row.Progress;
+            var name = $"{progress.Package} {progress.Version}";
+            var elapsed = row.Elapsed.Elapsed;
+
+            if (progress.TotalFiles.HasValue)
+            {
+                if (row.Finished)
+                    return $"{name}  extracted {progress.Files} files in {FormatDuration(elapsed)}";
+
+                return $"{name}  extracting {progress.Files} of {progress.TotalFiles} files ({Percent(progress.Files, progress.TotalFiles.Value)})";
+            }
+
+            if (row.Finished)
+                return $"{name}  {progress.Phase}ed {FormatSize(progress.Bytes)} in {FormatDuration(elapsed)}";
+
+            if (!progress.Total.HasValue)
+                return $"{name}  {progress.Phase}ing {FormatSize(progress.Bytes)}";
+
+            var text = $"{name}  {progress.Phase}ing {FormatSize(progress.Bytes)} of {FormatSize(progress.Total.Value)} ({Percent(progress.Bytes, progress.Total.Value)})";
+            if (progress.Bytes > 0 && elapsed.TotalSeconds > 0)
+                text += FormatRemaining(progress.Total.Value - progress.Bytes, progress.Bytes / elapsed.TotalSeconds);
+
+            return text;
+        }
+
+        private static int GetWidth()
+        {
+            // writing to the last column would wrap onto the next line on some consoles
+            return Math.Max(Console.WindowWidth - 1, 20);
+        }
+
+        private static string Percent(long value, long total) => total <= 0 ? "100%" : ((double)value / total).ToString("P0");
+
+        private static string FormatSize(long bytes)
+        {
+            if (bytes < 1024)
+                return bytes + " B";
+            if (bytes < 1024 * 1024)
+                return (bytes / 1024.0).ToString("0.0") + " KB";
+            if (bytes < 1024L * 1024 * 1024)
+                return (bytes / (1024.0 * 1024)).ToString("0.0") + " MB";
+
+            return (bytes / (1024.0 * 1024 * 1024)).ToString("0.00") + " GB";
+        }
+
+        // perSecond is the throughput measured so far, in the same unit as remaining; the estimate is capped at 99 hours.
+        private static string FormatRemaining(double remaining, double perSecond)
+        {
+            return ", about " + FormatDuration(TimeSpan.FromSeconds(Math.Min(remaining / perSecond, 99 * 3600))) + " remaining";
+        }
+
+        private static string FormatDuration(TimeSpan duration)
+        {
+            if (duration.TotalHours >= 1)
+                return $"{(int)duration.TotalHours}h {duration.Minutes}m";
+            if (duration.TotalMinutes >= 1)
+                return $"{duration.Minutes}m {duration.Seconds}s";
+
+            return $"{Math.Max(duration.Seconds, 1)}s";
+        }
+
+        private sealed class Row
+        {
+            public Row(Progress progress)
+            {
+                this.Progress = progress;
+            }
+
+            public Progress Progress { get; }
+            public Stopwatch Elapsed { get; } = Stopwatch.StartNew();
+            public bool Finished { get; set; }
+        }
+    }
+}
@@ -0,0 +1,67 @@
+﻿using System;
+using System.IO;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    // Reports the bytes read from a stream, such as a package that is being downloaded or uploaded, to a Progress.
+    internal sealed class ProgressStream : Stream
+    {
+        private readonly Stream inner;
+        private readonly Progress progress;
+
+        public ProgressStream(Stream inner, Progress progress)
+        {
+            this.inner = inner;
+            this.progress = progress;
+        }
+
+        public override bool CanRead => this.inner.CanRead;
+        public override bool CanSeek => this.inner.CanSeek;
+        public override bool CanWrite => false;
+        public override long Length => this.inner.Length;
+        public override long Position
+        {
+            get => this.inner.Position;
+            set
+            {
+                this.inner.Position = value;
+                this.progress.Reset(value);
+            }
+        }
+
+        public override int Read(byte[] buffer, int offset, int count)
+        {
+            int read = this.inner.Read(buffer, offset, count);
+            this.progress.Add(read);
+            return read;
+        }
+
+        public override async Task<int> ReadAsync(byte[] buffer, int offset, int count, CancellationToken cancellationToken)
+        {
+            int read = await this.inner.ReadAsync(buffer, offset, count, cancellationToken);
+            this.progress.Add(read);
+            return read;
+        }
+
+        public override long Seek(long offset, SeekOrigin origin)
+        {
+            long position = this.inner.Seek(offset, origin);
+            this.progress.Reset(position);
+            return position;
+        }
+
+        public override void Flush() => this.inner.Flush();
+        public override void SetLength(long value) => throw new NotSupportedException();
+        public override void Write(byte[] buffer, int offset, int count) => throw new NotSupportedException();
+
+        protected override void Dispose(bool disposing)
+        {
+            if (disposing)
+                this.inner.Dispose();
+
+            base.Dispose(disposing);
+        }
+    }
+}
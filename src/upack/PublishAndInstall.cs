@@ -0,0 +1,184 @@
+﻿using System;
+using System.ComponentModel;
+using System.Net;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("publish-and-install")]
+    [Description("Pushes a universal package to the specified feed, then installs the pushed version from the feed and registers it.")]
+    public sealed class PublishAndInstall : FeedCommand
+    {
+        [DisplayName("package")]
+        [Description("Path of a valid .upack file.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string Package { get; set; }
+
+        [DisplayName("source")]
+        [Description("URL of a upack API endpoint.")]
+        [ExtraArgument(Optional = false)]
+        [UseEnvironmentVariableAsDefault("UPACK_FEED")]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("target")]
+        [Description("Directory where the contents of the package will be extracted.")]
+        [ExtraArgument(Optional = false)]
+        [ExpandPath]
+        public string TargetDirectory { get; set; }
+
+        [DisplayName("user")]
+        [Description("User name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("overwrite")]
+        [Description("When specified, overwrite files in the target directory.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Overwrite { get; set; } = false;
+
+        [DisplayName("comment")]
+        [Description("The reason for installing the package, for the local registry.")]
+        [ExtraArgument]
+        public string Comment { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("Register the package in the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("lock-timeout")]
+        [Description("Number of seconds to wait for another process to release the registry lock before failing. If not specified, waits indefinitely.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_LOCK_TIMEOUT")]
+        public string LockTimeout { get; set; }
+
+        [DisplayName("lock-poll-interval")]
+        [Description("Number of seconds to wait between attempts to acquire the registry lock; the default is 0.5.")]
+        [ExtraArgument]
+        public string LockPollInterval { get; set; }
+
+        [DisplayName("ignore-platform")]
+        [Description("Install the package even if its manifest lists operating systems or architectures that do not include this machine.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool IgnorePlatform { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            // Check everything that could make the install fail before the package is pushed, so that a failure
+            // never leaves a published package that was not installed.
+            UniversalPackageMetadata info;
+            try
+            {
+                using (var package = new UniversalPackage(this.Package))
+                {
+                    info = package.GetFullMetadata().Clone();
+
+                    this.Overwrite = ConfirmOverwrite(package, this.TargetDirectory, null, this.Overwrite);
+                }
+            }
+            catch (Exception ex) when (!(ex is UpackException))
+            {
+                throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                {
+                    Code = ErrorCodes.InvalidPackage,
+                    Location = this.Package
+                };
+            }
+
+            var error = ValidateManifest(info);
+            if (error != null)
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid upack.json: {error}");
+
+            var id = new UniversalPackageId(info.Group, info.Name);
+            if (!this.IgnorePlatform)
+            {
+                var problem = Platform.CheckCompatible(info);
+                if (problem != null)
+                    throw new UpackException(ExitCode.ValidationFailed, $"{id} {info.Version} {problem}; use --ignore-platform to publish and install it anyway.")
+                    {
+                        Code = ErrorCodes.IncompatiblePlatform
+                    };
+            }
+
+            var pin = PackagePin.TryRead(this.TargetDirectory);
+            if (pin != null && (!pin.IsFor(id) || VersionRange.TryParse(pin.Version)?.IsMatch(info.Version, true) == false))
+                throw new UpackException(ExitCode.Conflict, $"{this.TargetDirectory} is pinned to {pin}, which does not allow {id} {info.Version}.")
+                {
+                    Code = ErrorCodes.Pinned,
+                    Hint = "Change the pin with upack hold, or release it with upack hold --release."
+                };
+
+            var push = new Push
+            {
+                Package = this.Package,
+                Target = this.SourceUrl,
+                Authentication = this.Authentication,
+                ApiKey = this.ApiKey,
+                Clock = this.Clock
+            };
+
+            int result = await push.RunAsync(cancellationToken);
+            if (result != 0)
+                return result;
+
+            var install = new Install
+            {
+                PackageName = (string.IsNullOrEmpty(info.Group) ? string.Empty : info.Group + "/") + info.Name,
+                Version = info.Version.ToString(),
+                SourceUrls = new[] { this.SourceUrl },
+                TargetDirectory = this.TargetDirectory,
+                Authentication = this.Authentication,
+                ApiKey = this.ApiKey,
+                Overwrite = this.Overwrite,
+                Comment = this.Comment,
+                UserRegistry = this.UserRegistry,
+                ProjectRegistry = this.ProjectRegistry,
+                RegistryPath = this.RegistryPath,
+                LockTimeout = this.LockTimeout,
+                LockPollInterval = this.LockPollInterval,
+                IgnorePlatform = this.IgnorePlatform,
+                Clock = this.Clock
+            };
+
+            try
+            {
+                return await install.RunAsync(cancellationToken);
+            }
+            catch (UpackException ex)
+            {
+                throw new UpackException(ex.ExitCode, $"{id} {info.Version} was published, but could not be installed: {ex.Message}", ex)
+                {
+                    Code = ex.Code,
+                    Location = ex.Location,
+                    Hint = ex.Hint
+                };
+            }
+        }
+    }
+}
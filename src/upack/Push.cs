@@ -4,13 +4,15 @@ using System.IO;
 using System.Net;
 using System.Threading;
 using System.Threading.Tasks;
+using Inedo.UPack.Net;
 using Inedo.UPack.Packaging;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("push")]
     [Description("Pushes a universal package to the specified feed.")]
-    public sealed class Push : Command
+    public sealed class Push : FeedCommand
     {
         [DisplayName("package")]
         [Description("Path of a valid .upack file.")]
@@ -30,53 +32,107 @@ namespace Inedo.UPack.CLI
         [UseEnvironmentVariableAsDefault("UPACK_USER")]
         public NetworkCredential Authentication { get; set; }
 
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("strict")]
+        [Description("Also check the types of all known upack.json properties against the embedded JSON schema, and reject unknown properties with names similar to known ones.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Strict { get; set; } = false;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
-            using (var packageStream = new FileStream(this.Package, FileMode.Open, FileAccess.Read, FileShare.Read, 4096, FileOptions.Asynchronous))
-            {
-                UniversalPackageMetadata info;
+            // the metadata is read from its own stream, which is closed before the upload opens the file again
+            UniversalPackageMetadata info;
 
-                try
+            try
+            {
+                using (var package = new UniversalPackage(this.Package))
                 {
-                    using (var package = new UniversalPackage(packageStream, true))
-                    {
-                        info = package.GetFullMetadata();
-                    }
+                    info = package.GetFullMetadata();
                 }
-                catch (Exception ex)
+            }
+            catch (Exception ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
                 {
-                    throw new UpackException("The specified file is not a valid universal package: " + ex.Message, ex);
-                }
+                    Code = ErrorCodes.InvalidPackage,
+                    Location = this.Package
+                };
+            }
 
-                var error = ValidateManifest(info);
-                if (error != null)
+            var error = ValidateManifest(info);
+            if (error != null)
+                throw new UpackException(ExitCode.ValidationFailed, $"Invalid upack.json: {error}")
                 {
-                    Console.Error.WriteLine("Invalid upack.json: {0}", error);
-                    return 2;
-                }
+                    Code = ErrorCodes.InvalidManifest,
+                    Location = this.Package
+                };
 
-                packageStream.Position = 0;
+            if (this.Strict)
+                CheckManifestSchema(info);
 
-                var client = CreateClient(this.Target, this.Authentication);
+            // HTTP feeds are uploaded to directly, so that the file is streamed; other sources go through the feed client
+            bool http = Uri.TryCreate(this.Target, UriKind.Absolute, out var targetUri) && (targetUri.Scheme == Uri.UriSchemeHttp || targetUri.Scheme == Uri.UriSchemeHttps);
+            var client = http ? null : CreateClient(this.Target, this.Authentication, this.ApiKey);
+            var credentials = http ? ResolveCredentials(this.Target, this.Authentication, this.ApiKey) : null;
 
-                PrintManifest(info);
+            PrintManifest(info);
 
-                try
-                {
-                    await client.UploadPackageAsync(packageStream, cancellationToken);
-                }
-                catch (WebException ex)
-                {
-                    throw ConvertWebException(ex);
-                }
+            long size = new FileInfo(this.Package).Length;
+            var progress = Progress.Start("upload", new UniversalPackageId(info.Group, info.Name), info.Version, size);
+
+            try
+            {
+                // a retried upload starts again from the beginning of the file
+                await FeedHttp.SendAsync(
+                    () => http
+                        ? PackageUpload.UploadAsync(this.Target, credentials, this.Package, progress, cancellationToken)
+                        : this.UploadWithClientAsync(client, progress, cancellationToken),
+                    cancellationToken
+                );
+            }
+            catch (WebException ex)
+            {
+                throw ConvertWebException(ex);
+            }
+
+            progress?.Finish();
+
+            if (!string.IsNullOrEmpty(info.Group))
+                Log.Success($"{info.Group}:{info.Name} {info.Version} published!");
+            else
+                Log.Success($"{info.Name} {info.Version} published!");
 
-                if (!string.IsNullOrEmpty(info.Group))
-                    Console.WriteLine($"{info.Group}:{info.Name} {info.Version} published!");
-                else
-                    Console.WriteLine($"{info.Name} {info.Version} published!");
+            if (JsonOutput)
+            {
+                WriteResult(
+                    new JObject
+                    {
+                        ["group"] = info.Group,
+                        ["name"] = info.Name,
+                        ["version"] = info.Version?.ToString(),
+                        ["target"] = this.Target,
+                        ["sha1"] = GetSHA1(this.Package).ToString(),
+                        ["size"] = size
+                    }
+                );
             }
 
             return 0;
         }
+
+        private async Task UploadWithClientAsync(UniversalFeedClient client, Progress progress, CancellationToken cancellationToken)
+        {
+            using (var file = new FileStream(this.Package, FileMode.Open, FileAccess.Read, FileShare.Read, 4096, FileOptions.Asynchronous))
+            {
+                progress?.Reset(0);
+                await client.UploadPackageAsync(progress != null ? new ProgressStream(file, progress) : (Stream)file, cancellationToken);
+            }
+        }
     }
 }
@@ -0,0 +1,238 @@
+﻿using System;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Net;
+using Inedo.UPack.Packaging;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("readme")]
+    [Description("Displays the README file included in a local .upack file, a package in the package cache, or a remote universal package.")]
+    public sealed class Readme : FeedCommand
+    {
+        // Conventional names, in order of preference, of a README at the archive root or the top of the package contents.
+        internal static readonly string[] FileNames = { "README.md", "README.txt", "README", "readme.md", "Readme.md", "readme.txt" };
+
+        [DisplayName("package")]
+        [Description("Package name and group, such as group/name, or the path of a local .upack file.")]
+        [PositionalArgument(0)]
+        public string PackageName { get; set; }
+
+        [DisplayName("version")]
+        [Description("Package version, a version range, or latest, latest-stable, or latest-prerelease. If not specified, the latest version is retrieved.")]
+        [PositionalArgument(1, Optional = true)]
+        public string Version { get; set; }
+
+        [DisplayName("source")]
+        [Description("URL of a upack API endpoint. If not specified, the README is read from the package cache of the local registry.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_FEED")]
+        public string SourceUrl { get; set; }
+
+        [DisplayName("user")]
+        [Description("User name and password to use for servers that require authentication. Example: \"«username»:«password»\" or \"api:«api-key»\"")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_USER")]
+        public NetworkCredential Authentication { get; set; }
+
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("infer-group")]
+        [Description("When the package name does not include a group, use the group that follows the feed name in the source URL, such as https://proget/upack/Feed/«group».")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_INFER_GROUP")]
+        public bool InferGroup { get; set; } = false;
+
+        [DisplayName("userregistry")]
+        [Description("Read the package cache of the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Read the package cache of the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry whose package cache to read instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var localPath = Path.Combine(Environment.CurrentDirectory, this.PackageName ?? string.Empty);
+            if (this.PackageName != null && (this.PackageName.EndsWith(".upack", StringComparison.OrdinalIgnoreCase) || File.Exists(localPath)))
+            {
+                localPath = Path.GetFullPath(localPath);
+                if (!File.Exists(localPath))
+                    throw new UpackException(ExitCode.NotFound, $"The package file '{localPath}' does not exist.")
+                    {
+                        Code = ErrorCodes.FileNotFound
+                    };
+
+                string localText;
+                try
+                {
+                    using (var package = new UniversalPackage(localPath))
+                    {
+                        localText = ReadFromPackage(package, DefaultContentRoot);
+                    }
+                }
+                catch (Exception ex) when (ex is InvalidDataException || ex is IOException)
+                {
+                    throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                    {
+                        Code = ErrorCodes.InvalidPackage,
+                        Location = localPath
+                    };
+                }
+
+                if (localText == null)
+                    throw new UpackException(ExitCode.NotFound, $"{localPath} does not include a README.");
+
+                Console.WriteLine(localText.TrimEnd());
+                return 0;
+            }
+
+            var sourceUrl = this.SourceUrl;
+            var inferredGroup = this.InferGroup && !string.IsNullOrEmpty(sourceUrl) ? InferGroupFromSource(ref sourceUrl) : null;
+
+            UniversalPackageId packageId;
+            try
+            {
+                packageId = UniversalPackageId.Parse(this.PackageName);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            if (string.IsNullOrEmpty(packageId.Group) && !string.IsNullOrEmpty(inferredGroup))
+                packageId = new UniversalPackageId(inferredGroup, packageId.Name);
+
+            string text;
+            UniversalPackageVersion version;
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+            {
+                UniversalFeedClient client = null;
+                if (string.IsNullOrEmpty(sourceUrl))
+                {
+                    version = this.GetCachedVersion(registry, packageId, this.Version, false);
+                }
+                else
+                {
+                    client = CreateClient(sourceUrl, this.Authentication, this.ApiKey);
+                    version = await this.GetVersionAsync(client, packageId, this.Version, false, false, cancellationToken);
+                }
+
+                // a cached copy avoids any further requests to the feed
+                using (var cached = await registry.TryOpenFromCacheAsync(packageId, version, cancellationToken))
+                {
+                    if (cached != null)
+                    {
+                        using (var package = new UniversalPackage(cached))
+                        {
+                            text = ReadFromPackage(package, DefaultContentRoot);
+                        }
+                    }
+                    else if (client != null)
+                    {
+                        text = await ReadFromFeedAsync(client, packageId, version, cancellationToken);
+                    }
+                    else
+                    {
+                        throw new UpackException(ExitCode.NotFound, $"{packageId} {version} is not in the package cache of {registry.RegistryRoot}.")
+                        {
+                            Code = ErrorCodes.NotInCache
+                        };
+                    }
+                }
+            }
+
+            if (text == null)
+                throw new UpackException(ExitCode.NotFound, $"{packageId} {version} does not include a README.");
+
+            Console.WriteLine(text.TrimEnd());
+            return 0;
+        }
+
+        // Returns the text of the README embedded at the archive root by pack --readme, or else the one at the top of the package
+        // contents, or null if there is neither.
+        internal static string ReadFromPackage(UniversalPackage package, string root)
+        {
+            var files = package.Entries.Where(e => !e.IsDirectory).ToList();
+
+            var embedded = files
+                .Select(e => new { Entry = e, Path = e.RawPath.Replace('\\', '/') })
+                .ToList();
+
+            var contents = files
+                .Select(e => new { Entry = e, Path = GetContentPath(e, root) })
+                .Where(e => e.Path != null && e.Path.IndexOf('/') < 0)
+                .ToList();
+
+            foreach (var candidates in new[] { embedded, contents })
+            {
+                foreach (var name in FileNames)
+                {
+                    var match = candidates.FirstOrDefault(e => string.Equals(e.Path, name, StringComparison.Ordinal));
+                    if (match != null)
+                    {
+                        using (var stream = match.Entry.Open())
+                        using (var reader = new StreamReader(stream, Encoding.UTF8, true))
+                        {
+                            return reader.ReadToEnd();
+                        }
+                    }
+                }
+            }
+
+            return null;
+        }
+
+        // Requests each conventional README name from the feed, at the archive root and then in the package contents, so that the
+        // package itself does not need to be downloaded.
+        internal static async Task<string> ReadFromFeedAsync(UniversalFeedClient client, UniversalPackageId packageId, UniversalPackageVersion version, CancellationToken cancellationToken)
+        {
+            foreach (var name in FileNames.Concat(FileNames.Select(n => DefaultContentRoot + n)))
+            {
+                try
+                {
+                    using (var stream = await FeedHttp.SendAsync(() => client.GetPackageFileStreamAsync(packageId, version, name, cancellationToken), cancellationToken))
+                    {
+                        if (stream == null)
+                            continue;
+
+                        using (var reader = new StreamReader(stream, Encoding.UTF8, true))
+                        {
+                            return await reader.ReadToEndAsync();
+                        }
+                    }
+                }
+                catch (WebException ex) when ((ex.Response as HttpWebResponse)?.StatusCode == HttpStatusCode.NotFound)
+                {
+                }
+                catch (WebException ex)
+                {
+                    throw ConvertWebException(ex, PackageNotFoundMessage);
+                }
+            }
+
+            return null;
+        }
+    }
+}
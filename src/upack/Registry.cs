@@ -0,0 +1,710 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Diagnostics;
+using System.IO;
+using System.Linq;
+using System.Text;
+using System.Text.RegularExpressions;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    // Reads and writes a local package registry (installedPackages.json and packageCache) in the universal package registry format.
+    public sealed class Registry : IDisposable
+    {
+        private static readonly TimeSpan DefaultLockPollInterval = TimeSpan.FromMilliseconds(500);
+        private const int JournalWriteAttempts = 5;
+        private static readonly TimeSpan JournalRetryDelay = TimeSpan.FromMilliseconds(50);
+        // the description that LockAsync writes to .lock
+        private static readonly Regex AbandonedLockRegex = new Regex(@"^Locked by .* using upack/[0-9.]+ \(process [0-9]+\) at ");
+
+        private FileStream lockStream;
+
+        public Registry(string registryRoot)
+        {
+            this.RegistryRoot = registryRoot ?? throw new ArgumentNullException(nameof(registryRoot));
+
+            var sharedBlobRoot = Environment.GetEnvironmentVariable("UPACK_CACHE_PATH");
+            this.SharesBlobs = !string.IsNullOrEmpty(sharedBlobRoot);
+            this.BlobRoot = this.SharesBlobs ? Path.GetFullPath(sharedBlobRoot) : Path.Combine(this.CacheRoot, "blobs");
+        }
+
+        public string RegistryRoot { get; }
+        // Cached packages are stored once per content, as blobs named by their SHA256 hash, and the index file
+        // packageCache/index/«group$name»/«version».sha256 records the hash of each cached version. The UPACK_CACHE_PATH environment
+        // variable moves the blobs to a directory that several registries share, so that a package cached by each of them is only
+        // stored once. Packages cached by earlier versions of upack, as packageCache/«group$name»/«name».«version».upack, are still read.
+        public string CacheRoot => Path.Combine(this.RegistryRoot, "packageCache");
+        public string BlobRoot { get; }
+        public bool SharesBlobs { get; }
+        // Name of the upack command using the registry, recorded in the journal.
+        public string Command { get; set; }
+        // If null, LockAsync waits until the lock is released.
+        public TimeSpan? LockTimeout { get; set; }
+        public TimeSpan LockPollInterval { get; set; } = DefaultLockPollInterval;
+        public IClock Clock { get; set; } = SystemClock.Instance;
+
+        private string InstalledPackagesPath => Path.Combine(this.RegistryRoot, "installedPackages.json");
+        private string JournalPath => Path.Combine(this.RegistryRoot, "journal.log");
+        // The lock is an exclusive handle on .lockhandle (opened with FileShare.None, which is a share mode on Windows and flock
+        // elsewhere), so it is released automatically if the process dies. The .lock file is also created, and describes the
+        // holder, since earlier versions of upack treat its existence as the lock.
+        private string LockDescriptionPath => Path.Combine(this.RegistryRoot, ".lock");
+        private string LockHandlePath => Path.Combine(this.RegistryRoot, ".lockhandle");
+
+        public static Registry GetRegistry(bool userRegistry)
+        {
+            // use the same locations as earlier versions of upack
+            using (var registry = PackageRegistry.GetRegistry(userRegistry))
+            {
+                return new Registry(registry.RegistryRoot);
+            }
+        }
+
+        // Finds the nearest .upack directory at or above the working directory, or uses «workingDirectory»/.upack if there is none.
+        public static Registry GetProjectRegistry(string workingDirectory)
+        {
+            var userRegistryRoot = GetRegistry(true).RegistryRoot;
+
+            for (var dir = new DirectoryInfo(workingDirectory); dir != null; dir = dir.Parent)
+            {
+                var root = Path.Combine(dir.FullName, ".upack");
+                if (Directory.Exists(root) && !string.Equals(Path.GetFullPath(root).TrimEnd(Path.DirectorySeparatorChar), Path.GetFullPath(userRegistryRoot).TrimEnd(Path.DirectorySeparatorChar), StringComparison.OrdinalIgnoreCase))
+                    return new Registry(root);
+            }
+
+            return new Registry(Path.Combine(workingDirectory, ".upack"));
+        }
+
+        public async Task LockAsync(CancellationToken cancellationToken)
+        {
+            if (this.lockStream != null)
+                throw new InvalidOperationException("The registry is already locked.");
+
+            Directory.CreateDirectory(this.RegistryRoot);
+
+            var stopwatch = Stopwatch.StartNew();
+            bool reportedWait = false;
+
+            async Task WaitAsync()
+            {
+                var remaining = this.LockTimeout - stopwatch.Elapsed;
+                if (remaining <= TimeSpan.Zero)
+                    throw new RegistryLockedException(this.RegistryRoot, this.GetLockDescription(), this.LockTimeout.Value);
+
+                if (!reportedWait)
+                {
+                    Log.Warning($"Waiting for registry lock ({this.GetLockDescription() ?? "unknown holder"})...");
+                    reportedWait = true;
+                }
+
+                await Task.Delay(remaining < this.LockPollInterval ? remaining.Value : this.LockPollInterval, cancellationToken);
+            }
+
+            while (!this.TryLockHandle())
+                await WaitAsync();
+
+            try
+            {
+                while (!this.TryCreateLockFile())
+                    await WaitAsync();
+            }
+            catch
+            {
+                this.lockStream.Dispose();
+                this.lockStream = null;
+                throw;
+            }
+        }
+
+        // Returns false if another process has the handle lock.
+        private bool TryLockHandle()
+        {
+            try
+            {
+                this.lockStream = new FileStream(this.LockHandlePath, FileMode.OpenOrCreate, FileAccess.ReadWrite, FileShare.None);
+                return true;
+            }
+            catch (UnauthorizedAccessException ex)
+            {
+                throw new UpackException($"Access to the registry at {this.RegistryRoot} was denied.", ex);
+            }
+            catch (IOException ex) when (IsSharingViolation(ex))
+            {
+                return false;
+            }
+            catch (IOException ex)
+            {
+                throw new UpackException($"Unable to lock the registry at {this.RegistryRoot}: {ex.Message}", ex);
+            }
+        }
+
+        // Returns false if another process holds the legacy lock, which is the existence of the .lock file. Earlier versions of
+        // upack and other users of Inedo.UPack's PackageRegistry only honor that, so it is taken in addition to the handle lock.
+        private bool TryCreateLockFile()
+        {
+            try
+            {
+                using (var stream = new FileStream(this.LockDescriptionPath, FileMode.CreateNew, FileAccess.Write, FileShare.None))
+                using (var writer = new StreamWriter(stream, new UTF8Encoding(false)))
+                {
+                    writer.Write($"Locked by {Environment.UserName} using upack/{typeof(Registry).Assembly.GetName().Version} (process {Process.GetCurrentProcess().Id}) at {this.Clock.Now:o}");
+                }
+
+                return true;
+            }
+            catch (IOException) when (File.Exists(this.LockDescriptionPath))
+            {
+                // this process has the handle lock, so a .lock written by a process that also takes the handle lock was
+                // left behind when that process died
+                var description = this.GetLockDescription();
+                if (description != null && AbandonedLockRegex.IsMatch(description))
+                {
+                    try
+                    {
+                        File.Delete(this.LockDescriptionPath);
+                    }
+                    catch (IOException)
+                    {
+                    }
+                    catch (UnauthorizedAccessException)
+                    {
+                    }
+                }
+
+                return false;
+            }
+            catch (UnauthorizedAccessException ex)
+            {
+                throw new UpackException($"Access to the registry at {this.RegistryRoot} was denied.", ex);
+            }
+            catch (IOException ex)
+            {
+                throw new UpackException($"Unable to lock the registry at {this.RegistryRoot}: {ex.Message}", ex);
+            }
+        }
+
+        // ERROR_SHARING_VIOLATION and ERROR_LOCK_VIOLATION on Windows, and EWOULDBLOCK from flock on Linux and macOS; anything
+        // else, such as a full disk or a read-only file system, will not go away by waiting.
+        private static bool IsSharingViolation(IOException ex)
+        {
+            if (ex is FileNotFoundException || ex is DirectoryNotFoundException || ex is PathTooLongException)
+                return false;
+
+            if (Environment.OSVersion.Platform == PlatformID.Win32NT)
+            {
+                int code = ex.HResult & 0xFFFF;
+                return code == 32 || code == 33;
+            }
+
+            return ex.HResult == 11 || ex.HResult == 35;
+        }
+
+        public Task UnlockAsync()
+        {
+            this.Unlock();
+            return Task.FromResult<object>(null);
+        }
+
+        // Does not require the lock; writers replace installedPackages.json atomically, so readers always see a complete file.
+        public async Task<IReadOnlyList<InstalledPackage>> GetInstalledPackagesAsync()
+        {
+            if (!File.Exists(this.InstalledPackagesPath))
+                return new InstalledPackage[0];
+
+            string text;
+            try
+            {
+                using (var reader = new StreamReader(new FileStream(this.InstalledPackagesPath, FileMode.Open, FileAccess.Read, FileShare.ReadWrite | FileShare.Delete), Encoding.UTF8))
+                {
+                    text = await reader.ReadToEndAsync();
+                }
+            }
+            catch (FileNotFoundException)
+            {
+                return new InstalledPackage[0];
+            }
+
+            try
+            {
+                return JsonConvert.DeserializeObject<List<InstalledPackage>>(text) ?? new List<InstalledPackage>();
+            }
+            catch (JsonException ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, $"The registry file {this.InstalledPackagesPath} is not valid: {ex.Message}", ex)
+                {
+                    Code = ErrorCodes.InvalidStateFile,
+                    Hint = "Check the registry with upack registry repair."
+                };
+            }
+        }
+
+        public async Task RegisterPackageAsync(InstalledPackage package, CancellationToken cancellationToken)
+        {
+            this.EnsureLocked();
+
+            var packages = (await this.GetInstalledPackagesAsync()).ToList();
+            packages.RemoveAll(p => IsSamePackage(p, package) && string.Equals(p.InstallPath, package.InstallPath, StringComparison.OrdinalIgnoreCase));
+            packages.Add(package);
+
+            await this.WriteInstalledPackagesAsync(packages, cancellationToken);
+            this.WriteJournal("register", package.Group, package.Name, package.Version, package.InstallPath);
+        }
+
+        public async Task<bool> UnregisterPackageAsync(InstalledPackage package, CancellationToken cancellationToken)
+        {
+            this.EnsureLocked();
+
+            var packages = (await this.GetInstalledPackagesAsync()).ToList();
+            int removed = packages.RemoveAll(
+                p => IsSamePackage(p, package)
+                    && string.Equals(p.Version, package.Version, StringComparison.OrdinalIgnoreCase)
+                    && (package.InstallPath == null || string.Equals(p.InstallPath, package.InstallPath, StringComparison.OrdinalIgnoreCase))
+            );
+
+            if (removed == 0)
+                return false;
+
+            await this.WriteInstalledPackagesAsync(packages, cancellationToken);
+            this.WriteJournal("unregister", package.Group, package.Name, package.Version, package.InstallPath);
+            return true;
+        }
+
+        // Returns the blob or legacy .upack file of a cached package, or null if it is not in the cache.
+        public string GetCachedPackagePath(UniversalPackageId id, UniversalPackageVersion version)
+        {
+            var sha256 = this.GetCachedHash(id, version);
+            if (sha256 != null && File.Exists(this.GetBlobPath(sha256)))
+                return this.GetBlobPath(sha256);
+
+            var legacyPath = this.GetLegacyCachePath(id, version);
+            return File.Exists(legacyPath) ? legacyPath : null;
+        }
+
+        // Returns the SHA256 hash that the index records for a cached package, or null if there is no index entry.
+        public string GetCachedHash(UniversalPackageId id, UniversalPackageVersion version)
+        {
+            return ReadIndexEntry(this.GetIndexPath(id, version));
+        }
+
+        public string GetBlobPath(string sha256) => Path.Combine(this.BlobRoot, sha256.ToLowerInvariant());
+
+        public IReadOnlyList<UniversalPackageVersion> GetCachedVersions(UniversalPackageId id)
+        {
+            var versions = new List<UniversalPackageVersion>();
+
+            var indexDirectory = Path.Combine(this.CacheRoot, "index", GetCacheDirectoryName(id));
+            if (Directory.Exists(indexDirectory))
+            {
+                versions.AddRange(
+                    Directory.EnumerateFiles(indexDirectory, "*.sha256")
+                        .Select(f => UniversalPackageVersion.TryParse(Path.GetFileNameWithoutExtension(f)))
+                        .Where(v => v != null)
+                );
+            }
+
+            var legacyDirectory = Path.Combine(this.CacheRoot, GetCacheDirectoryName(id));
+            if (Directory.Exists(legacyDirectory))
+            {
+                var prefix = id.Name + ".";
+                versions.AddRange(
+                    Directory.EnumerateFiles(legacyDirectory, "*.upack")
+                        .Select(Path.GetFileNameWithoutExtension)
+                        .Where(n => n.StartsWith(prefix, StringComparison.OrdinalIgnoreCase))
+                        .Select(n => UniversalPackageVersion.TryParse(n.Substring(prefix.Length)))
+                        .Where(v => v != null)
+                );
+            }
+
+            return versions.Distinct().ToList();
+        }
+
+        // Lists every index entry and legacy .upack file in the package cache, whether or not its blob still exists.
+        public IReadOnlyList<CachedPackage> GetCachedPackages()
+        {
+            var packages = new List<CachedPackage>();
+            if (!Directory.Exists(this.CacheRoot))
+                return packages;
+
+            var indexRoot = Path.Combine(this.CacheRoot, "index");
+            if (Directory.Exists(indexRoot))
+            {
+                foreach (var directory in Directory.EnumerateDirectories(indexRoot))
+                {
+                    var id = ParseCacheDirectoryName(Path.GetFileName(directory));
+                    if (id == null)
+                        continue;
+
+                    foreach (var file in Directory.EnumerateFiles(directory, "*.sha256"))
+                    {
+                        var version = UniversalPackageVersion.TryParse(Path.GetFileNameWithoutExtension(file));
+                        var sha256 = ReadIndexEntry(file);
+                        if (version != null && sha256 != null)
+                            packages.Add(new CachedPackage { Id = id, Version = version, SHA256 = sha256, Path = this.GetBlobPath(sha256) });
+                    }
+                }
+            }
+
+            foreach (var directory in Directory.EnumerateDirectories(this.CacheRoot, "*$*"))
+            {
+                var id = ParseCacheDirectoryName(Path.GetFileName(directory));
+                if (id == null)
+                    continue;
+
+                var prefix = id.Name + ".";
+                foreach (var file in Directory.EnumerateFiles(directory, "*.upack"))
+                {
+                    var fileName = Path.GetFileNameWithoutExtension(file);
+                    var version = fileName.StartsWith(prefix, StringComparison.OrdinalIgnoreCase) ? UniversalPackageVersion.TryParse(fileName.Substring(prefix.Length)) : null;
+                    if (version != null)
+                        packages.Add(new CachedPackage { Id = id, Version = version, Path = file });
+                }
+            }
+
+            return packages;
+        }
+
+        // Lists the blobs in the blob store, which with UPACK_CACHE_PATH may include blobs of other registries.
+        public IReadOnlyList<string> GetCacheBlobs()
+        {
+            if (!Directory.Exists(this.BlobRoot))
+                return new string[0];
+
+            return Directory.EnumerateFiles(this.BlobRoot)
+                .Where(f => IsSHA256(Path.GetFileName(f)))
+                .ToList();
+        }
+
+        // Removes the index entry or legacy file of a cached package; the blob is left for any other entries that share it.
+        public void RemoveFromCache(CachedPackage package)
+        {
+            File.Delete(package.SHA256 != null ? this.GetIndexPath(package.Id, package.Version) : package.Path);
+        }
+
+        public Task<Stream> TryOpenFromCacheAsync(UniversalPackageId id, UniversalPackageVersion version, CancellationToken cancellationToken)
+        {
+            var path = this.GetCachedPackagePath(id, version);
+            if (path == null)
+                return Task.FromResult<Stream>(null);
+
+            try
+            {
+                return Task.FromResult<Stream>(new FileStream(path, FileMode.Open, FileAccess.Read, FileShare.Read | FileShare.Delete, 4096, FileOptions.Asynchronous));
+            }
+            catch (FileNotFoundException)
+            {
+                // removed by registry repair since it was found
+                return Task.FromResult<Stream>(null);
+            }
+        }
+
+        // The registry lock is not required: a blob is written to a temporary file and renamed into place, and is never modified
+        // afterward, and an index entry is replaced in a single rename, so a concurrent reader sees either the old hash or the new one.
+        public async Task WriteToCacheAsync(UniversalPackageId id, UniversalPackageVersion version, Stream stream, CancellationToken cancellationToken)
+        {
+            // a download already knows its hash, so a package that is in the blob store is not written again
+            var sha256 = stream is HashedStream hashed ? hashed.SHA256.ToString() : null;
+            if (sha256 == null || !File.Exists(this.GetBlobPath(sha256)))
+                sha256 = await this.WriteBlobAsync(stream, cancellationToken);
+
+            var indexPath = this.GetIndexPath(id, version);
+            Directory.CreateDirectory(Path.GetDirectoryName(indexPath));
+            var tempPath = indexPath + "." + Guid.NewGuid().ToString("N") + ".tmp";
+            try
+            {
+                File.WriteAllText(tempPath, sha256);
+                MoveIntoPlace(tempPath, indexPath, true);
+            }
+            finally
+            {
+                File.Delete(tempPath);
+            }
+
+            this.WriteJournal("cache", id.Group, id.Name, version.ToString(), null);
+        }
+
+        // Returns the SHA256 hash of the blob; if another process stored the same blob first, this copy is discarded.
+        private async Task<string> WriteBlobAsync(Stream stream, CancellationToken cancellationToken)
+        {
+            Directory.CreateDirectory(this.BlobRoot);
+            var tempPath = Path.Combine(this.BlobRoot, Guid.NewGuid().ToString("N") + ".tmp");
+            try
+            {
+                string sha256;
+                using (var hash = System.Security.Cryptography.SHA256.Create())
+                using (var file = new FileStream(tempPath, FileMode.CreateNew, FileAccess.Write, FileShare.None, 4096, FileOptions.Asynchronous))
+                {
+                    var buffer = new byte[81920];
+                    int read;
+                    while ((read = await stream.ReadAsync(buffer, 0, buffer.Length, cancellationToken)) > 0)
+                    {
+                        hash.TransformBlock(buffer, 0, read, null, 0);
+                        await file.WriteAsync(buffer, 0, read, cancellationToken);
+                    }
+
+                    hash.TransformFinalBlock(new byte[0], 0, 0);
+                    sha256 = new HexString(hash.Hash).ToString();
+                }
+
+                MoveIntoPlace(tempPath, this.GetBlobPath(sha256), false);
+                return sha256;
+            }
+            finally
+            {
+                File.Delete(tempPath);
+            }
+        }
+
+        // File.Move fails if the target exists; a blob with the same name already has the same contents, but an index entry is replaced.
+        private static void MoveIntoPlace(string tempPath, string path, bool replace)
+        {
+            try
+            {
+                File.Move(tempPath, path);
+            }
+            catch (IOException) when (File.Exists(path))
+            {
+                if (replace)
+                    File.Replace(tempPath, path, null);
+            }
+        }
+
+        private static string ReadIndexEntry(string path)
+        {
+            if (!File.Exists(path))
+                return null;
+
+            var sha256 = File.ReadAllText(path).Trim();
+            return IsSHA256(sha256) ? sha256.ToLowerInvariant() : null;
+        }
+
+        private static bool IsSHA256(string value) => value.Length == 64 && value.All(Uri.IsHexDigit);
+
+        private string GetIndexPath(UniversalPackageId id, UniversalPackageVersion version)
+        {
+            return Path.Combine(this.CacheRoot, "index", GetCacheDirectoryName(id), version + ".sha256");
+        }
+
+        private string GetLegacyCachePath(UniversalPackageId id, UniversalPackageVersion version)
+        {
+            return Path.Combine(this.CacheRoot, GetCacheDirectoryName(id), $"{id.Name}.{version}.upack");
+        }
+
+        private static string GetCacheDirectoryName(UniversalPackageId id) => (id.Group ?? string.Empty).Replace('/', '$') + "$" + id.Name;
+
+        // Package names cannot contain $, so the last one separates the group from the name.
+        private static UniversalPackageId ParseCacheDirectoryName(string directoryName)
+        {
+            int separator = directoryName.LastIndexOf('$');
+            if (separator < 0 || separator == directoryName.Length - 1)
+                return null;
+
+            var group = directoryName.Substring(0, separator).Replace('$', '/');
+            try
+            {
+                return new UniversalPackageId(group.Length > 0 ? group : null, directoryName.Substring(separator + 1));
+            }
+            catch (ArgumentException)
+            {
+                return null;
+            }
+        }
+
+        // Version lists fetched from feeds are kept in versionCache, in a file for each URL and user named by a hash of both, so
+        // that a later command only needs to ask the feed whether a list has changed. Returns null if the list is not cached.
+        public CachedVersionList TryReadVersionList(string url, string userName)
+        {
+            var path = this.GetVersionListPath(url, userName);
+            if (!File.Exists(path))
+                return null;
+
+            try
+            {
+                var list = JsonConvert.DeserializeObject<CachedVersionList>(File.ReadAllText(path));
+                return list != null && list.Url == url && list.UserName == userName ? list : null;
+            }
+            catch (JsonException)
+            {
+                return null;
+            }
+        }
+
+        // Like a cache index entry, the file is replaced in a single rename, so several processes may write it at once.
+        public void WriteVersionList(CachedVersionList list)
+        {
+            var path = this.GetVersionListPath(list.Url, list.UserName);
+            Directory.CreateDirectory(Path.GetDirectoryName(path));
+            var tempPath = path + "." + Guid.NewGuid().ToString("N") + ".tmp";
+            try
+            {
+                File.WriteAllText(tempPath, JsonConvert.SerializeObject(list, Formatting.None));
+                MoveIntoPlace(tempPath, path, true);
+            }
+            finally
+            {
+                File.Delete(tempPath);
+            }
+        }
+
+        private string GetVersionListPath(string url, string userName)
+        {
+            using (var sha256 = System.Security.Cryptography.SHA256.Create())
+            {
+                var hash = new HexString(sha256.ComputeHash(Encoding.UTF8.GetBytes(url + "\n" + userName)));
+                return Path.Combine(this.RegistryRoot, "versionCache", hash + ".json");
+            }
+        }
+
+        public async Task<IReadOnlyList<RegistryJournalEntry>> GetJournalAsync()
+        {
+            var entries = new List<RegistryJournalEntry>();
+            if (!File.Exists(this.JournalPath))
+                return entries;
+
+            using (var reader = new StreamReader(new FileStream(this.JournalPath, FileMode.Open, FileAccess.Read, FileShare.ReadWrite), Encoding.UTF8))
+            {
+                string line;
+                while ((line = await reader.ReadLineAsync()) != null)
+                {
+                    if (string.IsNullOrWhiteSpace(line))
+                        continue;
+
+                    try
+                    {
+                        entries.Add(JsonConvert.DeserializeObject<RegistryJournalEntry>(line));
+                    }
+                    catch (JsonException)
+                    {
+                        // skip lines damaged by an interrupted write
+                    }
+                }
+            }
+
+            return entries;
+        }
+
+        public void Dispose() => this.Unlock();
+
+        private static bool IsSamePackage(InstalledPackage a, InstalledPackage b)
+        {
+            return string.Equals(a.Group ?? string.Empty, b.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                && string.Equals(a.Name, b.Name, StringComparison.OrdinalIgnoreCase);
+        }
+
+        private async Task WriteInstalledPackagesAsync(IEnumerable<InstalledPackage> packages, CancellationToken cancellationToken)
+        {
+            var text = JsonConvert.SerializeObject(packages, Formatting.Indented);
+            var tempPath = this.InstalledPackagesPath + "." + Process.GetCurrentProcess().Id + ".tmp";
+            try
+            {
+                using (var writer = new StreamWriter(new FileStream(tempPath, FileMode.Create, FileAccess.Write, FileShare.None, 4096, FileOptions.Asynchronous), new UTF8Encoding(false)))
+                {
+                    cancellationToken.ThrowIfCancellationRequested();
+                    await writer.WriteAsync(text);
+                }
+
+                if (File.Exists(this.InstalledPackagesPath))
+                    File.Replace(tempPath, this.InstalledPackagesPath, null);
+                else
+                    File.Move(tempPath, this.InstalledPackagesPath);
+            }
+            finally
+            {
+                if (File.Exists(tempPath))
+                    File.Delete(tempPath);
+            }
+        }
+
+        private void WriteJournal(string operation, string group, string name, string version, string installPath)
+        {
+            var entry = new RegistryJournalEntry
+            {
+                Date = this.Clock.Now.ToString("o"),
+                User = Environment.UserName,
+                Command = this.Command,
+                Operation = operation,
+                Group = string.IsNullOrEmpty(group) ? null : group,
+                Name = name,
+                Version = version,
+                InstallPath = installPath
+            };
+
+            // cache writes do not hold the registry lock, so several processes may append at once; a line is written in a single
+            // call to a shared handle, and the journal is never a reason for the operation itself to fail
+            var line = Encoding.UTF8.GetBytes(JsonConvert.SerializeObject(entry, Formatting.None) + "\n");
+            for (int attempt = 1; ; attempt++)
+            {
+                try
+                {
+                    Directory.CreateDirectory(this.RegistryRoot);
+                    using (var journal = new FileStream(this.JournalPath, FileMode.Append, FileAccess.Write, FileShare.ReadWrite))
+                    {
+                        journal.Write(line, 0, line.Length);
+                    }
+
+                    return;
+                }
+                catch (IOException ex)
+                {
+                    if (attempt >= JournalWriteAttempts)
+                    {
+                        Log.Warning($"Could not write to the registry journal at {this.JournalPath}: {ex.Message}");
+                        return;
+                    }
+
+                    Thread.Sleep(JournalRetryDelay);
+                }
+                catch (UnauthorizedAccessException ex)
+                {
+                    Log.Warning($"Could not write to the registry journal at {this.JournalPath}: {ex.Message}");
+                    return;
+                }
+            }
+        }
+
+        private string GetLockDescription()
+        {
+            try
+            {
+                return File.ReadAllText(this.LockDescriptionPath).Trim();
+            }
+            catch (IOException)
+            {
+                return null;
+            }
+            catch (UnauthorizedAccessException)
+            {
+                return null;
+            }
+        }
+
+        private void EnsureLocked()
+        {
+            if (this.lockStream == null)
+                throw new InvalidOperationException("The registry must be locked before it can be modified.");
+        }
+
+        private void Unlock()
+        {
+            if (this.lockStream == null)
+                return;
+
+            try
+            {
+                File.Delete(this.LockDescriptionPath);
+            }
+            catch (IOException)
+            {
+            }
+            catch (UnauthorizedAccessException)
+            {
+            }
+
+            this.lockStream.Dispose();
+            this.lockStream = null;
+        }
+    }
+}
@@ -0,0 +1,138 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry diff")]
+    [Description("Compares two files written by registry export and reports packages that were added, removed, upgraded, downgraded, or moved.")]
+    public sealed class RegistryDiff : Command
+    {
+        [DisplayName("before")]
+        [Description("Path of the earlier file written by registry export.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string BeforePath { get; set; }
+
+        [DisplayName("after")]
+        [Description("Path of the later file written by registry export.")]
+        [PositionalArgument(1)]
+        [ExpandPath]
+        public string AfterPath { get; set; }
+
+        [DisplayName("exit-code")]
+        [Description("Exit with code 1 if there are any differences.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ExitCode { get; set; } = false;
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var before = ReadExport(this.BeforePath);
+            var after = ReadExport(this.AfterPath);
+
+            int added = 0;
+            int removed = 0;
+            int upgraded = 0;
+            int downgraded = 0;
+            int moved = 0;
+
+            var keys = before.Select(GetKey).Concat(after.Select(GetKey))
+                .Distinct(StringComparer.OrdinalIgnoreCase)
+                .OrderBy(k => k, StringComparer.OrdinalIgnoreCase);
+
+            foreach (var key in keys)
+            {
+                var oldEntries = before.Where(p => string.Equals(GetKey(p), key, StringComparison.OrdinalIgnoreCase)).ToList();
+                var newEntries = after.Where(p => string.Equals(GetKey(p), key, StringComparison.OrdinalIgnoreCase)).ToList();
+
+                // pair installations at the same path first, then treat any that remain as having moved
+                var pairs = new List<KeyValuePair<InstalledPackage, InstalledPackage>>();
+                foreach (var oldEntry in oldEntries.ToList())
+                {
+                    var newEntry = newEntries.FirstOrDefault(p => string.Equals(p.InstallPath, oldEntry.InstallPath, StringComparison.OrdinalIgnoreCase));
+                    if (newEntry != null)
+                    {
+                        pairs.Add(new KeyValuePair<InstalledPackage, InstalledPackage>(oldEntry, newEntry));
+                        oldEntries.Remove(oldEntry);
+                        newEntries.Remove(newEntry);
+                    }
+                }
+
+                while (oldEntries.Count > 0 && newEntries.Count > 0)
+                {
+                    pairs.Add(new KeyValuePair<InstalledPackage, InstalledPackage>(oldEntries[0], newEntries[0]));
+                    oldEntries.RemoveAt(0);
+                    newEntries.RemoveAt(0);
+                }
+
+                foreach (var pair in pairs)
+                {
+                    var oldEntry = pair.Key;
+                    var newEntry = pair.Value;
+
+                    if (!string.Equals(oldEntry.Version, newEntry.Version, StringComparison.OrdinalIgnoreCase))
+                    {
+                        var oldVersion = UniversalPackageVersion.TryParse(oldEntry.Version);
+                        var newVersion = UniversalPackageVersion.TryParse(newEntry.Version);
+                        if (oldVersion != null && newVersion != null && UniversalPackageVersion.Compare(newVersion, oldVersion) < 0)
+                        {
+                            Console.WriteLine($"v {key} {oldEntry.Version} -> {newEntry.Version} at {newEntry.InstallPath}");
+                            downgraded++;
+                        }
+                        else
+                        {
+                            Console.WriteLine($"^ {key} {oldEntry.Version} -> {newEntry.Version} at {newEntry.InstallPath}");
+                            upgraded++;
+                        }
+                    }
+
+                    if (!string.Equals(oldEntry.InstallPath, newEntry.InstallPath, StringComparison.OrdinalIgnoreCase))
+                    {
+                        Console.WriteLine($"> {key} {newEntry.Version} moved from {oldEntry.InstallPath} to {newEntry.InstallPath}");
+                        moved++;
+                    }
+                }
+
+                foreach (var entry in oldEntries)
+                {
+                    Console.WriteLine($"- {key} {entry.Version} at {entry.InstallPath}");
+                    removed++;
+                }
+
+                foreach (var entry in newEntries)
+                {
+                    Console.WriteLine($"+ {key} {entry.Version} at {entry.InstallPath}");
+                    added++;
+                }
+            }
+
+            int changes = added + removed + upgraded + downgraded + moved;
+            if (changes == 0)
+                Console.WriteLine("No differences.");
+            else
+                Console.WriteLine($"{added} added, {removed} removed, {upgraded} upgraded, {downgraded} downgraded, {moved} moved.");
+
+            return Task.FromResult(this.ExitCode && changes > 0 ? 1 : 0);
+        }
+
+        private static List<InstalledPackage> ReadExport(string path)
+        {
+            try
+            {
+                return JsonConvert.DeserializeObject<List<InstalledPackage>>(File.ReadAllText(path)) ?? new List<InstalledPackage>();
+            }
+            catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException || ex is JsonException)
+            {
+                throw new UpackException($"The registry export file '{path}' does not exist or could not be read: {ex.Message}", ex);
+            }
+        }
+
+        private static string GetKey(InstalledPackage pkg) => string.IsNullOrEmpty(pkg.Group) ? pkg.Name : pkg.Group + "/" + pkg.Name;
+    }
+}
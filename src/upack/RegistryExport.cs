@@ -0,0 +1,65 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Threading;
+using System.Threading.Tasks;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry export")]
+    [Description("Writes the contents of the local registry to a JSON file that can be loaded with registry import.")]
+    public sealed class RegistryExport : Command
+    {
+        [DisplayName("output")]
+        [Description("Path of the file to write. If not specified, the registry contents are written to standard output.")]
+        [ExtraArgument]
+        [ExpandPath]
+        public string OutputPath { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("Export the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            IReadOnlyList<InstalledPackage> packages;
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+            {
+                packages = await registry.GetInstalledPackagesAsync();
+            }
+
+            var json = JsonConvert.SerializeObject(packages, Formatting.Indented);
+
+            if (string.IsNullOrEmpty(this.OutputPath))
+            {
+                Console.WriteLine(json);
+            }
+            else
+            {
+                Directory.CreateDirectory(Path.GetDirectoryName(this.OutputPath));
+                File.WriteAllText(this.OutputPath, json);
+                if (Log.Verbosity >= Verbosity.Normal)
+                    Console.Error.WriteLine($"Exported {packages.Count} packages to {this.OutputPath}.");
+            }
+
+            return 0;
+        }
+    }
+}
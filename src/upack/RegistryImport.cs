@@ -0,0 +1,118 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry import")]
+    [Description("Merges packages from a file written by registry export into the local registry.")]
+    public sealed class RegistryImport : Command
+    {
+        [DisplayName("input")]
+        [Description("Path of a file written by registry export.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string InputPath { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("Import into the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("lock-timeout")]
+        [Description("Number of seconds to wait for another process to release the registry lock before failing. If not specified, waits indefinitely.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_LOCK_TIMEOUT")]
+        public string LockTimeout { get; set; }
+
+        [DisplayName("lock-poll-interval")]
+        [Description("Number of seconds to wait between attempts to acquire the registry lock; the default is 0.5.")]
+        [ExtraArgument]
+        public string LockPollInterval { get; set; }
+
+        [DisplayName("replace")]
+        [Description("When a package is already registered with the same install path, replace it with the imported entry instead of keeping the existing one.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Replace { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            List<InstalledPackage> imported;
+            try
+            {
+                imported = JsonConvert.DeserializeObject<List<InstalledPackage>>(File.ReadAllText(this.InputPath));
+            }
+            catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException || ex is JsonException)
+            {
+                throw new UpackException($"The registry export file '{this.InputPath}' does not exist or could not be read: {ex.Message}", ex);
+            }
+
+            int added = 0;
+            int replaced = 0;
+            int skipped = 0;
+
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry, this.LockTimeout, this.LockPollInterval))
+            {
+                await registry.LockAsync(cancellationToken);
+                try
+                {
+                    var existing = await registry.GetInstalledPackagesAsync();
+
+                    foreach (var pkg in imported ?? new List<InstalledPackage>())
+                    {
+                        var conflicts = existing.Where(p => string.Equals(p.Group ?? string.Empty, pkg.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                            && string.Equals(p.Name, pkg.Name, StringComparison.OrdinalIgnoreCase)
+                            && string.Equals(p.InstallPath, pkg.InstallPath, StringComparison.OrdinalIgnoreCase)).ToList();
+
+                        if (conflicts.Count > 0 && !this.Replace)
+                        {
+                            Log.Info($"Skipped {FormatPackage(pkg)}: already registered at {pkg.InstallPath}.");
+                            skipped++;
+                            continue;
+                        }
+
+                        foreach (var conflict in conflicts)
+                            await registry.UnregisterPackageAsync(conflict, cancellationToken);
+
+                        await registry.RegisterPackageAsync(pkg, cancellationToken);
+
+                        if (conflicts.Count > 0)
+                            replaced++;
+                        else
+                            added++;
+                    }
+                }
+                finally
+                {
+                    await registry.UnlockAsync();
+                }
+            }
+
+            Log.Success($"{added} packages added, {replaced} replaced, {skipped} skipped.");
+
+            return 0;
+        }
+
+        private static string FormatPackage(InstalledPackage pkg) => (string.IsNullOrEmpty(pkg.Group) ? pkg.Name : pkg.Group + ":" + pkg.Name) + " " + pkg.Version;
+    }
+}
@@ -0,0 +1,32 @@
+﻿using Newtonsoft.Json;
+
+namespace Inedo.UPack.CLI
+{
+    [JsonObject(ItemNullValueHandling = NullValueHandling.Ignore)]
+    public sealed class RegistryJournalEntry
+    {
+        [JsonProperty("date")]
+        public string Date { get; set; }
+
+        [JsonProperty("user")]
+        public string User { get; set; }
+
+        [JsonProperty("command")]
+        public string Command { get; set; }
+
+        [JsonProperty("operation")]
+        public string Operation { get; set; }
+
+        [JsonProperty("group")]
+        public string Group { get; set; }
+
+        [JsonProperty("name")]
+        public string Name { get; set; }
+
+        [JsonProperty("version")]
+        public string Version { get; set; }
+
+        [JsonProperty("path")]
+        public string InstallPath { get; set; }
+    }
+}
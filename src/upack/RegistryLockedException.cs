@@ -0,0 +1,17 @@
+﻿using System;
+
+namespace Inedo.UPack.CLI
+{
+    public sealed class RegistryLockedException : UpackException
+    {
+        public RegistryLockedException(string registryRoot, string lockDescription, TimeSpan timeout)
+            : base($"Timed out after {timeout.TotalSeconds:0.###} seconds waiting for the registry at {registryRoot} to be unlocked ({lockDescription ?? "unknown holder"}).")
+        {
+            this.RegistryRoot = registryRoot;
+            this.LockDescription = lockDescription;
+        }
+
+        public string RegistryRoot { get; }
+        public string LockDescription { get; }
+    }
+}
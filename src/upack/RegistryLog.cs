@@ -0,0 +1,104 @@
+﻿using System;
+using System.ComponentModel;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry log")]
+    [Description("Displays the journal of packages registered, unregistered, and cached in the local registry.")]
+    public sealed class RegistryLog : Command
+    {
+        [DisplayName("package")]
+        [Description("Only display entries for this package; specify as «group»/«name» or «name».")]
+        [ExtraArgument]
+        public string PackageName { get; set; }
+
+        [DisplayName("user")]
+        [Description("Only display entries for operations performed by this user.")]
+        [ExtraArgument]
+        public string User { get; set; }
+
+        [DisplayName("since")]
+        [Description("Only display entries recorded on or after this date.")]
+        [ExtraArgument]
+        public string Since { get; set; }
+
+        [DisplayName("last")]
+        [Description("Only display the most recent number of matching entries.")]
+        [ExtraArgument]
+        public string Last { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("Read the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            DateTimeOffset since = DateTimeOffset.MinValue;
+            if (!string.IsNullOrEmpty(this.Since) && !DateTimeOffset.TryParse(this.Since, out since))
+                throw new UpackException(ExitCode.InvalidArguments, "--since must be a valid date.");
+
+            int last = 0;
+            if (!string.IsNullOrEmpty(this.Last) && (!int.TryParse(this.Last, out last) || last <= 0))
+                throw new UpackException(ExitCode.InvalidArguments, "--last must be a positive integer.");
+
+            string group = null;
+            string name = null;
+            if (!string.IsNullOrEmpty(this.PackageName))
+            {
+                int slash = this.PackageName.LastIndexOf('/');
+                if (slash >= 0)
+                {
+                    group = this.PackageName.Substring(0, slash);
+                    name = this.PackageName.Substring(slash + 1);
+                }
+                else
+                {
+                    name = this.PackageName;
+                }
+            }
+
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry))
+            {
+                var entries = (await registry.GetJournalAsync()).AsEnumerable();
+
+                if (name != null)
+                    entries = entries.Where(e => string.Equals(e.Name, name, StringComparison.OrdinalIgnoreCase) && (group == null || string.Equals(e.Group ?? string.Empty, group, StringComparison.OrdinalIgnoreCase)));
+                if (!string.IsNullOrEmpty(this.User))
+                    entries = entries.Where(e => string.Equals(e.User, this.User, StringComparison.OrdinalIgnoreCase));
+                if (!string.IsNullOrEmpty(this.Since))
+                    entries = entries.Where(e => DateTimeOffset.TryParse(e.Date, out var date) && date >= since);
+
+                var list = entries.ToList();
+                if (last > 0 && list.Count > last)
+                    list = list.Skip(list.Count - last).ToList();
+
+                foreach (var entry in list)
+                {
+                    var id = string.IsNullOrEmpty(entry.Group) ? entry.Name : entry.Group + "/" + entry.Name;
+                    var path = string.IsNullOrEmpty(entry.InstallPath) ? string.Empty : " at " + entry.InstallPath;
+                    Console.WriteLine($"{entry.Date} {entry.User} ({entry.Command ?? "unknown"}): {entry.Operation} {id} {entry.Version}{path}");
+                }
+            }
+
+            return 0;
+        }
+    }
+}
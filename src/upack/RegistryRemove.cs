@@ -0,0 +1,103 @@
+﻿using System;
+using System.ComponentModel;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry remove")]
+    [Description("Removes a package from the local registry without deleting any of its installed files.")]
+    public sealed class RegistryRemove : Command
+    {
+        [DisplayName("package")]
+        [Description("Package name and group, such as group/name.")]
+        [PositionalArgument(0)]
+        public string PackageName { get; set; }
+
+        [DisplayName("version")]
+        [Description("Version of the package to remove from the registry.")]
+        [PositionalArgument(1)]
+        public string Version { get; set; }
+
+        [DisplayName("userregistry")]
+        [Description("Remove the package from the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("lock-timeout")]
+        [Description("Number of seconds to wait for another process to release the registry lock before failing. If not specified, waits indefinitely.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_LOCK_TIMEOUT")]
+        public string LockTimeout { get; set; }
+
+        [DisplayName("lock-poll-interval")]
+        [Description("Number of seconds to wait between attempts to acquire the registry lock; the default is 0.5.")]
+        [ExtraArgument]
+        public string LockPollInterval { get; set; }
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            UniversalPackageId id;
+            try
+            {
+                id = UniversalPackageId.Parse(this.PackageName);
+            }
+            catch (ArgumentException ex)
+            {
+                throw new UpackException(ExitCode.InvalidArguments, "Invalid package ID: " + ex.Message, ex);
+            }
+
+            var version = UniversalPackageVersion.TryParse(this.Version);
+            if (version == null)
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid UPack version number: {this.Version}");
+
+            int removed = 0;
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry, this.LockTimeout, this.LockPollInterval))
+            {
+                await registry.LockAsync(cancellationToken);
+                try
+                {
+                    var packages = await registry.GetInstalledPackagesAsync();
+                    var matches = packages.Where(p => string.Equals(p.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                        && string.Equals(p.Name, id.Name, StringComparison.OrdinalIgnoreCase)
+                        && UniversalPackageVersion.TryParse(p.Version) == version).ToList();
+
+                    foreach (var pkg in matches)
+                    {
+                        if (await registry.UnregisterPackageAsync(pkg, cancellationToken))
+                            removed++;
+                    }
+                }
+                finally
+                {
+                    await registry.UnlockAsync();
+                }
+            }
+
+            if (removed == 0)
+                throw new UpackException(ExitCode.NotFound, $"Package {id} {version} is not registered.")
+                {
+                    Code = ErrorCodes.NotInstalled
+                };
+
+            Log.Success($"Removed {id} {version} from the registry.");
+
+            return 0;
+        }
+    }
+}
@@ -0,0 +1,213 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("registry repair")]
+    [Description("Checks the local registry for missing install paths, duplicate entries, invalid dates, and orphaned or corrupt cache files, and optionally fixes them.")]
+    public sealed class RegistryRepair : Command
+    {
+        [DisplayName("userregistry")]
+        [Description("Check the user registry instead of the machine registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool UserRegistry { get; set; } = false;
+
+        [DisplayName("project-registry")]
+        [Description("Use the project registry in the nearest .upack directory of the working tree instead of the machine or user registry.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool ProjectRegistry { get; set; } = false;
+
+        [DisplayName("registry-path")]
+        [Description("Directory of the local registry to use instead of the machine or user registry.")]
+        [ExtraArgument]
+        [ExpandPath]
+        [UseEnvironmentVariableAsDefault("UPACK_REGISTRY")]
+        public string RegistryPath { get; set; }
+
+        [DisplayName("lock-timeout")]
+        [Description("Number of seconds to wait for another process to release the registry lock before failing. If not specified, waits indefinitely.")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_LOCK_TIMEOUT")]
+        public string LockTimeout { get; set; }
+
+        [DisplayName("lock-poll-interval")]
+        [Description("Number of seconds to wait between attempts to acquire the registry lock; the default is 0.5.")]
+        [ExtraArgument]
+        public string LockPollInterval { get; set; }
+
+        [DisplayName("fix")]
+        [Description("Remove the inconsistent entries and orphaned cache files instead of only reporting them.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Fix { get; set; } = false;
+
+        [DisplayName("prune-cache")]
+        [Description("Also treat package cache entries of packages that are not registered as orphaned. These are kept by default, since install --cache --unregistered caches packages without registering them for install --offline to use.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool PruneCache { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            int problems = 0;
+
+            using (var registry = OpenRegistry(this.RegistryPath, this.UserRegistry, this.ProjectRegistry, this.LockTimeout, this.LockPollInterval))
+            {
+                await registry.LockAsync(cancellationToken);
+                try
+                {
+                    var packages = await registry.GetInstalledPackagesAsync();
+                    var keep = new List<InstalledPackage>();
+                    var affectedKeys = new HashSet<string>(StringComparer.OrdinalIgnoreCase);
+
+                    foreach (var group in packages.GroupBy(GetKey, StringComparer.OrdinalIgnoreCase))
+                    {
+                        var entries = group.ToList();
+                        for (int i = 0; i < entries.Count; i++)
+                        {
+                            var pkg = entries[i];
+                            if (string.IsNullOrEmpty(pkg.InstallPath) || !Directory.Exists(pkg.InstallPath))
+                            {
+                                Console.WriteLine($"{group.Key}: install path {(string.IsNullOrEmpty(pkg.InstallPath) ? "<unknown path>" : pkg.InstallPath)} does not exist.");
+                                affectedKeys.Add(group.Key);
+                                problems++;
+                                continue;
+                            }
+
+                            if (entries.Skip(i + 1).Any(p => string.Equals(p.InstallPath, pkg.InstallPath, StringComparison.OrdinalIgnoreCase)))
+                            {
+                                Console.WriteLine($"{group.Key}: duplicate entry for {pkg.InstallPath}.");
+                                affectedKeys.Add(group.Key);
+                                problems++;
+                                continue;
+                            }
+
+                            if (!string.IsNullOrEmpty(pkg.InstallationDate) && !DateTimeOffset.TryParse(pkg.InstallationDate, out _))
+                            {
+                                Console.WriteLine($"{group.Key}: invalid installation date \"{pkg.InstallationDate}\".");
+                                affectedKeys.Add(group.Key);
+                                problems++;
+                                pkg.InstallationDate = null;
+                            }
+
+                            keep.Add(pkg);
+                        }
+                    }
+
+                    var registeredKeys = new HashSet<string>(packages.Select(GetKey), StringComparer.OrdinalIgnoreCase);
+                    var staleEntries = new List<CachedPackage>();
+                    var deletedBlobs = new List<string>();
+                    problems += CheckCache(registry, this.PruneCache ? registeredKeys : null, staleEntries, deletedBlobs);
+
+                    if (this.Fix && problems > 0)
+                    {
+                        if (!Confirm($"Fix {problems} problem{(problems == 1 ? string.Empty : "s")}, removing the affected registry entries and {staleEntries.Count + deletedBlobs.Count} cache file{(staleEntries.Count + deletedBlobs.Count == 1 ? string.Empty : "s")}?", true))
+                        {
+                            Console.WriteLine("Nothing was changed.");
+                            return (int)ExitCode.Canceled;
+                        }
+
+                        foreach (var pkg in packages.Where(p => affectedKeys.Contains(GetKey(p))))
+                            await registry.UnregisterPackageAsync(pkg, cancellationToken);
+
+                        foreach (var pkg in keep.Where(p => affectedKeys.Contains(GetKey(p))))
+                            await registry.RegisterPackageAsync(pkg, cancellationToken);
+
+                        foreach (var entry in staleEntries)
+                            registry.RemoveFromCache(entry);
+
+                        foreach (var blob in deletedBlobs)
+                            File.Delete(blob);
+
+                        Log.Success($"Fixed {problems} problems.");
+                        return 0;
+                    }
+                }
+                finally
+                {
+                    await registry.UnlockAsync();
+                }
+            }
+
+            if (problems == 0)
+            {
+                Console.WriteLine("No problems found.");
+                return 0;
+            }
+
+            Console.WriteLine($"{problems} problems found; run with --fix to repair them.");
+            return (int)ExitCode.ValidationFailed;
+        }
+
+        private static string GetKey(InstalledPackage pkg) => (string.IsNullOrEmpty(pkg.Group) ? string.Empty : pkg.Group + "/") + pkg.Name + " " + pkg.Version;
+
+        private static string GetKey(CachedPackage pkg) => (string.IsNullOrEmpty(pkg.Id.Group) ? string.Empty : pkg.Id.Group + "/") + pkg.Id.Name + " " + pkg.Version;
+
+        // A blob is named by its SHA256 hash, so verifying the cache only requires hashing each blob again. Cache entries whose blob
+        // is missing or corrupt are stale, as are entries of packages that are not registered if registeredKeys is specified; blobs
+        // that no entry refers to are orphaned, unless UPACK_CACHE_PATH is set and the blobs may belong to other registries.
+        private static int CheckCache(Registry registry, HashSet<string> registeredKeys, List<CachedPackage> staleEntries, List<string> deletedBlobs)
+        {
+            int problems = 0;
+
+            var corruptBlobs = new HashSet<string>(StringComparer.OrdinalIgnoreCase);
+            foreach (var blob in registry.GetCacheBlobs())
+            {
+                HexString sha256;
+                using (var stream = File.OpenRead(blob))
+                {
+                    sha256 = GetHash(stream, "SHA256");
+                }
+
+                if (!string.Equals(sha256.ToString(), Path.GetFileName(blob), StringComparison.OrdinalIgnoreCase))
+                {
+                    Console.WriteLine($"Corrupt cache blob: {blob}");
+                    corruptBlobs.Add(blob);
+                    deletedBlobs.Add(blob);
+                    problems++;
+                }
+            }
+
+            var referencedBlobs = new HashSet<string>(StringComparer.OrdinalIgnoreCase);
+            foreach (var entry in registry.GetCachedPackages())
+            {
+                var key = GetKey(entry);
+                if (registeredKeys != null && !registeredKeys.Contains(key))
+                {
+                    Console.WriteLine(entry.SHA256 != null ? $"Orphaned cache entry: {key}" : $"Orphaned cache file: {entry.Path}");
+                    staleEntries.Add(entry);
+                    problems++;
+                }
+                else if (entry.SHA256 != null && (corruptBlobs.Contains(entry.Path) || !File.Exists(entry.Path)))
+                {
+                    Console.WriteLine($"{key}: cached blob {entry.SHA256} is missing or corrupt.");
+                    staleEntries.Add(entry);
+                    problems++;
+                }
+                else if (entry.SHA256 != null)
+                {
+                    referencedBlobs.Add(entry.Path);
+                }
+            }
+
+            if (!registry.SharesBlobs)
+            {
+                foreach (var blob in registry.GetCacheBlobs().Where(b => !corruptBlobs.Contains(b) && !referencedBlobs.Contains(b)))
+                {
+                    Console.WriteLine($"Orphaned cache blob: {blob}");
+                    deletedBlobs.Add(blob);
+                    problems++;
+                }
+            }
+
+            return problems;
+        }
+    }
+}
@@ -1,12 +1,9 @@
 ﻿using System;
-using System.Collections.Generic;
 using System.ComponentModel;
 using System.IO;
-using System.Linq;
 using System.Threading;
 using System.Threading.Tasks;
 using Inedo.UPack.Packaging;
-using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
@@ -70,6 +67,21 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool NoAudit { get; set; }
 
+        [DisplayName("license")]
+        [Description("SPDX license expression, such as MIT or Apache-2.0 OR MIT, to replace the license of the package.")]
+        [ExtraArgument]
+        public string License { get; set; }
+
+        [DisplayName("license-url")]
+        [Description("Absolute URL of the license text to replace the license URL of the package.")]
+        [ExtraArgument]
+        public string LicenseUrl { get; set; }
+
+        [DisplayName("tag")]
+        [Description("Tag used to categorize the package, replacing the tags of the package. May be specified more than once.")]
+        [ExtraArgument]
+        public string[] Tags { get; set; }
+
         [DisplayName("note")]
         [Description("A description of the purpose for repackaging that will be entered as the audit note.")]
         [ExtraArgument]
@@ -85,10 +97,7 @@ namespace Inedo.UPack.CLI
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
             if (this.NoAudit && !string.IsNullOrEmpty(this.Note))
-            {
-                Console.Error.WriteLine("--no-audit cannot be used with --note.");
-                return 2;
-            }
+                throw new UpackException(ExitCode.InvalidArguments, "--no-audit cannot be used with --note.");
 
             var info = GetPackageMetadata(this.SourcePath);
             var infoToMerge = await GetMetadataToMergeAsync();
@@ -99,75 +108,37 @@ namespace Inedo.UPack.CLI
             foreach (var modifiedProperty in infoToMerge)
                 info[modifiedProperty.Key] = modifiedProperty.Value;
 
+            if (!string.IsNullOrEmpty(this.License))
+                info["license"] = this.License;
+            if (!string.IsNullOrEmpty(this.LicenseUrl))
+                info["licenseUrl"] = this.LicenseUrl;
+            if (this.Tags != null)
+                info.SetTags(this.Tags);
+
             var error = ValidateManifest(info);
             if (error != null)
-            {
-                Console.Error.WriteLine("Invalid {0}: {1}", string.IsNullOrWhiteSpace(this.Manifest) ? "parameters" : "upack.json", error);
-                return 2;
-            }
+                throw new UpackException(ExitCode.InvalidArguments, $"Invalid {(string.IsNullOrWhiteSpace(this.Manifest) ? "parameters" : "upack.json")}: {error}");
 
             PrintManifest(info);
 
             if (!this.NoAudit)
-            {
-                JArray history;
-                if (info.ContainsKey("repackageHistory"))
-                {
-                    history = (JArray)info["repackageHistory"];
-                }
-                else
-                {
-                    history = new JArray();
-                    info["repackageHistory"] = history;
-                }
-
-                var entry = new Dictionary<string, object>
-                {
-                    { "id", id },
-                    { "date", DateTime.UtcNow.ToString("u") },
-                    { "using", "upack/" + typeof(Repack).Assembly.GetName().Version.ToString(3) },
-                    { "by", Environment.UserName }
-                };
-
-                if (!string.IsNullOrEmpty(this.Note))
-                {
-                    entry["reason"] = this.Note;
-                }
-
-                history.Add(JObject.FromObject(entry));
-            }
+                this.AddRepackageHistory(info, id, this.Note);
 
             string relativePackageFileName = $"{info.Name}-{info.Version.Major}.{info.Version.Minor}.{info.Version.Patch}.upack";
             string targetFileName = Path.Combine(this.TargetDirectory ?? Environment.CurrentDirectory, relativePackageFileName);
 
-            if (!this.Overwrite && File.Exists(targetFileName))
-                throw new UpackException($"Target file '{targetFileName}' exists and overwrite was set to false.");
+            if (!this.Overwrite && File.Exists(targetFileName) && !Confirm($"{targetFileName} already exists. Overwrite?", false))
+                throw new UpackException(ExitCode.Conflict, $"Target file '{targetFileName}' exists and overwrite was set to false.")
+                {
+                    Code = ErrorCodes.FileExists
+                };
 
             string tmpPath = Path.GetTempFileName();
 
             using (var existingPackage = new UniversalPackage(this.SourcePath))
-            using (var builder = new UniversalPackageBuilder(tmpPath, info))
             {
-                var entries = from e in existingPackage.Entries
-                              where !string.Equals(e.RawPath, "upack.json", StringComparison.OrdinalIgnoreCase)
-                              select e;
-
-                foreach (var entry in entries)
-                {
-                    cancellationToken.ThrowIfCancellationRequested();
-
-                    if (entry.IsDirectory)
-                    {
-                        builder.AddEmptyDirectoryRaw(entry.RawPath);
-                    }
-                    else
-                    {
-                        using (var stream = entry.Open())
-                        {
-                            await builder.AddFileRawAsync(stream, entry.RawPath, entry.Timestamp, cancellationToken);
-                        }
-                    }
-                }
+                var manifest = MergeManifest(await ReadManifestTextAsync(existingPackage), info);
+                await RewritePackageAsync(existingPackage, tmpPath, manifest, cancellationToken);
             }
 
             Directory.CreateDirectory(Path.GetDirectoryName(targetFileName));
@@ -0,0 +1,42 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+using Inedo.UPack.Packaging;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // A package selected while resolving the dependencies of install --with-dependencies, kept open until it is extracted.
+    internal sealed class ResolvedDependency
+    {
+        public UniversalPackageId Id { get; set; }
+        public UniversalPackageVersion Version { get; set; }
+        public UniversalPackage Package { get; set; }
+        public HexString SHA1 { get; set; }
+        public long Size { get; set; }
+        public string RequiredBy { get; set; }
+        public string Source { get; set; }
+        // 0 for the package being installed, 1 for its dependencies, and so on.
+        public int Depth { get; set; }
+        // Paths of files that conflict with another package in the closure, and are taken from that package instead.
+        public HashSet<string> ExcludedPaths { get; } = new HashSet<string>(StringComparer.OrdinalIgnoreCase);
+        // Each dependency listed in the manifest, as written, with the package selected for it.
+        public List<KeyValuePair<string, ResolvedDependency>> Dependencies { get; } = new List<KeyValuePair<string, ResolvedDependency>>();
+
+        public bool IsFor(UniversalPackageId id)
+        {
+            return string.Equals(this.Id.Group ?? string.Empty, id.Group ?? string.Empty, StringComparison.OrdinalIgnoreCase)
+                && string.Equals(this.Id.Name, id.Name, StringComparison.OrdinalIgnoreCase);
+        }
+
+        public IEnumerable<string> GetDependencies()
+        {
+            var info = this.Package.GetFullMetadata();
+            if (!info.ContainsKey("dependencies") || info["dependencies"] == null)
+                return Enumerable.Empty<string>();
+
+            var token = JToken.FromObject(info["dependencies"]);
+            return token is JArray array ? array.Select(t => (string)t).ToList() : new List<string> { (string)token };
+        }
+    }
+}
@@ -0,0 +1,117 @@
+﻿using System;
+using System.Runtime.InteropServices;
+
+namespace Inedo.UPack.CLI
+{
+    // Temporarily switches the effective user and groups of the process to another user, so that files are created with that
+    // user's permissions and ownership; disposing switches back to root and the original groups. Only available on Unix when
+    // running as root.
+    internal sealed class RunAsUser : IDisposable
+    {
+        private readonly uint savedGroup;
+        private readonly uint[] savedGroups;
+        private bool disposed;
+
+        private RunAsUser(uint savedGroup, uint[] savedGroups)
+        {
+            this.savedGroup = savedGroup;
+            this.savedGroups = savedGroups;
+        }
+
+        // Returns an error message if the current process cannot switch users, or null if it can.
+        public static string CheckSupported()
+        {
+            if (Platform.CurrentOS == "windows")
+                return "--run-as is not supported on Windows.";
+            if (geteuid() != 0)
+                return "--run-as requires upack to be run as root.";
+
+            return null;
+        }
+
+        public static RunAsUser Switch(string userName)
+        {
+            var passwd = getpwnam(userName);
+            if (passwd == IntPtr.Zero)
+                throw new UpackException($"User {userName} was not found.");
+
+            // struct passwd starts with pw_name and pw_passwd, followed by pw_uid and pw_gid
+            uint uid = (uint)Marshal.ReadInt32(passwd, 2 * IntPtr.Size);
+            uint gid = (uint)Marshal.ReadInt32(passwd, 2 * IntPtr.Size + 4);
+
+            uint savedGroup = getegid();
+            int count = getgroups(0, null);
+            var groups = new uint[Math.Max(count, 0)];
+            if (count > 0 && getgroups(count, groups) < 0)
+                throw Error("read the supplementary groups of the process");
+
+            // the groups must be changed while the effective user is still root; initgroups includes the supplementary groups of
+            // the user, which may be the only way it can write to the target directory
+            if (initgroups(userName, gid) != 0)
+                throw Error($"set the supplementary groups to those of {userName}");
+
+            if (setegid(gid) != 0)
+            {
+                var error = Error($"switch to the group of {userName}");
+                setgroups((IntPtr)groups.Length, groups);
+                throw error;
+            }
+
+            if (seteuid(uid) != 0)
+            {
+                var error = Error($"switch to user {userName}");
+                setegid(savedGroup);
+                setgroups((IntPtr)groups.Length, groups);
+                throw error;
+            }
+
+            return new RunAsUser(savedGroup, groups);
+        }
+
+        // Does not throw, since it usually runs while an exception from the extraction is propagating.
+        public void Dispose()
+        {
+            if (this.disposed)
+                return;
+
+            this.disposed = true;
+
+            if (seteuid(0) != 0)
+            {
+                Log.Warning($"Unable to switch back to root (errno {Marshal.GetLastWin32Error()}).");
+                return;
+            }
+
+            if (setegid(this.savedGroup) != 0)
+                Log.Warning($"Unable to switch back to group {this.savedGroup} (errno {Marshal.GetLastWin32Error()}).");
+            if (setgroups((IntPtr)this.savedGroups.Length, this.savedGroups) != 0)
+                Log.Warning($"Unable to restore the supplementary groups of the process (errno {Marshal.GetLastWin32Error()}).");
+        }
+
+        private static UpackException Error(string action) => new UpackException($"Unable to {action} (errno {Marshal.GetLastWin32Error()}).");
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern uint geteuid();
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern int seteuid(uint euid);
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern uint getegid();
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern int setegid(uint egid);
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern IntPtr getpwnam(string name);
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern int getgroups(int size, uint[] list);
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern int setgroups(IntPtr size, uint[] list);
+
+        [DllImport("libc", SetLastError = true)]
+        private static extern int initgroups(string user, uint group);
+    }
+}
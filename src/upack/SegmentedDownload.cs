@@ -0,0 +1,174 @@
+﻿using System;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    // Downloads a package from the download endpoint of a feed in several parallel range requests, each writing its part of a
+    // preallocated temporary file. This is much faster than a single stream over a link with high latency.
+    internal static class SegmentedDownload
+    {
+        private const long MinimumSegmentSize = 4 * 1024 * 1024;
+
+        // Returns null if the feed does not support range requests or the package is too small to split, so that the caller
+        // downloads it in the usual way; a segmented download that fails part way is reported and also returns null.
+        public static async Task<Stream> TryDownloadAsync(string feedUrl, NetworkCredential credentials, UniversalPackageId id, UniversalPackageVersion version, int threads, CancellationToken cancellationToken)
+        {
+            var url = GetDownloadUrl(feedUrl, id, version);
+
+            long length;
+            try
+            {
+                length = await GetLengthAsync(url, credentials, cancellationToken);
+            }
+            catch (WebException)
+            {
+                return null;
+            }
+
+            if (length < MinimumSegmentSize * 2)
+                return null;
+
+            // more segments than connections would only wait for each other
+            int segments = (int)Math.Min(Math.Min(threads, FeedHttp.MaxConnections), length / MinimumSegmentSize);
+            if (segments < 2)
+                return null;
+
+            long segmentSize = (length + segments - 1) / segments;
+            var progress = Progress.Start("download", id, version, length);
+
+            var file = new FileStream(Path.GetTempFileName(), FileMode.Create, FileAccess.ReadWrite, FileShare.None, 4096, FileOptions.DeleteOnClose | FileOptions.Asynchronous);
+            try
+            {
+                file.SetLength(length);
+
+                // when one segment fails the others are canceled, and the file is only closed once all of them have stopped
+                using (var failed = CancellationTokenSource.CreateLinkedTokenSource(cancellationToken))
+                {
+                    var tasks = Enumerable.Range(0, segments)
+                        .Select(
+                            async i =>
+                            {
+                                try
+                                {
+                                    await DownloadSegmentAsync(url, credentials, file, i * segmentSize, Math.Min((i + 1) * segmentSize, length) - 1, progress, failed.Token);
+                                }
+                                catch
+                                {
+                                    failed.Cancel();
+                                    throw;
+                                }
+                            }
+                        )
+                        .ToList();
+
+                    await Task.WhenAll(tasks);
+                }
+
+                progress?.Finish();
+                file.Position = 0;
+                return file;
+            }
+            catch (Exception ex) when (ex is WebException || ex is IOException)
+            {
+                file.Dispose();
+                Log.Warning($"Segmented download of {id} {version} failed ({ex.Message}); downloading it in a single request.");
+                return null;
+            }
+            catch
+            {
+                file.Dispose();
+                throw;
+            }
+        }
+
+        private static string GetDownloadUrl(string feedUrl, UniversalPackageId id, UniversalPackageVersion version)
+        {
+            var url = new StringBuilder(feedUrl.TrimEnd('/')).Append("/download/");
+            if (!string.IsNullOrEmpty(id.Group))
+            {
+                foreach (var part in id.Group.Split('/'))
+                    url.Append(Uri.EscapeDataString(part)).Append('/');
+            }
+
+            return url.Append(Uri.EscapeDataString(id.Name)).Append('/').Append(Uri.EscapeDataString(version.ToString())).ToString();
+        }
+
+        // Requests the first byte; a server that supports range requests responds with 206 and the total length in Content-Range.
+        private static async Task<long> GetLengthAsync(string url, NetworkCredential credentials, CancellationToken cancellationToken)
+        {
+            HttpWebRequest request = null;
+            using (var response = (HttpWebResponse)await FeedHttp.SendAsync(
+                () =>
+                {
+                    request = FeedHttp.CreateRequest(url, credentials);
+                    request.AddRange(0L, 0L);
+                    return request.GetResponseAsync();
+                },
+                cancellationToken
+            ))
+            {
+                Log.DebugHeaders("<", response.Headers);
+                if (response.StatusCode != HttpStatusCode.PartialContent)
+                {
+                    // the server is sending the whole package, which is not wanted here
+                    request.Abort();
+                    return -1;
+                }
+
+                var contentRange = response.Headers[HttpResponseHeader.ContentRange];
+                int slash = contentRange?.LastIndexOf('/') ?? -1;
+                if (slash < 0 || !long.TryParse(contentRange.Substring(slash + 1), out long length))
+                    return -1;
+
+                return length;
+            }
+        }
+
+        private static async Task DownloadSegmentAsync(string url, NetworkCredential credentials, FileStream file, long start, long end, Progress progress, CancellationToken cancellationToken)
+        {
+            using (var response = (HttpWebResponse)await FeedHttp.SendAsync(
+                () =>
+                {
+                    var request = FeedHttp.CreateRequest(url, credentials);
+                    request.AddRange(start, end);
+                    return request.GetResponseAsync();
+                },
+                cancellationToken
+            ))
+            {
+                Log.Verbose($"Downloading bytes {start}-{end} of {url}");
+                if (response.StatusCode != HttpStatusCode.PartialContent)
+                    throw new IOException($"the server responded to a range request with {(int)response.StatusCode} {response.StatusDescription}");
+
+                using (var stream = response.GetResponseStream())
+                {
+                    var buffer = new byte[81920];
+                    long position = start;
+                    int read;
+                    while ((read = await stream.ReadAsync(buffer, 0, buffer.Length, cancellationToken)) > 0)
+                    {
+                        if (position + read > end + 1)
+                            throw new IOException("the server returned more data than was requested");
+
+                        lock (file)
+                        {
+                            file.Position = position;
+                            file.Write(buffer, 0, read);
+                        }
+
+                        position += read;
+                        progress?.Add(read);
+                    }
+
+                    if (position != end + 1)
+                        throw new IOException("the connection was closed before the whole segment was received");
+                }
+            }
+        }
+    }
+}
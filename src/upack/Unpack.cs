@@ -33,6 +33,20 @@ namespace Inedo.UPack.CLI
         [DefaultValue(false)]
         public bool PreserveTimestamps { get; set; } = false;
 
+        [DisplayName("content-root")]
+        [Description("Directory inside the archive that contains the package contents; the default is package/. Use / to extract everything except upack.json from the archive root.")]
+        [ExtraArgument]
+        public string ContentRoot { get; set; }
+
+        [DisplayName("warnings-as-errors")]
+        [Description("Fail instead of displaying a warning.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        [UseEnvironmentVariableAsDefault("UPACK_WARNINGS_AS_ERRORS")]
+        public bool WarningsAsErrors { get; set; } = false;
+
+        protected override bool TreatWarningsAsErrors => this.WarningsAsErrors;
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
             UniversalPackage package;
@@ -42,7 +56,11 @@ namespace Inedo.UPack.CLI
             }
             catch (Exception ex)
             {
-                throw new UpackException("The specified file is not a valid universal package: " + ex.Message, ex);
+                throw new UpackException(ExitCode.ValidationFailed, "The specified file is not a valid universal package: " + ex.Message, ex)
+                {
+                    Code = ErrorCodes.InvalidPackage,
+                    Location = this.Package
+                };
             }
 
             using (package)
@@ -50,7 +68,8 @@ namespace Inedo.UPack.CLI
                 var info = package.GetFullMetadata();
                 PrintManifest(info);
 
-                await UnpackZipAsync(this.Target, this.Overwrite, package, this.PreserveTimestamps, cancellationToken);
+                bool overwrite = ConfirmOverwrite(package, this.Target, this.ContentRoot, this.Overwrite);
+                await UnpackZipAsync(this.Target, overwrite, package, this.PreserveTimestamps, this.ContentRoot, cancellationToken);
             }
 
             return 0;
@@ -2,7 +2,7 @@
 
 namespace Inedo.UPack.CLI
 {
-    public sealed class UpackException : Exception
+    public class UpackException : Exception
     {
         public UpackException()
         {
@@ -17,5 +17,34 @@ namespace Inedo.UPack.CLI
             : base(message, innerException)
         {
         }
+
+        public UpackException(ExitCode exitCode, string message)
+            : base(message)
+        {
+            this.ExitCode = exitCode;
+        }
+
+        public UpackException(ExitCode exitCode, string message, Exception innerException)
+            : base(message, innerException)
+        {
+            this.ExitCode = exitCode;
+        }
+
+        public ExitCode ExitCode { get; } = ExitCode.Failed;
+
+        private string code;
+
+        // One of the ErrorCodes, which defaults to the code of the class of failure given by ExitCode.
+        public string Code
+        {
+            get => this.code ?? ErrorCodes.GetDefault(this.ExitCode);
+            set => this.code = value;
+        }
+
+        // The URL or path that the error concerns, if any.
+        public string Location { get; set; }
+
+        // What the user should most likely do about the error, if it is known and the message does not already say it.
+        public string Hint { get; set; }
     }
 }
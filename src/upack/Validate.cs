@@ -0,0 +1,113 @@
+﻿using System;
+using System.ComponentModel;
+using System.IO;
+using System.Linq;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+using Inedo.UPack.Packaging;
+using Newtonsoft.Json;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("validate")]
+    [Description("Checks that the upack.json of a package, or a upack.json file, is valid without creating or pushing a package.")]
+    public sealed class Validate : Command
+    {
+        [DisplayName("path")]
+        [Description("Path of a .upack file or a upack.json file.")]
+        [PositionalArgument(0)]
+        [ExpandPath]
+        public string FilePath { get; set; }
+
+        [DisplayName("strict")]
+        [Description("Also check the types of all known upack.json properties against the embedded JSON schema, and reject unknown properties with names similar to known ones.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Strict { get; set; } = false;
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            if (!File.Exists(this.FilePath))
+                throw new UpackException(ExitCode.NotFound, $"The file '{this.FilePath}' does not exist.")
+                {
+                    Code = ErrorCodes.FileNotFound
+                };
+
+            string text;
+            try
+            {
+                if (this.FilePath.EndsWith(".json", StringComparison.OrdinalIgnoreCase))
+                {
+                    text = File.ReadAllText(this.FilePath);
+                }
+                else
+                {
+                    using (var package = new UniversalPackage(this.FilePath))
+                    {
+                        var entry = package.Entries.FirstOrDefault(e => string.Equals(e.RawPath, "upack.json", StringComparison.OrdinalIgnoreCase));
+                        if (entry == null)
+                            throw new UpackException(ExitCode.NotFound, $"upack.json was not found in {this.FilePath}.");
+
+                        using (var reader = new StreamReader(entry.Open(), Encoding.UTF8, true))
+                        {
+                            text = reader.ReadToEnd();
+                        }
+                    }
+                }
+            }
+            catch (Exception ex) when (ex is InvalidDataException || ex is IOException || ex is UnauthorizedAccessException)
+            {
+                throw new UpackException($"The file '{this.FilePath}' could not be read: {ex.Message}", ex);
+            }
+
+            UniversalPackageMetadata info;
+            JObject manifest;
+            try
+            {
+                using (var reader = new JsonTextReader(new StringReader(text)) { DateParseHandling = DateParseHandling.None })
+                {
+                    manifest = JObject.Load(reader);
+                }
+
+                info = JsonConvert.DeserializeObject<UniversalPackageMetadata>(text);
+            }
+            catch (JsonException ex)
+            {
+                throw new UpackException(ExitCode.ValidationFailed, $"upack.json is not valid JSON: {ex.Message}", ex)
+                {
+                    Code = ErrorCodes.InvalidManifest,
+                    Location = this.FilePath
+                };
+            }
+
+            var problems = ManifestSchema.Check(manifest);
+            var error = ValidateManifest(info);
+
+            // the schema reports wrong types more precisely than ValidateManifest, so only its problems are shown with --strict
+            if (this.Strict && problems.Count > 0)
+            {
+                foreach (var problem in problems)
+                    Console.Error.WriteLine("Invalid upack.json (--strict): {0}", problem);
+
+                throw new UpackException(ExitCode.ValidationFailed, $"upack.json has {problems.Count} problem{(problems.Count == 1 ? string.Empty : "s")}.")
+                {
+                    Code = ErrorCodes.InvalidManifest,
+                    Location = this.FilePath
+                };
+            }
+
+            if (error != null)
+                throw new UpackException(ExitCode.ValidationFailed, "Invalid upack.json: " + error)
+                {
+                    Code = ErrorCodes.InvalidManifest,
+                    Location = this.FilePath
+                };
+
+            PrintManifest(info);
+            Log.Success("upack.json is valid.");
+            return Task.FromResult(0);
+        }
+    }
+}
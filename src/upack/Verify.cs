@@ -1,19 +1,23 @@
 ﻿using System;
+using System.Collections.Generic;
 using System.ComponentModel;
+using System.IO;
+using System.Linq;
 using System.Net;
 using System.Threading;
 using System.Threading.Tasks;
+using Inedo.UPack.Net;
+using Newtonsoft.Json.Linq;
 
 namespace Inedo.UPack.CLI
 {
     [DisplayName("verify")]
     [Description("Verifies that a specified package hash matches the hash stored in a universal feed.")]
-    public sealed class Verify : Command
+    public sealed class Verify : FeedCommand
     {
         [DisplayName("package")]
-        [Description("Path of a valid .upack file.")]
+        [Description("Path of a valid .upack file, a directory to search recursively for .upack files, or a wildcard pattern such as artifacts/*.upack.")]
         [PositionalArgument(0)]
-        [ExpandPath]
         public string PackagePath { get; set; }
 
         [DisplayName("source")]
@@ -28,24 +32,218 @@ namespace Inedo.UPack.CLI
         [UseEnvironmentVariableAsDefault("UPACK_USER")]
         public NetworkCredential Authentication { get; set; }
 
+        [DisplayName("api-key")]
+        [Description("API key to use for servers that require authentication, instead of --user=api:«api-key».")]
+        [ExtraArgument]
+        [UseEnvironmentVariableAsDefault("UPACK_API_KEY")]
+        public string ApiKey { get; set; }
+
+        [DisplayName("parallel")]
+        [Description("When verifying more than one package, the number of packages to verify at the same time; the default is 4.")]
+        [ExtraArgument]
+        public string Parallel { get; set; }
+
         public override async Task<int> RunAsync(CancellationToken cancellationToken)
         {
-            var metadata = GetPackageMetadata(this.PackagePath);
+            // the package path is not expanded by the argument parser because it may contain wildcards
+            var path = Path.Combine(Environment.CurrentDirectory, this.PackagePath ?? string.Empty);
+            bool wildcard = Path.GetFileName(path).IndexOfAny(new[] { '*', '?' }) >= 0;
+
+            if (!wildcard && !Directory.Exists(path))
+                return await this.VerifySingleAsync(Path.GetFullPath(path), cancellationToken);
+
+            int parallel = 4;
+            if (!string.IsNullOrEmpty(this.Parallel) && (!int.TryParse(this.Parallel, out parallel) || parallel <= 0))
+                throw new UpackException(ExitCode.InvalidArguments, "--parallel must be a positive integer.");
+
+            List<string> files;
+            if (wildcard)
+            {
+                var directory = Path.GetFullPath(Path.GetDirectoryName(path));
+                files = Directory.Exists(directory) ? Directory.GetFiles(directory, Path.GetFileName(path)).ToList() : new List<string>();
+            }
+            else
+            {
+                path = Path.GetFullPath(path);
+                files = Directory.GetFiles(path, "*.upack", SearchOption.AllDirectories).ToList();
+            }
+
+            if (files.Count == 0)
+                throw new UpackException(ExitCode.InvalidArguments, $"No packages found at {this.PackagePath}.");
+
+            files.Sort(StringComparer.OrdinalIgnoreCase);
+
+            var client = CreateClient(this.SourceEndpoint, this.Authentication, this.ApiKey);
+            VerifyResult[] results;
+            using (var throttle = new SemaphoreSlim(parallel))
+            {
+                results = await Task.WhenAll(
+                    files.Select(
+                        async f =>
+                        {
+                            await throttle.WaitAsync(cancellationToken);
+                            try
+                            {
+                                return await VerifyFileAsync(client, f, cancellationToken);
+                            }
+                            finally
+                            {
+                                throttle.Release();
+                            }
+                        }
+                    )
+                );
+            }
+
+            var baseDirectory = wildcard ? Path.GetFullPath(Path.GetDirectoryName(path)) : path;
+            foreach (var r in results)
+            {
+                if (r.File.StartsWith(baseDirectory, StringComparison.OrdinalIgnoreCase))
+                    r.File = r.File.Substring(baseDirectory.Length).TrimStart(Path.DirectorySeparatorChar, Path.AltDirectorySeparatorChar);
+            }
+
+            int statusWidth = Math.Max("Status".Length, results.Max(r => r.Status.Length));
+            int packageWidth = Math.Max("Package".Length, results.Max(r => r.Package.Length));
+            int versionWidth = Math.Max("Version".Length, results.Max(r => r.Version.Length));
+
+            Console.WriteLine($"{"Status".PadRight(statusWidth)}  {"Package".PadRight(packageWidth)}  {"Version".PadRight(versionWidth)}  File");
+            foreach (var r in results)
+            {
+                Console.WriteLine($"{r.Status.PadRight(statusWidth)}  {r.Package.PadRight(packageWidth)}  {r.Version.PadRight(versionWidth)}  {r.File}");
+                if (!string.IsNullOrEmpty(r.Detail))
+                    Console.WriteLine($"{string.Empty.PadRight(statusWidth)}  {r.Detail}");
+            }
+
+            int matched = results.Count(r => r.Status == VerifyResult.Matched);
+            Console.WriteLine();
+            Console.WriteLine($"{results.Length} packages: {matched} matched, {results.Count(r => r.Status == VerifyResult.Mismatched)} mismatched, {results.Count(r => r.Status == VerifyResult.NotFound)} not found, {results.Count(r => r.Status == VerifyResult.Failed)} failed.");
+
+            WriteResult(new JArray(results.Select(r => r.ToJson())));
+
+            if (results.Any(r => r.Status == VerifyResult.Mismatched))
+                return (int)ExitCode.ValidationFailed;
+            if (results.Any(r => r.Status == VerifyResult.NotFound))
+                return (int)ExitCode.NotFound;
+
+            return matched == results.Length ? 0 : 1;
+        }
+
+        private async Task<int> VerifySingleAsync(string packagePath, CancellationToken cancellationToken)
+        {
+            var metadata = GetPackageMetadata(packagePath);
             var packageId = new UniversalPackageId(metadata.Group, metadata.Name);
-            var client = CreateClient(this.SourceEndpoint, this.Authentication);
-            var remoteVersion = await client.GetPackageVersionAsync(packageId, metadata.Version, false, cancellationToken);
+            var client = CreateClient(this.SourceEndpoint, this.Authentication, this.ApiKey);
+            var remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(packageId, metadata.Version, false, cancellationToken), cancellationToken);
 
             if (remoteVersion == null)
-                throw new UpackException($"Package {packageId} was not found in feed.");
+                throw new UpackException(ExitCode.NotFound, $"Package {packageId} was not found in feed.")
+                {
+                    Code = ErrorCodes.PackageNotFound,
+                    Location = this.SourceEndpoint
+                };
 
-            var sha1 = GetSHA1(this.PackagePath);
+            var sha1 = GetSHA1(packagePath);
 
             if (sha1 != remoteVersion.SHA1)
-                throw new UpackException($"Package SHA1 value {sha1} did not match remote SHA1 value {remoteVersion.SHA1}");
+                throw new UpackException(ExitCode.ValidationFailed, $"Package SHA1 value {sha1} did not match remote SHA1 value {remoteVersion.SHA1}")
+                {
+                    Code = ErrorCodes.HashMismatch
+                };
+
+            Log.Success("Hashes for local and remote package match: " + sha1);
 
-            Console.WriteLine("Hashes for local and remote package match: " + sha1);
+            WriteResult(
+                new VerifyResult
+                {
+                    File = packagePath,
+                    Package = packageId.ToString(),
+                    Version = metadata.Version?.ToString() ?? string.Empty,
+                    Status = VerifyResult.Matched,
+                    SHA1 = sha1.ToString()
+                }.ToJson()
+            );
 
             return 0;
         }
+
+        private static async Task<VerifyResult> VerifyFileAsync(UniversalFeedClient client, string packagePath, CancellationToken cancellationToken)
+        {
+            var result = new VerifyResult { File = packagePath };
+            try
+            {
+                var metadata = GetPackageMetadata(packagePath);
+                var packageId = new UniversalPackageId(metadata.Group, metadata.Name);
+                result.Package = packageId.ToString();
+                result.Version = metadata.Version?.ToString() ?? string.Empty;
+
+                RemoteUniversalPackageVersion remoteVersion;
+                try
+                {
+                    remoteVersion = await FeedHttp.SendAsync(() => client.GetPackageVersionAsync(packageId, metadata.Version, false, cancellationToken), cancellationToken);
+                }
+                catch (WebException ex)
+                {
+                    throw ConvertWebException(ex);
+                }
+
+                if (remoteVersion == null)
+                {
+                    result.Status = VerifyResult.NotFound;
+                    return result;
+                }
+
+                var sha1 = GetSHA1(packagePath);
+                result.SHA1 = sha1.ToString();
+                if (sha1 != remoteVersion.SHA1)
+                {
+                    result.Status = VerifyResult.Mismatched;
+                    result.Detail = $"local SHA1 {sha1} does not match remote SHA1 {remoteVersion.SHA1}";
+                    return result;
+                }
+
+                result.Status = VerifyResult.Matched;
+                return result;
+            }
+            catch (Exception ex) when (ex is UpackException || ex is IOException || ex is UnauthorizedAccessException || ex is InvalidDataException)
+            {
+                result.Status = VerifyResult.Failed;
+                result.Detail = ex.Message;
+                return result;
+            }
+        }
+
+        private sealed class VerifyResult
+        {
+            public const string Matched = "OK";
+            public const string Mismatched = "MISMATCH";
+            public const string NotFound = "NOT FOUND";
+            public const string Failed = "ERROR";
+
+            public string File { get; set; }
+            public string Package { get; set; } = string.Empty;
+            public string Version { get; set; } = string.Empty;
+            public string Status { get; set; }
+            public string Detail { get; set; }
+            public string SHA1 { get; set; }
+
+            // The --json form uses a status that is easier to match than the one displayed in the table.
+            public JObject ToJson()
+            {
+                var json = new JObject
+                {
+                    ["file"] = this.File,
+                    ["package"] = this.Package,
+                    ["version"] = this.Version,
+                    ["status"] = this.Status == Matched ? "matched" : this.Status == Mismatched ? "mismatched" : this.Status == NotFound ? "notFound" : "failed"
+                };
+
+                if (this.SHA1 != null)
+                    json["sha1"] = this.SHA1;
+                if (!string.IsNullOrEmpty(this.Detail))
+                    json["detail"] = this.Detail;
+
+                return json;
+            }
+        }
     }
 }
@@ -0,0 +1,125 @@
+﻿using System;
+using System.ComponentModel;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("version check")]
+    [Description("Checks whether a universal package version is valid, and if not, explains which rule of the semantic versioning grammar it violates.")]
+    public sealed class VersionCheck : Command
+    {
+        private static readonly string[] CoreNames = { "major", "minor", "patch" };
+
+        [DisplayName("version")]
+        [Description("Version to check.")]
+        [PositionalArgument(0)]
+        public string Version { get; set; }
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var problem = Explain(this.Version);
+            if (problem == null && UniversalPackageVersion.TryParse(this.Version) == null)
+                problem = "it is not accepted by the universal package version parser.";
+
+            if (problem != null)
+                throw new UpackException(ExitCode.ValidationFailed, $"{this.Version} is not a valid UPack version number: {problem}")
+                {
+                    Code = ErrorCodes.InvalidVersion
+                };
+
+            Log.Success($"{this.Version} is a valid UPack version number.");
+            return Task.FromResult(0);
+        }
+
+        // Returns a description of the first rule of major.minor.patch[-prerelease][+build] that version breaks, or null if it follows all of them.
+        internal static string Explain(string version)
+        {
+            if (string.IsNullOrEmpty(version))
+                return "the version is empty.";
+
+            if (version[0] == 'v' || version[0] == 'V')
+                return $"the leading '{version[0]}' is not part of a version number; use {version.Substring(1)}.";
+
+            int plus = version.IndexOf('+');
+            var withoutBuild = plus >= 0 ? version.Substring(0, plus) : version;
+            int dash = withoutBuild.IndexOf('-');
+            var core = dash >= 0 ? withoutBuild.Substring(0, dash) : withoutBuild;
+
+            var parts = core.Split('.');
+            int offset = 0;
+            for (int i = 0; i < parts.Length && i < CoreNames.Length; i++)
+            {
+                var part = parts[i];
+                if (part.Length == 0)
+                    return $"the {CoreNames[i]} component at position {offset + 1} is empty.";
+
+                int bad = IndexOfInvalid(part, c => c >= '0' && c <= '9');
+                if (bad >= 0)
+                    return $"the {CoreNames[i]} component contains '{part[bad]}' at position {offset + bad + 1}; it must contain only digits.";
+
+                if (part.Length > 1 && part[0] == '0')
+                    return $"the {CoreNames[i]} component {part} has a leading zero.";
+
+                offset += part.Length + 1;
+            }
+
+            if (parts.Length < CoreNames.Length)
+                return $"the {string.Join(" and ", CoreNames.Skip(parts.Length))} {(parts.Length == 2 ? "component is" : "components are")} missing; a version must have the form major.minor.patch.";
+
+            if (parts.Length > CoreNames.Length)
+                return $"it has {parts.Length} numeric components, but a version must have exactly three (major.minor.patch); use --legacy-versions where supported to treat a fourth component as build metadata.";
+
+            if (dash >= 0)
+            {
+                var problem = ExplainIdentifiers(withoutBuild.Substring(dash + 1), "prerelease", dash + 2, true);
+                if (problem != null)
+                    return problem;
+            }
+
+            if (plus >= 0)
+            {
+                var problem = ExplainIdentifiers(version.Substring(plus + 1), "build metadata", plus + 2, false);
+                if (problem != null)
+                    return problem;
+            }
+
+            return null;
+        }
+
+        private static string ExplainIdentifiers(string text, string label, int position, bool numericLeadingZero)
+        {
+            if (text.Length == 0)
+                return $"the {label} after position {position - 1} is empty.";
+
+            foreach (var identifier in text.Split('.'))
+            {
+                if (identifier.Length == 0)
+                    return $"the {label} has an empty identifier at position {position}.";
+
+                int bad = IndexOfInvalid(identifier, c => (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '-');
+                if (bad >= 0)
+                    return $"the {label} contains '{identifier[bad]}' at position {position + bad}; it may contain only letters, digits, hyphens, and dots.";
+
+                if (numericLeadingZero && identifier.Length > 1 && identifier[0] == '0' && identifier.All(c => c >= '0' && c <= '9'))
+                    return $"the numeric {label} identifier {identifier} has a leading zero.";
+
+                position += identifier.Length + 1;
+            }
+
+            return null;
+        }
+
+        private static int IndexOfInvalid(string text, Func<char, bool> isValid)
+        {
+            for (int i = 0; i < text.Length; i++)
+            {
+                if (!isValid(text[i]))
+                    return i;
+            }
+
+            return -1;
+        }
+    }
+}
@@ -0,0 +1,37 @@
+﻿using System;
+using System.ComponentModel;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("version compare")]
+    [Description("Compares two universal package versions and outputs -1, 0, or 1 if the first is lower than, equal to, or higher than the second.")]
+    public sealed class VersionCompare : Command
+    {
+        [DisplayName("a")]
+        [Description("First version to compare.")]
+        [PositionalArgument(0)]
+        public string First { get; set; }
+
+        [DisplayName("b")]
+        [Description("Second version to compare.")]
+        [PositionalArgument(1)]
+        public string Second { get; set; }
+
+        public override Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var a = ParseVersion(this.First);
+            var b = ParseVersion(this.Second);
+
+            Console.WriteLine(Math.Sign(UniversalPackageVersion.Compare(a, b)));
+
+            return Task.FromResult(0);
+        }
+
+        private static UniversalPackageVersion ParseVersion(string version)
+        {
+            return UniversalPackageVersion.TryParse(version) ?? throw new UpackException(ExitCode.InvalidArguments, $"Invalid UPack version number: {version}");
+        }
+    }
+}
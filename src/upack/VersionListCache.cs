@@ -0,0 +1,105 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Globalization;
+using System.IO;
+using System.Linq;
+using System.Net;
+using System.Text;
+using System.Threading;
+using System.Threading.Tasks;
+using Newtonsoft.Json.Linq;
+
+namespace Inedo.UPack.CLI
+{
+    // Requests the versions endpoint of a feed itself rather than through the feed client, so that the response can be kept in
+    // the user registry with its ETag and Last-Modified headers and revalidated with If-None-Match and If-Modified-Since; a
+    // 304 response reuses the stored list instead of downloading it again.
+    internal static class VersionListCache
+    {
+        public static async Task<IReadOnlyList<FeedVersion>> GetAsync(string feedUrl, NetworkCredential credentials, UniversalPackageId id, CancellationToken cancellationToken)
+        {
+            var url = GetVersionsUrl(feedUrl, id);
+
+            // the cache only saves requests, so a registry that cannot be read or written is the same as an empty one
+            using (var registry = Registry.GetRegistry(true))
+            {
+                CachedVersionList cached = null;
+                try
+                {
+                    cached = registry.TryReadVersionList(url, credentials?.UserName);
+                }
+                catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException)
+                {
+                    Log.Debug($"Unable to read the version cache: {ex.Message}");
+                }
+
+                CachedVersionList list;
+                try
+                {
+                    list = await FeedHttp.SendAsync(() => GetListAsync(url, credentials, cached), cancellationToken);
+                }
+                catch (WebException ex) when (cached != null && (ex.Response as HttpWebResponse)?.StatusCode == HttpStatusCode.NotModified)
+                {
+                    ex.Response.Dispose();
+                    Log.Verbose($"The versions of {id} have not changed since they were cached.");
+                    return Parse(cached.Body);
+                }
+
+                try
+                {
+                    registry.WriteVersionList(list);
+                }
+                catch (Exception ex) when (ex is IOException || ex is UnauthorizedAccessException)
+                {
+                    Log.Debug($"Unable to write the version cache: {ex.Message}");
+                }
+
+                return Parse(list.Body);
+            }
+        }
+
+        private static async Task<CachedVersionList> GetListAsync(string url, NetworkCredential credentials, CachedVersionList cached)
+        {
+            var request = FeedHttp.CreateRequest(url, credentials);
+            request.Accept = "application/json";
+
+            if (!string.IsNullOrEmpty(cached?.ETag))
+                request.Headers[HttpRequestHeader.IfNoneMatch] = cached.ETag;
+
+            if (DateTime.TryParseExact(cached?.LastModified, "r", CultureInfo.InvariantCulture, DateTimeStyles.AdjustToUniversal | DateTimeStyles.AssumeUniversal, out var lastModified))
+                request.IfModifiedSince = lastModified;
+
+            using (var response = (HttpWebResponse)await request.GetResponseAsync())
+            using (var reader = new StreamReader(response.GetResponseStream(), Encoding.UTF8))
+            {
+                Log.DebugHeaders("<", response.Headers);
+                return new CachedVersionList
+                {
+                    Url = url,
+                    UserName = credentials?.UserName,
+                    ETag = response.Headers[HttpResponseHeader.ETag],
+                    LastModified = response.Headers[HttpResponseHeader.LastModified],
+                    Body = await reader.ReadToEndAsync()
+                };
+            }
+        }
+
+        private static string GetVersionsUrl(string feedUrl, UniversalPackageId id)
+        {
+            var url = new StringBuilder(feedUrl.TrimEnd('/')).Append("/versions?");
+            if (!string.IsNullOrEmpty(id.Group))
+                url.Append("group=").Append(Uri.EscapeDataString(id.Group)).Append('&');
+
+            return url.Append("name=").Append(Uri.EscapeDataString(id.Name)).ToString();
+        }
+
+        private static IReadOnlyList<FeedVersion> Parse(string body)
+        {
+            return JArray.Parse(body)
+                .OfType<JObject>()
+                .Select(FeedVersion.FromJson)
+                .Where(v => v != null)
+                .ToList();
+        }
+    }
+}
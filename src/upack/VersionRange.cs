@@ -0,0 +1,182 @@
+﻿using System;
+using System.Collections.Generic;
+using System.Linq;
+using System.Numerics;
+using System.Text.RegularExpressions;
+
+namespace Inedo.UPack.CLI
+{
+    // A version constraint such as "^2.3", "~1.4.2", "2.x", "1.2.*", or ">=1.2 <2.0"; alternatives may be separated with "||".
+    // x, X, and * are interchangeable wildcards, so "1.2.*" matches any patch of 1.2 and "1.*" any minor version of 1.
+    public sealed class VersionRange
+    {
+        private static readonly Regex ComparatorRegex = new Regex(@"^(?<op>\^|~|>=|<=|>|<|=)?\s*v?(?<major>\d+|[xX*])(?:\.(?<minor>\d+|[xX*]))?(?:\.(?<patch>\d+|[xX*]))?(?:-(?<pre>[0-9A-Za-z.-]+))?$", RegexOptions.ExplicitCapture);
+
+        private readonly List<List<Comparator>> alternatives;
+
+        private VersionRange(string text, List<List<Comparator>> alternatives)
+        {
+            this.Text = text;
+            this.alternatives = alternatives;
+        }
+
+        public string Text { get; }
+
+        public static VersionRange TryParse(string text)
+        {
+            if (string.IsNullOrWhiteSpace(text))
+                return null;
+
+            var alternatives = new List<List<Comparator>>();
+            foreach (var alternative in text.Split(new[] { "||" }, StringSplitOptions.None))
+            {
+                // allow "> = 1.2" style spacing by joining operators to the version that follows them
+                var parts = Regex.Split(alternative.Trim(), @"(?<=[^<>=^~\s])\s+");
+                var comparators = new List<Comparator>();
+                foreach (var part in parts)
+                {
+                    if (string.IsNullOrWhiteSpace(part))
+                        continue;
+
+                    var parsed = ParseComparator(part.Trim());
+                    if (parsed == null)
+                        return null;
+
+                    comparators.AddRange(parsed);
+                }
+
+                if (comparators.Count == 0)
+                    return null;
+
+                alternatives.Add(comparators);
+            }
+
+            return new VersionRange(text.Trim(), alternatives);
+        }
+
+        // Prerelease versions only match when includePrerelease is set or a comparator names a prerelease of the same version.
+        public bool IsMatch(UniversalPackageVersion version, bool includePrerelease)
+        {
+            return this.alternatives.Any(
+                comparators => comparators.All(c => c.IsMatch(version))
+                    && (string.IsNullOrEmpty(version.Prerelease) || includePrerelease || comparators.Any(c => c.AllowsPrereleaseOf(version)))
+            );
+        }
+
+        public override string ToString() => this.Text;
+
+        private static IEnumerable<Comparator> ParseComparator(string text)
+        {
+            var match = ComparatorRegex.Match(text);
+            if (!match.Success)
+                return null;
+
+            var op = match.Groups["op"].Value;
+            var major = ParsePart(match.Groups["major"]);
+            var minor = ParsePart(match.Groups["minor"]);
+            var patch = ParsePart(match.Groups["patch"]);
+            var prerelease = match.Groups["pre"].Success ? match.Groups["pre"].Value : null;
+
+            if (major == null)
+                return new[] { new Comparator(">=", new UniversalPackageVersion(0, 0, 0)) };
+            if ((minor == null && patch != null) || (prerelease != null && patch == null))
+                return null;
+
+            var lower = new UniversalPackageVersion(major.Value, minor ?? 0, patch ?? 0, prerelease, null);
+
+            switch (op)
+            {
+                case "^":
+                    if (major > 0 || minor == null)
+                        return Between(lower, new UniversalPackageVersion(major.Value + 1, 0, 0));
+                    if (minor > 0 || patch == null)
+                        return Between(lower, new UniversalPackageVersion(0, minor.Value + 1, 0));
+                    return Between(lower, new UniversalPackageVersion(0, 0, patch.Value + 1));
+
+                case "~":
+                    if (minor == null)
+                        return Between(lower, new UniversalPackageVersion(major.Value + 1, 0, 0));
+                    return Between(lower, new UniversalPackageVersion(major.Value, minor.Value + 1, 0));
+
+                case ">":
+                    // "> 1.2" excludes every 1.2.x version
+                    if (minor == null)
+                        return new[] { new Comparator(">=", new UniversalPackageVersion(major.Value + 1, 0, 0)) };
+                    if (patch == null)
+                        return new[] { new Comparator(">=", new UniversalPackageVersion(major.Value, minor.Value + 1, 0)) };
+                    return new[] { new Comparator(">", lower) };
+
+                case "<=":
+                    // "<= 1.2" includes every 1.2.x version
+                    if (minor == null)
+                        return new[] { new Comparator("<", new UniversalPackageVersion(major.Value + 1, 0, 0)) };
+                    if (patch == null)
+                        return new[] { new Comparator("<", new UniversalPackageVersion(major.Value, minor.Value + 1, 0)) };
+                    return new[] { new Comparator("<=", lower) };
+
+                case ">=":
+                case "<":
+                    return new[] { new Comparator(op, lower) };
+
+                default:
+                    // a partial version without an operator, such as "2" or "2.3.x", matches anything with that prefix
+                    if (minor == null)
+                        return Between(lower, new UniversalPackageVersion(major.Value + 1, 0, 0));
+                    if (patch == null)
+                        return Between(lower, new UniversalPackageVersion(major.Value, minor.Value + 1, 0));
+                    return new[] { new Comparator("=", lower) };
+            }
+        }
+
+        private static BigInteger? ParsePart(Group group)
+        {
+            if (!group.Success || !char.IsDigit(group.Value[0]))
+                return null;
+
+            return BigInteger.Parse(group.Value);
+        }
+
+        private static IEnumerable<Comparator> Between(UniversalPackageVersion lower, UniversalPackageVersion upper)
+        {
+            return new[] { new Comparator(">=", lower), new Comparator("<", upper) };
+        }
+
+        private sealed class Comparator
+        {
+            public Comparator(string op, UniversalPackageVersion version)
+            {
+                this.Operator = op;
+                this.Version = version;
+            }
+
+            public string Operator { get; }
+            public UniversalPackageVersion Version { get; }
+
+            public bool IsMatch(UniversalPackageVersion version)
+            {
+                int result = UniversalPackageVersion.Compare(version, this.Version);
+                switch (this.Operator)
+                {
+                    case ">=":
+                        return result >= 0;
+                    case ">":
+                        return result > 0;
+                    case "<=":
+                        return result <= 0;
+                    case "<":
+                        return result < 0;
+                    default:
+                        return result == 0;
+                }
+            }
+
+            public bool AllowsPrereleaseOf(UniversalPackageVersion version)
+            {
+                return !string.IsNullOrEmpty(this.Version.Prerelease)
+                    && this.Version.Major == version.Major
+                    && this.Version.Minor == version.Minor
+                    && this.Version.Patch == version.Patch;
+            }
+        }
+    }
+}
@@ -0,0 +1,50 @@
+﻿using System;
+using System.Collections.Generic;
+using System.ComponentModel;
+using System.Linq;
+using System.Threading;
+using System.Threading.Tasks;
+
+namespace Inedo.UPack.CLI
+{
+    [DisplayName("version sort")]
+    [Description("Reads universal package versions from standard input, one per line, and outputs them in version order.")]
+    public sealed class VersionSort : Command
+    {
+        [DisplayName("descending")]
+        [Description("Output the highest version first.")]
+        [ExtraArgument]
+        [DefaultValue(false)]
+        public bool Descending { get; set; } = false;
+
+        public override async Task<int> RunAsync(CancellationToken cancellationToken)
+        {
+            var versions = new List<KeyValuePair<string, UniversalPackageVersion>>();
+
+            string line;
+            int lineNumber = 0;
+            while ((line = await Console.In.ReadLineAsync()) != null)
+            {
+                lineNumber++;
+                line = line.Trim();
+                if (line.Length == 0)
+                    continue;
+
+                var version = UniversalPackageVersion.TryParse(line);
+                if (version == null)
+                    throw new UpackException(ExitCode.ValidationFailed, $"Invalid UPack version number on line {lineNumber}: {line}")
+                    {
+                        Code = ErrorCodes.InvalidVersion
+                    };
+
+                versions.Add(new KeyValuePair<string, UniversalPackageVersion>(line, version));
+            }
+
+            var sorted = this.Descending ? versions.OrderByDescending(v => v.Value) : versions.OrderBy(v => v.Value);
+            foreach (var version in sorted)
+                Console.WriteLine(version.Key);
+
+            return 0;
+        }
+    }
+}